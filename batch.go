@@ -2,71 +2,113 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+type batchTask struct {
+	input    string
+	defaults *Config // options shared by the series, nil if not a series
+	index    int     // position of the book in the series
+}
+
 type taskResult struct {
-	input string
-	e     error
+	input  string
+	e      error
+	output []byte // log of the task
 }
 
-var (
-	chTaskResult chan *taskResult
-)
+const path_of_series_ini = "series.ini"
 
-func runTask(input string, outdir string) {
+func runTask(task *batchTask, outdir string) *taskResult {
 	var (
-		maker  = NewEpubMaker(logger)
+		buf    = new(bytes.Buffer)
+		maker  = NewEpubMaker(log.New(buf, logger.Prefix(), logger.Flags()))
 		folder VirtualFolder
-		tr     = &taskResult{input: input}
+		tr     = &taskResult{input: task.input}
 		duokan = !getFlagBool("noduokan")
 		ver    = EPUB_VERSION_300
 	)
 	if getFlagBool("epub2") {
 		ver = EPUB_VERSION_200
 	}
-	if folder, tr.e = OpenVirtualFolder(input); tr.e != nil {
-		logger.Printf("%s: failed to open source folder/file.\n", input)
+	maker.SetConfigFile(getFlagValue("config", ""))
+	maker.SetGlobalConfigFile(getGlobalConfigPath())
+	maker.SetLogLevel(getLogLevel())
+	maker.SetOpds(getFlagBool("opds"))
+	maker.SetStrict(getFlagBool("strict"))
+	maker.SetUnpacked(getFlagBool("unpacked"))
+	maker.SetRequireUtf8(getFlagBool("require-utf8"))
+	maker.SetDefaultConfig(task.defaults)
+	maker.SetSeriesIndex(task.index)
+	if folder, tr.e = OpenBookFolder(task.input); tr.e != nil {
+		fmt.Fprintf(buf, "%s%s: failed to open source folder/file.\n", logger.Prefix(), task.input)
 	} else if tr.e = maker.Process(folder, duokan); tr.e == nil {
 		tr.e = maker.SaveTo(outdir, ver)
 	}
 
-	chTaskResult <- tr
+	tr.output = buf.Bytes()
+	return tr
 }
 
-func processBatchFile(f *os.File, outdir string) (count int, e error) {
+func readBatchFile(f *os.File) ([]*batchTask, error) {
+	var tasks []*batchTask
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		name := strings.TrimSpace(scanner.Text())
 		if len(name) > 0 {
-			go runTask(name, outdir)
-			count++
+			tasks = append(tasks, &batchTask{input: name})
 		}
 	}
-	if e = scanner.Err(); e != nil {
+	if e := scanner.Err(); e != nil {
 		logger.Println("error reading batch file.")
+		return tasks, e
 	}
 
-	return
+	return tasks, nil
 }
 
-func processBatchFolder(f *os.File, outdir string) (count int, e error) {
+func readBatchFolder(f *os.File) ([]*batchTask, error) {
 	names, e := f.Readdirnames(-1)
 	if e != nil {
 		logger.Println("error reading source folder.")
-		return 0, e
+		return nil, e
 	}
 
+	// books in a folder with 'series.ini' are a series, they share the
+	// options in it, and are ordered by name
+	var defaults *Config
 	for _, name := range names {
-		name = filepath.Join(f.Name(), name)
-		go runTask(name, outdir)
-		count++
+		if strings.ToLower(name) == path_of_series_ini {
+			if defaults, e = OpenIniFile(filepath.Join(f.Name(), name)); e != nil {
+				logger.Println("error reading series configuration.")
+				return nil, e
+			}
+			defaults.ResolvePath("/output/sign", f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var tasks []*batchTask
+	for _, name := range names {
+		if strings.ToLower(name) == path_of_series_ini {
+			continue
+		}
+		task := &batchTask{input: filepath.Join(f.Name(), name)}
+		if defaults != nil {
+			task.defaults, task.index = defaults, len(tasks)+1
+		}
+		tasks = append(tasks, task)
 	}
 
-	return count, nil
+	return tasks, nil
 }
 
 func RunBatch() {
@@ -82,30 +124,59 @@ func RunBatch() {
 
 	outpath := getArg(1, "")
 
-	runtime.GOMAXPROCS(runtime.NumCPU() + 1)
-	chTaskResult = make(chan *taskResult)
-	defer close(chTaskResult)
+	jobs, e := strconv.Atoi(getFlagValue("jobs", "1"))
+	if e != nil || jobs < 1 {
+		onCommandLineError()
+	}
 
-	var count int
-	var e error
+	var tasks []*batchTask
 	if fi, _ := input.Stat(); fi.IsDir() {
-		count, e = processBatchFolder(input, outpath)
+		tasks, e = readBatchFolder(input)
 	} else {
-		count, e = processBatchFile(input, outpath)
+		tasks, e = readBatchFile(input)
 	}
 
-	if e != nil && count == 0 {
+	if e != nil && len(tasks) == 0 {
+		exitCode = 1
 		return
 	}
 
-	failed := 0
+	runtime.GOMAXPROCS(runtime.NumCPU() + 1)
+	chTask := make(chan *batchTask)
+	chTaskResult := make(chan *taskResult)
+
+	// tasks are handed out in order, so the output is deterministic if
+	// there's only one worker
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for task := range chTask {
+				chTaskResult <- runTask(task, outpath)
+			}
+		}()
+	}
+	go func() {
+		for _, task := range tasks {
+			chTask <- task
+		}
+		close(chTask)
+	}()
+
+	count, failed := len(tasks), 0
 	for i := 0; i < count; i++ {
-		if (<-chTaskResult).e != nil {
+		tr := <-chTaskResult
+		os.Stderr.Write(tr.output)
+		if tr.e != nil {
+			logger.Printf("%s: failed.\n", tr.input)
 			failed++
+		} else {
+			logger.Printf("%s: succeeded.\n", tr.input)
 		}
 	}
 
 	logger.Printf("total: %d   succeeded: %d    failed: %d\n", count, count-failed, failed)
+	if failed > 0 {
+		exitCode = 1
+	}
 }
 
 func init() {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// If option 'track_chapter_mtime' of section 'build' is enabled, the source
+// files of every chapter file and their modification time are recorded in
+// 'META-INF/chapter_mtimes.json', so downstream tools can tell which chapters
+// are changed, the modification time of the chapter entries in the archive is
+// also set to the time of their sources.
+
+const path_of_chapter_mtimes = "chapter_mtimes.json"
+
+// chapterMtime is the record of a chapter file in 'chapter_mtimes.json'
+type chapterMtime struct {
+	Path     string    `json:"path"`
+	Sources  []string  `json:"sources"`
+	Modified time.Time `json:"modified"`
+}
+
+// markSource records that the content from source file 'path' starts at the
+// first element of 'body'
+func (this *EpubMaker) markSource(body *html.Node, path string) {
+	if !this.track_mtime {
+		return
+	}
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		if this.sources == nil {
+			this.sources = make(map[*html.Node]string)
+		}
+		this.sources[n] = path
+		return
+	}
+}
+
+// chapterSources returns the source files of the content of 'body', which is
+// the body of the chapter to be saved, it must be called before the header
+// & footer templates are inserted
+func (this *EpubMaker) chapterSources(body *html.Node) []string {
+	var result []string
+	if len(this.source) > 0 {
+		result = []string{this.source}
+	}
+	content := false
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if isBlankNode(n) {
+			continue
+		}
+		if p, ok := this.sources[n]; ok {
+			// the previous source file has no content in this chapter
+			if !content {
+				result = nil
+			}
+			result = append(result, p)
+			this.source = p
+		}
+		content = true
+	}
+	return result
+}
+
+// sourceModTime returns the latest modification time of 'sources', it is zero
+// if unknown
+func (this *EpubMaker) sourceModTime(sources []string) time.Time {
+	var result time.Time
+	mtf, ok := this.folder.(ModTimeFolder)
+	if !ok {
+		return result
+	}
+	for _, p := range sources {
+		if t, e := mtf.ModTime(p); e == nil && t.After(result) {
+			result = t
+		}
+	}
+	return result
+}
+
+// recordChapterMtime records the sources & modification time of the content
+// file which is added to the book last
+func (this *EpubMaker) recordChapterMtime(sources []string, modified time.Time) {
+	files := this.book.Files()
+	f := files[len(files)-1]
+	if !modified.IsZero() {
+		f.ModTime = modified
+	}
+	if sources == nil {
+		sources = []string{}
+	}
+	this.chapter_mtimes = append(this.chapter_mtimes, chapterMtime{Path: f.Path, Sources: sources, Modified: modified})
+}
+
+// addChapterMtimes adds 'chapter_mtimes.json' to the 'META-INF' folder
+func (this *EpubMaker) addChapterMtimes() {
+	if this.chapter_mtimes == nil {
+		this.chapter_mtimes = []chapterMtime{}
+	}
+	data, e := json.MarshalIndent(this.chapter_mtimes, "", "\t")
+	if e == nil {
+		e = this.book.AddMetaInfFile(path_of_chapter_mtimes, data)
+	}
+	if e != nil {
+		this.writeWarning("failed to record modification time of chapters: " + e.Error())
+	}
+}
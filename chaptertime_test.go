@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChapterMtime(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\ncontent_files=a.html,b.html\n" +
+			"[build]\nchapter_name_pattern=chapter-{n}.html\ntrack_chapter_mtime=true\n",
+		"a.html": "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"b.html": "<html><head></head><body><h1>Three</h1><p>3</p></body></html>",
+	}
+	for name, s := range files {
+		if e := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0666); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ta := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tb := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{"a.html": ta, "b.html": tb} {
+		if e := os.Chtimes(filepath.Join(dir, name), mtime, mtime); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	maker := NewEpubMaker(testLogger)
+	if e := maker.Process(OpenSystemFolder(dir), false); e != nil {
+		t.Fatal(e)
+	}
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	var records []chapterMtime
+	if e := json.Unmarshal([]byte(readEntry(t, zr, "META-INF/"+path_of_chapter_mtimes)), &records); e != nil {
+		t.Fatal(e)
+	}
+	want := []chapterMtime{
+		{Path: "chapter-1.html", Sources: []string{"a.html"}, Modified: ta},
+		{Path: "chapter-2.html", Sources: []string{"a.html"}, Modified: ta},
+		{Path: "chapter-3.html", Sources: []string{"b.html"}, Modified: tb},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got records %v, want %v", records, want)
+	}
+	for i, r := range records {
+		if r.Path != want[i].Path || !reflect.DeepEqual(r.Sources, want[i].Sources) || !r.Modified.Equal(want[i].Modified) {
+			t.Errorf("record %d is %v, want %v", i, r, want[i])
+		}
+		// the entries in the archive have the time of their sources
+		if f := findEntry(zr, r.Path); f == nil || !f.Modified.Equal(want[i].Modified) {
+			t.Errorf("modification time of '%s' is not '%s'", r.Path, want[i].Modified)
+		}
+	}
+}
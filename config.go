@@ -5,17 +5,62 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type Config struct {
-	data map[string]string
+	data      map[string]string
+	undefined []string // undefined environment variables referenced by values
 }
 
+var reEnvVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces '${VAR}' in 'v' with the value of environment variable
+// 'VAR', undefined variables are replaced by empty string and recorded
+func (cfg *Config) expandEnv(v string) string {
+	return reEnvVar.ReplaceAllStringFunc(v, func(m string) string {
+		name := m[2 : len(m)-1]
+		if val, ok := os.LookupEnv(name); ok {
+			return val
+		}
+		cfg.addUndefined(name)
+		return ""
+	})
+}
+
+func (cfg *Config) addUndefined(name string) {
+	for _, n := range cfg.undefined {
+		if n == name {
+			return
+		}
+	}
+	cfg.undefined = append(cfg.undefined, name)
+}
+
+func NewConfig() *Config {
+	return &Config{data: make(map[string]string)}
+}
+
+// ParseIni parses the configuration in 'reader', values are kept as is
 func ParseIni(reader io.Reader) (*Config, error) {
-	section, lastKey, cfg := "/", "", make(map[string]string)
+	return parseIni(reader, false)
+}
+
+// ParseIniExpandEnv is the same as 'ParseIni', but '${VAR}' in values are
+// replaced by environment variables, so it is only for trusted files, an
+// uploaded book must not be able to read the environment of the server
+func ParseIniExpandEnv(reader io.Reader) (*Config, error) {
+	return parseIni(reader, true)
+}
+
+func parseIni(reader io.Reader, expand bool) (*Config, error) {
+	section, lastKey, result := "/", "", NewConfig()
 	firstLine, scanner := true, bufio.NewScanner(reader)
+	cfg := result.data
 
 	for scanner.Scan() {
 		s := scanner.Bytes()
@@ -41,6 +86,9 @@ func ParseIni(reader io.Reader) (*Config, error) {
 		if i := bytes.IndexByte(s, '='); i != -1 {
 			k = string(bytes.ToLower(bytes.TrimSpace(s[:i])))
 			v = string(bytes.TrimSpace(s[i+1:]))
+			if expand {
+				v = result.expandEnv(v)
+			}
 		}
 
 		if len(k) > 0 {
@@ -70,9 +118,12 @@ func ParseIni(reader io.Reader) (*Config, error) {
 		return nil, e
 	}
 
-	return &Config{data: cfg}, nil
+	return result, nil
 }
 
+// OpenIniFile parses the configuration file at 'path' with environment
+// variables expanded, it is for files specified by the user, like the global
+// configuration, the '-config' file and 'series.ini'
 func OpenIniFile(path string) (*Config, error) {
 	f, e := os.Open(path)
 	if e != nil {
@@ -80,7 +131,31 @@ func OpenIniFile(path string) (*Config, error) {
 	}
 	defer f.Close()
 
-	return ParseIni(f)
+	return ParseIniExpandEnv(f)
+}
+
+// Merge copies all values of 'other' into 'cfg', values in 'other' win
+func (cfg *Config) Merge(other *Config) {
+	for k, v := range other.data {
+		cfg.data[k] = v
+	}
+	for _, n := range other.undefined {
+		cfg.addUndefined(n)
+	}
+}
+
+// ResolvePath makes the relative path in option 'path' relative to folder
+// 'dir' instead of the working directory, it does nothing if the option is
+// empty or absolute
+func (cfg *Config) ResolvePath(path string, dir string) {
+	v := cfg.data[path]
+	if len(v) > 0 && !filepath.IsAbs(v) {
+		cfg.data[path] = filepath.Join(dir, v)
+	}
+}
+
+func (cfg *Config) UndefinedVariables() []string {
+	return cfg.undefined
 }
 
 func (cfg *Config) GetInt(path string, dflt int) int {
@@ -110,3 +185,28 @@ func (cfg *Config) GetBool(path string, dflt bool) bool {
 	}
 	return dflt
 }
+
+// Keys returns the paths of all options, sorted
+func (cfg *Config) Keys() []string {
+	keys := make([]string, 0, len(cfg.data))
+	for k := range cfg.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetSection returns the names (sorted) and values of all options in 'section'
+func (cfg *Config) GetSection(section string) ([]string, map[string]string) {
+	prefix := "/" + strings.ToLower(strings.Trim(section, "/")) + "/"
+	names, values := make([]string, 0), make(map[string]string)
+	for k, v := range cfg.data {
+		if strings.HasPrefix(k, prefix) {
+			name := k[len(prefix):]
+			names = append(names, name)
+			values[name] = v
+		}
+	}
+	sort.Strings(names)
+	return names, values
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIniExpandEnv(t *testing.T) {
+	t.Setenv("MAKEEPUB_TEST_VERSION", "1.2")
+	t.Setenv("MAKEEPUB_TEST_UNDEFINED", "")
+	os.Unsetenv("MAKEEPUB_TEST_UNDEFINED")
+
+	ini := "[book]\n" +
+		"name=Book ${MAKEEPUB_TEST_VERSION}\n" +
+		"author=${MAKEEPUB_TEST_UNDEFINED}Someone\n" +
+		"publisher=${MAKEEPUB_TEST_UNDEFINED}\n"
+	cfg, e := ParseIniExpandEnv(strings.NewReader(ini))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if s := cfg.GetString("/book/name", ""); s != "Book 1.2" {
+		t.Errorf("defined variable: got '%s', want 'Book 1.2'", s)
+	}
+	if s := cfg.GetString("/book/author", ""); s != "Someone" {
+		t.Errorf("undefined variable: got '%s', want 'Someone'", s)
+	}
+	if u := cfg.UndefinedVariables(); len(u) != 1 || u[0] != "MAKEEPUB_TEST_UNDEFINED" {
+		t.Errorf("undefined variables: got %v, want [MAKEEPUB_TEST_UNDEFINED]", u)
+	}
+
+	// 'ParseIni' does not expand environment variables
+	if cfg, e = ParseIni(strings.NewReader(ini)); e != nil {
+		t.Fatal(e)
+	}
+	if s := cfg.GetString("/book/name", ""); s != "Book ${MAKEEPUB_TEST_VERSION}" {
+		t.Errorf("not expanded: got '%s', want 'Book ${MAKEEPUB_TEST_VERSION}'", s)
+	}
+	if u := cfg.UndefinedVariables(); len(u) != 0 {
+		t.Errorf("not expanded: got undefined variables %v", u)
+	}
+}
+
+func TestServerNotExpandEnv(t *testing.T) {
+	t.Setenv("MAKEEPUB_TEST_SECRET", "secret")
+	data := makeZip(t, map[string]string{
+		"book.ini":  "[book]\nname=${MAKEEPUB_TEST_SECRET}\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	}, time.Now())
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	w, e := mw.CreateFormFile("input", "book.zip")
+	if e == nil {
+		_, e = w.Write(data)
+	}
+	if e == nil {
+		e = mw.Close()
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	r := httptest.NewRequest("POST", "/convert", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	if e = doConvert(log.New(ioutil.Discard, "", 0), rec, r); e != nil {
+		t.Fatal(e)
+	}
+
+	book := rec.Body.Bytes()
+	zr, e := zip.NewReader(bytes.NewReader(book), int64(len(book)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	opf := readEntry(t, zr, "content.opf")
+	if strings.Contains(opf, "secret") {
+		t.Errorf("environment variable is expanded in server mode:\n%s", opf)
+	}
+	if !strings.Contains(opf, "${MAKEEPUB_TEST_SECRET}") {
+		t.Errorf("book name is not kept as is:\n%s", opf)
+	}
+}
+
+func TestGlobalConfig(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(dir, "global.ini")
+	ini := "[book]\nname=Global\npublisher=House\nlanguage=fr\n"
+	if e := ioutil.WriteFile(global, []byte(ini), 0666); e != nil {
+		t.Fatal(e)
+	}
+
+	maker := NewEpubMaker(testLogger)
+	maker.SetGlobalConfigFile(global)
+	e := maker.Process(NewMemoryFolder(map[string][]byte{
+		"book.ini":  []byte("[book]\nname=Test\nauthor=Tester\n"),
+		"book.html": []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+	}), false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// values of 'book.ini' take precedence
+	if s := maker.book.Name(); s != "Test" {
+		t.Errorf("name is '%s', want 'Test'", s)
+	}
+	if s := maker.book.Publisher(); s != "House" {
+		t.Errorf("publisher is '%s', want 'House'", s)
+	}
+	if s := maker.book.Language(); s != "fr" {
+		t.Errorf("language is '%s', want 'fr'", s)
+	}
+}
+
+func TestGlobalConfigPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("MAKEEPUB_CONFIG", "")
+	if p := getGlobalConfigPath(); p != "" {
+		t.Errorf("got '%s' without a global configuration file", p)
+	}
+	p := filepath.Join(home, path_of_global_config)
+	if e := ioutil.WriteFile(p, []byte("[book]\n"), 0666); e != nil {
+		t.Fatal(e)
+	}
+	if s := getGlobalConfigPath(); s != p {
+		t.Errorf("got '%s', want '%s'", s, p)
+	}
+	// the environment variable takes precedence
+	t.Setenv("MAKEEPUB_CONFIG", "/other.ini")
+	if s := getGlobalConfigPath(); s != "/other.ini" {
+		t.Errorf("got '%s', want '/other.ini'", s)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// isCjkLanguage reports whether words of language 'lang' are not separated
+// by white spaces, so characters are counted instead of words
+func isCjkLanguage(lang string) bool {
+	lang = strings.ToLower(lang)
+	return strings.HasPrefix(lang, "zh") || strings.HasPrefix(lang, "ja")
+}
+
+// countText returns the number of words in 'text', or the number of letters
+// and digits if 'cjk' is true
+func countText(text string, cjk bool) int {
+	if !cjk {
+		return len(strings.Fields(text))
+	}
+	count := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			count++
+		}
+	}
+	return count
+}
+
+// bodyText returns the text in the 'body' of html file 'data', content of
+// 'script' and 'style' elements is excluded
+func bodyText(data []byte) string {
+	root, e := html.Parse(bytes.NewReader(data))
+	if e != nil {
+		return ""
+	}
+	body := findFirstChild(root, atom.Body)
+	if body == nil {
+		return ""
+	}
+
+	buf := new(bytes.Buffer)
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type == html.TextNode {
+				buf.WriteString(n.Data)
+				buf.WriteByte(' ')
+			} else if n.Type == html.ElementNode && n.DataAtom != atom.Script && n.DataAtom != atom.Style {
+				walk(n)
+			}
+		}
+	}
+	walk(body)
+	return buf.String()
+}
+
+// countWords returns the number of words (or characters for CJK languages)
+// in all content files of the book
+func (this *EpubMaker) countWords() int {
+	cjk, count := isCjkLanguage(this.book.Language()), 0
+	for _, f := range this.book.ContentFiles() {
+		if isHtmlFile(f.Path) {
+			count += countText(bodyText(f.Data), cjk)
+		}
+	}
+	return count
+}
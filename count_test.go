@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountText(t *testing.T) {
+	if n := countText(" Hello, world!\n\tfoo  bar ", false); n != 4 {
+		t.Errorf("got %d words, want 4", n)
+	}
+	if n := countText("中文，字数 12。", true); n != 6 {
+		t.Errorf("got %d characters, want 6", n)
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\nlanguage=en\n[build]\ncount=true\n",
+		"book.html": "<html><head><style>p { color: red; }</style></head><body><h1>One</h1><p>two <b>three</b></p><script>var four;</script><h1>Five</h1></body></html>",
+	})
+	const meta = "<meta name=\"calibre:word_count\" content=\"4\"/>"
+	for _, version := range []int{EPUB_VERSION_200, EPUB_VERSION_300} {
+		opf := readEntry(t, buildArchive(t, maker.book, version), "content.opf")
+		if !strings.Contains(opf, meta) {
+			t.Errorf("'%s' is not in the OPF of version %d:\n%s", meta, version, opf)
+		}
+		if strings.Contains(opf, "property=\"calibre:") {
+			t.Errorf("undeclared prefix 'calibre' is used in the OPF of version %d:\n%s", version, opf)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/atom"
+)
+
+// diagnose returns the problems of the source folder which are not reported
+// as warnings during processing, it must be called after 'Process'
+func (this *EpubMaker) diagnose() []string {
+	var result []string
+
+	if len(this.book.CoverImage()) == 0 {
+		result = append(result, "the book has no cover image, add 'cover.png', 'cover.jpg' or 'cover.gif' to the root folder, or specify it by option 'cover' of section 'book'.")
+	}
+
+	for _, f := range this.files {
+		if isTextFile(f.path) && !utf8.Valid(f.data) {
+			result = append(result, fmt.Sprintf("'%s' is not valid UTF-8, convert it to UTF-8.", f.path))
+		}
+	}
+
+	// headers which are not direct children of 'body' are not split points
+	if root, e := this.parseBook(); e == nil {
+		body := findFirstChild(root, atom.Body)
+		for _, a := range []atom.Atom{atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6} {
+			for _, h := range findChildren(body, a) {
+				if h.Parent == body || hasClass(h, makeepub_not_chapter) || hasClass(h.Parent, makeepub_chapter) {
+					continue
+				}
+				result = append(result, fmt.Sprintf(
+					"<%s>%s</%s> is not a direct child of 'body', so it is not a split point, move it out of <%s>.",
+					h.Data, strings.TrimSpace(nodeText(h)), h.Data, h.Parent.Data))
+			}
+		}
+	}
+
+	return result
+}
+
+// RunDoctor inspects the source folder and reports the problems without
+// creating the book
+func RunDoctor() {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 {
+		onCommandLineError()
+	}
+	folder, e := OpenBookFolder(inpath)
+	if e != nil {
+		logger.Fatalf("%s: failed to open source folder/file.\n", inpath)
+	}
+
+	maker := NewEpubMaker(logger)
+	maker.SetLogLevel(getLogLevel())
+	maker.SetConfigFile(getFlagValue("config", ""))
+	maker.SetGlobalConfigFile(getGlobalConfigPath())
+	if e = maker.Process(folder, true); e != nil {
+		logger.Printf("%s: the book cannot be created, please fix the errors above.\n", inpath)
+		exitCode = 1
+		return
+	}
+
+	problems := maker.diagnose()
+	for _, msg := range problems {
+		maker.writeWarning(msg)
+	}
+	if maker.warnings == 0 {
+		logger.Printf("%s: no problem found.\n", inpath)
+		return
+	}
+	logger.Printf("%s: %d problem(s) found.\n", inpath, maker.warnings)
+	exitCode = 1
+}
+
+func init() {
+	AddCommandHandler("doctor", RunDoctor)
+}
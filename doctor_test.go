@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body>" +
+			"<h1>One</h1><p>1</p><div><h1>Two</h1></div><p>2</p></body></html>",
+		"style.css": "p { font-family: \"\xff\"; }",
+	})
+	problems := maker.diagnose()
+	for _, want := range []string{
+		"the book has no cover image",
+		"'style.css' is not valid UTF-8",
+		"<h1>Two</h1> is not a direct child of 'body'",
+	} {
+		found := false
+		for _, msg := range problems {
+			found = found || strings.Contains(msg, want)
+		}
+		if !found {
+			t.Errorf("'%s' is not reported, problems are:\n%s", want, strings.Join(problems, "\n"))
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("got %d problems, want 3:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+}
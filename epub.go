@@ -3,10 +3,15 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/xml"
 	"fmt"
 	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +23,10 @@ const (
 	path_of_content_opf   = "content.opf"
 	path_of_container_xml = "META-INF/container.xml"
 	path_of_cover_page    = "cover.html"
+	path_of_colophon      = "colophon.xhtml"
+	path_of_back_cover    = "back_cover.html"
+	path_of_title_page    = "titlepage.xhtml"
+	path_of_part_page     = "part.xhtml"
 
 	EPUB_VERSION_NONE = iota // no version, pack all raw files into a zip package
 	EPUB_VERSION_200         // epub version 2.0
@@ -36,15 +45,31 @@ var (
 		".css":   "text/css",
 		".txt":   "text/plain",
 		".xml":   "text/xml",
+		".json":  "application/json",
 		".xhtml": "application/xhtml+xml",
 		".ncx":   "application/x-dtbncx+xml",
 		".jpg":   "image/jpeg",
 		".jpeg":  "image/jpeg",
 		".gif":   "image/gif",
 		".png":   "image/png",
+		".webp":  "image/webp",
+		".avif":  "image/avif",
 		".bmp":   "image/bmp",
 		".otf":   "application/x-font-opentype",
 		".ttf":   "application/x-font-ttf",
+		".woff":  "font/woff",
+		".woff2": "font/woff2",
+		".mp3":   "audio/mpeg",
+		".m4a":   "audio/mp4",
+		".mp4":   "video/mp4",
+	}
+
+	// media types of files which are already compressed, deflate does not
+	// make them smaller but wastes CPU
+	compressed_media_types = map[string]bool{
+		"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+		"image/avif": true, "font/woff": true, "font/woff2": true, "audio/mpeg": true,
+		"audio/mp4": true, "video/mp4": true,
 	}
 )
 
@@ -59,40 +84,79 @@ func getMediaType(path string) string {
 ////////////////////////////////////////////////////////////////////////////////
 // helper class, epub compressor
 
+// archive/zip switches to the zip64 format automatically when an entry or
+// the archive exceeds 4GB, or there are more than 65535 entries, so books
+// with large audio/video files need nothing special. But the archive should
+// be written to the output file directly to avoid holding it in memory.
+//
+// If 'dir' is not empty, files are written to this folder instead of an
+// archive, which is useful for inspecting & diffing the output.
 type epubCompressor struct {
 	zip *zip.Writer
-	buf *bytes.Buffer
+	dir string
 }
 
-func (this *epubCompressor) init() error {
-	this.buf = new(bytes.Buffer)
-	this.zip = zip.NewWriter(this.buf)
+func (this *epubCompressor) init(w io.Writer) error {
+	if len(this.dir) > 0 {
+		return this.addFile(path_of_mimetype, []byte("application/epub+zip"), time.Time{})
+	}
+	this.zip = zip.NewWriter(w)
 
 	header := &zip.FileHeader{
 		Name:   path_of_mimetype,
 		Method: zip.Store,
 	}
-	w, e := this.zip.CreateHeader(header)
+	fw, e := this.zip.CreateHeader(header)
 	if e == nil {
-		_, e = w.Write([]byte("application/epub+zip"))
+		_, e = fw.Write([]byte("application/epub+zip"))
 	}
 	return e
 }
 
-func (this *epubCompressor) addFile(path string, data []byte) error {
-	w, e := this.zip.Create(path)
+// addFile adds a file to the archive, 'mtime' is the modification time of the
+// entry, it is not set if zero
+func (this *epubCompressor) addFile(path string, data []byte, mtime time.Time) error {
+	return this.addEntry(path, data, mtime, zip.Deflate)
+}
+
+// addEntry adds a file to the archive with compression method 'method'
+func (this *epubCompressor) addEntry(path string, data []byte, mtime time.Time, method uint16) error {
+	if len(this.dir) > 0 {
+		return this.writeFile(path, data, mtime)
+	}
+	header := &zip.FileHeader{Name: path, Method: method}
+	if !mtime.IsZero() {
+		header.Modified = mtime
+	}
+	w, e := this.zip.CreateHeader(header)
 	if e == nil {
 		_, e = w.Write(data)
 	}
 	return e
 }
 
-func (this *epubCompressor) close() error {
-	return this.zip.Close()
+func (this *epubCompressor) writeFile(path string, data []byte, mtime time.Time) error {
+	p, e := joinOutputPath(this.dir, path)
+	if e != nil {
+		return e
+	}
+	if e := os.MkdirAll(filepath.Dir(p), os.ModeDir|0755); e != nil {
+		return e
+	}
+	if e := ioutil.WriteFile(p, data, 0666); e != nil {
+		return e
+	}
+	if !mtime.IsZero() {
+		return os.Chtimes(p, mtime, mtime)
+	}
+	return nil
 }
 
-func (this *epubCompressor) result() []byte {
-	return this.buf.Bytes()
+func (this *epubCompressor) close() error {
+	if this.zip == nil {
+		return nil
+	}
+	return this.zip.Close()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -108,27 +172,99 @@ type File struct {
 	Data     []byte
 	Attr     int
 	Chapters []Chapter
+	Type     string    // the 'epub:type' of a content file, e.g. 'preface'
+	ModTime  time.Time // modification time of the zip entry, zero for unknown
+}
+
+type Meta struct {
+	Name   string
+	Value  string
+	Legacy bool // always written as an EPUB2 'name' & 'content' meta?
 }
 
 type Epub struct {
-	id          string
-	name        string
-	author      string
-	publisher   string
-	description string
-	language    string
-	cover       string // path of the cover image
-	duokan      bool   // if duokan externsion is enabled
-	files       []*File
+	id              string
+	name            string
+	author          string
+	publisher       string
+	description     string
+	language        string
+	cover           string // path of the cover image
+	cover_page      string // path of the cover page
+	cover_alt       string // alt text of the cover image, the book name if empty
+	cover_width     int    // width of the cover image, 0 if not specified
+	cover_height    int    // height of the cover image, 0 if not specified
+	content_dir     string // folder in the archive which contains all book files
+	duokan          bool   // if duokan externsion is enabled
+	files           []*File
+	metas           []Meta // custom metadata
+	chapter_pattern string // pattern of chapter file names, '{n}' is the chapter number
+	chapter_count   int
+	guide           bool              // generate the 'guide' element for EPUB2?
+	semantics       map[string]string // file path (lower case) => epub:type
+	series          string            // name of the series the book belongs to
+	series_index    int               // position of the book in the series, 0 if unknown
+	included        map[string]bool   // files which must be in the book even if not referenced
+	linear          map[string]bool   // file path (lower case) => linear attribute of spine item
+	meta_inf        []*File           // extra files in the 'META-INF' folder
+	fixed_layout    bool              // pre-paginated layout, EPUB3 only
+	orientation     string            // 'rendition:orientation' of fixed layout
+	spread          string            // 'rendition:spread' of fixed layout
+	version         int               // epub version used by 'WriteTo'
+	media_types     map[string]string // file path (lower case) => media type, overrides the default
+	generator       string            // the tool which produced the book, not recorded if empty
+	name_alt        [2]string         // alternate-script title & its language, EPUB3 only
+	author_alt      [2]string         // alternate-script author name & its language, EPUB3 only
+	container_xml   []byte            // custom 'META-INF/container.xml', generated if nil
+	smart_compress  bool              // store files of compressed media types without compression?
+	pretty_xml      bool              // indent the generated OPF, NCX & nav?
+	base_style      string            // style sheet linked into the generated pages, empty for none
 }
 
 func NewEpub(duokan bool) *Epub {
 	this := new(Epub)
 	this.files = make([]*File, 0, 256)
 	this.duokan = duokan
+	this.version = EPUB_VERSION_300
+	this.smart_compress = true
 	return this
 }
 
+// SetSmartCompression sets whether to store files of compressed media types,
+// like JPEG & PNG images, without compression, it is enabled by default
+func (this *Epub) SetSmartCompression(smart bool) {
+	this.smart_compress = smart
+}
+
+// SetBaseStyle sets the style sheet which is linked into the generated pages,
+// like the cover page, title page and colophon
+func (this *Epub) SetBaseStyle(path string) {
+	this.base_style = path
+}
+
+// SetPrettyXml sets whether to indent the generated package document, NCX
+// and navigation document consistently, it helps to diff & debug the output
+func (this *Epub) SetPrettyXml(pretty bool) {
+	this.pretty_xml = pretty
+}
+
+// formatXml returns the indented 'data' if pretty-printing is enabled, 'data'
+// is returned as is if it cannot be parsed
+func (this *Epub) formatXml(data []byte) []byte {
+	if !this.pretty_xml {
+		return data
+	}
+	if d, e := indentXml(data); e == nil {
+		return d
+	}
+	return data
+}
+
+// SetVersion sets the epub version used by 'WriteTo', it is EPUB3 by default
+func (this *Epub) SetVersion(version int) {
+	this.version = version
+}
+
 func (this *Epub) Id() string {
 	if len(this.id) == 0 {
 		this.SetId("")
@@ -153,6 +289,12 @@ func (this *Epub) SetName(name string) {
 	this.name = name
 }
 
+// SetNameAlt sets the title of the book in an alternate script, e.g. the
+// romanized form of a Chinese title, 'lang' is the language of 'name'
+func (this *Epub) SetNameAlt(name, lang string) {
+	this.name_alt = [2]string{name, lang}
+}
+
 func (this *Epub) Author() string {
 	return this.author
 }
@@ -161,6 +303,22 @@ func (this *Epub) SetAuthor(author string) {
 	this.author = author
 }
 
+// SetAuthorAlt sets the author name in an alternate script, 'lang' is the
+// language of 'author'
+func (this *Epub) SetAuthorAlt(author, lang string) {
+	this.author_alt = [2]string{author, lang}
+}
+
+// writeAlternateScript writes the alternate-script meta which refines 'id',
+// EPUB3 only
+func writeAlternateScript(buf *bytes.Buffer, id string, alt [2]string) {
+	lang := ""
+	if len(alt[1]) > 0 {
+		lang = " xml:lang=\"" + html.EscapeString(alt[1]) + "\""
+	}
+	fmt.Fprintf(buf, "		<meta refines=\"#%s\" property=\"alternate-script\"%s>%s</meta>\n", id, lang, html.EscapeString(alt[0]))
+}
+
 func (this *Epub) Publisher() string {
 	return this.publisher
 }
@@ -185,14 +343,199 @@ func (this *Epub) SetLanguage(lang string) {
 	this.language = lang
 }
 
+// SetGenerator sets the name & version of the tool which produced the book,
+// it is recorded in the metadata for provenance
+func (this *Epub) SetGenerator(generator string) {
+	this.generator = generator
+}
+
+// AddMeta adds a custom metadata which is not natively supported
+func (this *Epub) AddMeta(name, value string) {
+	this.metas = append(this.metas, Meta{Name: name, Value: value})
+}
+
+// AddLegacyMeta is the same as 'AddMeta', but the metadata is written in the
+// EPUB2 form in EPUB3 books too, this is for the extensions like calibre's,
+// whose prefixes are not declared in the package
+func (this *Epub) AddLegacyMeta(name, value string) {
+	this.metas = append(this.metas, Meta{Name: name, Value: value, Legacy: true})
+}
+
+func (this *Epub) Series() (string, int) {
+	return this.series, this.series_index
+}
+
+// SetSeries sets the series the book belongs to, 'index' is the position of
+// the book in the series, 0 means unknown
+func (this *Epub) SetSeries(name string, index int) {
+	this.series, this.series_index = name, index
+}
+
+// SetSemantics sets the 'epub:type' of content files, keys of 'semantics'
+// are file paths in lower case
+func (this *Epub) SetSemantics(semantics map[string]string) {
+	this.semantics = semantics
+}
+
+// SetMediaTypes sets the media types of files, which override the ones
+// determined by extensions, keys of 'types' are file paths in lower case
+func (this *Epub) SetMediaTypes(types map[string]string) {
+	this.media_types = types
+}
+
+// MediaType returns the media type of file 'path'
+func (this *Epub) MediaType(path string) string {
+	if mt, ok := this.media_types[strings.ToLower(path)]; ok {
+		return mt
+	}
+	return getMediaType(path)
+}
+
+// SetFileType sets the 'epub:type' of content file 'path'
+func (this *Epub) SetFileType(path, typ string) {
+	if this.semantics == nil {
+		this.semantics = make(map[string]string)
+	}
+	this.semantics[strings.ToLower(path)] = typ
+}
+
+// SetFileLinear sets the 'linear' attribute of the spine item of file 'path'
+func (this *Epub) SetFileLinear(path string, linear bool) {
+	if this.linear == nil {
+		this.linear = make(map[string]bool)
+	}
+	this.linear[strings.ToLower(path)] = linear
+}
+
+// SetLinear sets the 'linear' attribute of spine items, keys of 'linear' are
+// file paths in lower case
+func (this *Epub) SetLinear(linear map[string]bool) {
+	this.linear = linear
+}
+
+// linearOf returns the 'linear' attribute of the spine item of file 'path'
+func (this *Epub) linearOf(path string, dflt bool) string {
+	linear, ok := this.linear[strings.ToLower(path)]
+	if !ok {
+		linear = dflt
+	}
+	if linear {
+		return "yes"
+	}
+	return "no"
+}
+
+// FileType returns the 'epub:type' of content file 'path'
+func (this *Epub) FileType(path string) string {
+	if t, ok := this.semantics[strings.ToLower(path)]; ok {
+		return t
+	}
+	return "bodymatter"
+}
+
+// SetGuide sets whether to generate the 'guide' element in EPUB2 books
+func (this *Epub) SetGuide(guide bool) {
+	this.guide = guide
+}
+
 func (this *Epub) Duokan() bool {
 	return this.duokan
 }
 
+func (this *Epub) SetDuokan(duokan bool) {
+	this.duokan = duokan
+}
+
+func (this *Epub) CoverImage() string {
+	return this.cover
+}
+
 func (this *Epub) SetCoverImage(path string) {
 	this.cover = filepath.ToSlash(path)
 }
 
+// CoverAlt returns the alt text of the cover image
+func (this *Epub) CoverAlt() string {
+	if len(this.cover_alt) > 0 {
+		return this.cover_alt
+	}
+	if len(this.name) > 0 {
+		return this.name
+	}
+	return "cover"
+}
+
+func (this *Epub) SetCoverAlt(alt string) {
+	this.cover_alt = alt
+}
+
+// SetCoverSize sets the size of the cover image, so the cover page is an SVG
+// wrapped image which fits the screen, and the image need not be decoded
+func (this *Epub) SetCoverSize(width, height int) {
+	this.cover_width, this.cover_height = width, height
+}
+
+// generateCoverPage generates the cover page, it is an SVG wrapped image if
+// the size of the cover image is specified
+func (this *Epub) generateCoverPage() []byte {
+	if this.cover_width <= 0 || this.cover_height <= 0 {
+		return generateImagePage(this.cover, this.CoverAlt(), this.coverViewport(), this.base_style)
+	}
+	viewport := this.coverViewport()
+	if len(viewport) > 0 {
+		viewport = "	<meta name=\"viewport\" content=\"" + viewport + "\"/>\n"
+	}
+	s := fmt.Sprintf(""+
+		"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
+		"<!DOCTYPE html>"+
+		"<html xmlns=\"http://www.w3.org/1999/xhtml\">\n"+
+		"<head>\n"+
+		"	<title></title>\n"+
+		"%s%s"+
+		"</head>\n"+
+		"<body>\n"+
+		"	<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" version=\"1.1\""+
+		" width=\"100%%\" height=\"100%%\" viewBox=\"0 0 %d %d\" preserveAspectRatio=\"xMidYMid meet\">\n"+
+		"		<title>%s</title>\n"+
+		"		<image width=\"%d\" height=\"%d\" xlink:href=\"%s\"/>\n"+
+		"	</svg>\n"+
+		"</body>\n"+
+		"</html>\n",
+		viewport, styleSheetLink(this.base_style),
+		this.cover_width, this.cover_height,
+		html.EscapeString(this.CoverAlt()),
+		this.cover_width, this.cover_height, this.cover)
+	return []byte(s)
+}
+
+func (this *Epub) CoverPage() string {
+	if len(this.cover_page) == 0 {
+		return path_of_cover_page
+	}
+	return this.cover_page
+}
+
+func (this *Epub) SetCoverPage(path string) {
+	this.cover_page = filepath.ToSlash(path)
+}
+
+func (this *Epub) ContentDir() string {
+	return this.content_dir
+}
+
+// SetContentDir sets the folder in the archive to store the package files,
+// all the files are moved together, so references between them are not changed
+func (this *Epub) SetContentDir(dir string) {
+	this.content_dir = strings.Trim(filepath.ToSlash(dir), "/")
+}
+
+func (this *Epub) archivePath(path string) string {
+	if len(this.content_dir) == 0 {
+		return path
+	}
+	return this.content_dir + "/" + path
+}
+
 func (this *Epub) AddFile(path string, data []byte) {
 	path = filepath.ToSlash(path)
 	if strings.ToLower(path) == path_of_mimetype {
@@ -202,7 +545,7 @@ func (this *Epub) AddFile(path string, data []byte) {
 		Path: path,
 		Data: data,
 	}
-	if path == path_of_cover_page ||
+	if path == this.CoverPage() ||
 		path == path_of_content_opf ||
 		path == path_of_toc_ncx ||
 		path == path_of_nav_xhtml ||
@@ -212,60 +555,371 @@ func (this *Epub) AddFile(path string, data []byte) {
 	this.files = append(this.files, f)
 }
 
-func generateImagePage(path, alt string) []byte {
+func (this *Epub) FixedLayout() bool {
+	return this.fixed_layout
+}
+
+// SetFixedLayout enables or disables the fixed layout (pre-paginated) of
+// EPUB3, empty 'orientation' or 'spread' means the default value 'auto'
+func (this *Epub) SetFixedLayout(fixed bool, orientation, spread string) {
+	this.fixed_layout, this.orientation, this.spread = fixed, orientation, spread
+}
+
+// coverViewport returns the viewport of the cover page of fixed layout books
+func (this *Epub) coverViewport() string {
+	if !this.fixed_layout {
+		return ""
+	}
+	if this.cover_width > 0 && this.cover_height > 0 {
+		return formatViewport(this.cover_width, this.cover_height)
+	}
+	if f := this.FindFile(this.cover); f != nil {
+		if w, h, ok := imageSize(f.Data); ok {
+			return formatViewport(w, h)
+		}
+	}
+	return ""
+}
+
+// Files returns all the files of the book, in the order they are added
+func (this *Epub) Files() []*File {
+	return this.files
+}
+
+// RemoveFile removes file 'path' from the book
+func (this *Epub) RemoveFile(path string) {
+	for i, f := range this.files {
+		if f.Path == path {
+			this.files = append(this.files[:i], this.files[i+1:]...)
+			return
+		}
+	}
+}
+
+// ContentFiles returns the content files, in reading order
+func (this *Epub) ContentFiles() []*File {
+	var result []*File
+	for _, f := range this.files {
+		if (f.Attr & epub_CONTENT_FILE) != 0 {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// Include marks file 'path' as a file which must be in the book, even if it
+// is not referenced by any other file
+func (this *Epub) Include(path string) {
+	if this.included == nil {
+		this.included = make(map[string]bool)
+	}
+	this.included[filepath.ToSlash(path)] = true
+}
+
+// IsIncluded reports whether file 'path' is marked by 'Include'
+func (this *Epub) IsIncluded(path string) bool {
+	return this.included[filepath.ToSlash(path)]
+}
+
+// reserved file names in the 'META-INF' folder
+var meta_inf_reserved = map[string]bool{
+	"container.xml": true, "encryption.xml": true, "manifest.xml": true,
+	"metadata.xml": true, "signatures.xml": true,
+}
+
+// AddMetaInfFile adds file 'name' into the 'META-INF' folder, it returns an
+// error if 'name' is reserved or already exists
+func (this *Epub) AddMetaInfFile(name string, data []byte) error {
+	name = strings.ToLower(name)
+	if meta_inf_reserved[name] || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("'%s' cannot be used as a file name in 'META-INF'", name)
+	}
+	for _, f := range this.meta_inf {
+		if f.Path == name {
+			return fmt.Errorf("'%s' already exists in 'META-INF'", name)
+		}
+	}
+	this.meta_inf = append(this.meta_inf, &File{Path: name, Data: data})
+	return nil
+}
+
+// AddContentFile adds a file which is not generated from 'book.html' to the
+// spine, 'typ' is its 'epub:type' unless specified by the semantics
+func (this *Epub) AddContentFile(path string, data []byte, typ string) {
+	this.AddFile(path, data)
+	f := this.files[len(this.files)-1]
+	f.Attr |= epub_CONTENT_FILE
+	f.Type = typ
+	if t, ok := this.semantics[strings.ToLower(f.Path)]; ok {
+		f.Type = t
+	}
+}
+
+// AddColophon adds the colophon page to the end of the spine, 'text' is plain
+// text, every line of it becomes a paragraph
+func (this *Epub) AddColophon(text string) {
+	body := new(bytes.Buffer)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			fmt.Fprintf(body, "	<p>%s</p>\n", html.EscapeString(line))
+		}
+	}
+	data := generateTextPage("Colophon", this.base_style, "<section epub:type=\"colophon\">\n"+body.String()+"</section>")
+	this.AddContentFile(path_of_colophon, data, "colophon")
+}
+
+// AddTitlePage adds the title page, which is the first content file (after
+// the cover page), 'body' is the xhtml content of the 'body' element
+func (this *Epub) AddTitlePage(body string) {
+	f := &File{
+		Path: path_of_title_page,
+		Data: generateTextPage(this.Name(), this.base_style, "<section epub:type=\"titlepage\">\n"+body+"\n</section>"),
+		Attr: epub_CONTENT_FILE,
+		Type: "titlepage",
+	}
+	if t, ok := this.semantics[path_of_title_page]; ok {
+		f.Type = t
+	}
+	this.files = append([]*File{f}, this.files...)
+}
+
+// AddBackCover adds the back cover page, which only contains image 'path', to
+// the end of the spine
+func (this *Epub) AddBackCover(path string) {
+	this.AddContentFile(path_of_back_cover, generateImagePage(path, "back cover", "", this.base_style), "backmatter")
+}
+
+// FindFile returns the file whose path equals to 'path' after normalization,
+// paths are compared case-insensitively. It returns nil if not found.
+func (this *Epub) FindFile(path string) *File {
+	path = cleanBookPath(filepath.ToSlash(path))
+	for _, f := range this.files {
+		if strings.EqualFold(cleanBookPath(f.Path), path) {
+			return f
+		}
+	}
+	return nil
+}
+
+// styleSheetLink returns the 'link' element of style sheet 'path' for the
+// generated pages, it is empty if 'path' is empty
+func styleSheetLink(path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return "	<link href=\"" + html.EscapeString(path) + "\" rel=\"stylesheet\" type=\"text/css\"/>\n"
+}
+
+// generateImagePage generates a page which only contains image 'path', the
+// viewport meta is added if 'viewport' is not empty, and style sheet 'style'
+// is linked if not empty
+func generateImagePage(path, alt, viewport, style string) []byte {
 	path = filepath.ToSlash(path)
+	if len(viewport) > 0 {
+		viewport = "	<meta name=\"viewport\" content=\"" + viewport + "\"/>\n"
+	}
 	s := fmt.Sprintf(""+
 		"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
 		"<!DOCTYPE html>"+
 		"<html xmlns=\"http://www.w3.org/1999/xhtml\">\n"+
 		"<head>\n"+
 		"	<title></title>\n"+
+		"%s%s"+
 		"</head>\n"+
 		"<body>\n"+
 		"	<p><img alt=\"%s\" src=\"%s\"/></p>\n"+
 		"</body>\n"+
-		"</html>\n", alt, path)
+		"</html>\n", viewport, styleSheetLink(style), html.EscapeString(alt), path)
+	return []byte(s)
+}
+
+// generateTextPage generates a page with 'title' and 'body', 'body' is the
+// content of the 'body' element, and must be valid xhtml, style sheet 'style'
+// is linked if not empty
+func generateTextPage(title, style, body string) []byte {
+	s := fmt.Sprintf(""+
+		"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
+		"<!DOCTYPE html>"+
+		"<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\">\n"+
+		"<head>\n"+
+		"	<title>%s</title>\n"+
+		"%s"+
+		"</head>\n"+
+		"<body>\n"+
+		"%s\n"+
+		"</body>\n"+
+		"</html>\n", html.EscapeString(title), styleSheetLink(style), body)
 	return []byte(s)
 }
 
 func (this *Epub) AddFullScreenImage(path, alt string, chapters []Chapter) {
 	f := &File{
 		Path:     fmt.Sprintf("full_scrn_img_%04d.html", len(this.files)),
-		Data:     generateImagePage(path, alt),
+		Data:     generateImagePage(path, alt, "", this.base_style),
 		Attr:     epub_CONTENT_FILE | epub_FULL_SCREEN_PAGE,
 		Chapters: chapters,
 	}
+	f.Type = this.FileType(f.Path)
 	this.files = append(this.files, f)
 }
 
+// SplitFullScreenImage replaces full screen page 'f' by one full screen page
+// for every image in 'paths', the TOC items of 'f' are moved to the first one
+func (this *Epub) SplitFullScreenImage(f *File, paths []string, alt string) {
+	base := strings.TrimSuffix(f.Path, filepath.Ext(f.Path))
+	pages := make([]*File, 0, len(paths))
+	for i, p := range paths {
+		page := &File{
+			Path: fmt.Sprintf("%s_%02d.html", base, i+1),
+			Data: generateImagePage(p, alt, "", this.base_style),
+			Attr: f.Attr,
+			Type: f.Type,
+		}
+		if i == 0 {
+			page.Chapters = f.Chapters
+		}
+		pages = append(pages, page)
+	}
+
+	for i, old := range this.files {
+		if old == f {
+			files := append(pages, this.files[i+1:]...)
+			this.files = append(this.files[:i], files...)
+			return
+		}
+	}
+}
+
+// SetChapterPattern sets the pattern of the chapter file names, '{n}' in the
+// pattern will be replaced by the chapter number, which starts from 1
+func (this *Epub) SetChapterPattern(pattern string) {
+	this.chapter_pattern = filepath.ToSlash(pattern)
+}
+
+func (this *Epub) nextChapterPath() string {
+	if len(this.chapter_pattern) == 0 {
+		return fmt.Sprintf("chapter_%04d.html", len(this.files))
+	}
+	return strings.Replace(this.chapter_pattern, "{n}", strconv.Itoa(this.chapter_count+1), -1)
+}
+
 func (this *Epub) AddChapter(chapters []Chapter, data []byte) {
 	f := &File{
-		Path:     fmt.Sprintf("chapter_%04d.html", len(this.files)),
+		Path:     this.nextChapterPath(),
 		Data:     data,
 		Attr:     epub_CONTENT_FILE,
 		Chapters: chapters,
 	}
+	f.Type = this.FileType(f.Path)
 	this.files = append(this.files, f)
+	this.chapter_count++
 }
 
-func (this *Epub) Depth() int {
-	d := 0
+// AppendBook appends all files of 'book' to folder 'dir' of this book, a
+// part page which has the book name (and cover image) is added before its
+// content files as the top level TOC node, the levels of its chapters are
+// increased by one to be grouped under the node
+func (this *Epub) AppendBook(book *Epub, dir string) {
+	dir = strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/"
+
+	body := "<h1>" + html.EscapeString(book.Name()) + "</h1>"
+	if len(book.cover) > 0 {
+		src := (&url.URL{Path: book.cover}).EscapedPath()
+		body += "\n<p><img alt=\"" + html.EscapeString(book.CoverAlt()) + "\" src=\"" + html.EscapeString(src) + "\"/></p>"
+	}
+	this.files = append(this.files, &File{
+		Path:     dir + path_of_part_page,
+		Data:     generateTextPage(book.Name(), "", "<section epub:type=\"part\">\n"+body+"\n</section>"),
+		Attr:     epub_CONTENT_FILE,
+		Chapters: []Chapter{{Level: 1, Title: book.Name()}},
+		Type:     "part",
+	})
+
+	for _, f := range book.files {
+		if (f.Attr & epub_INTERNAL_FILE) != 0 {
+			continue
+		}
+		nf := *f
+		nf.Path = dir + f.Path
+		nf.Chapters = make([]Chapter, len(f.Chapters))
+		for i, c := range f.Chapters {
+			c.Level++
+			nf.Chapters[i] = c
+		}
+		if linear, ok := book.linear[strings.ToLower(f.Path)]; ok {
+			this.SetFileLinear(nf.Path, linear)
+		}
+		if mt, ok := book.media_types[strings.ToLower(f.Path)]; ok {
+			if this.media_types == nil {
+				this.media_types = make(map[string]string)
+			}
+			this.media_types[strings.ToLower(nf.Path)] = mt
+		}
+		this.files = append(this.files, &nf)
+	}
+
+	for p := range book.included {
+		this.Include(dir + p)
+	}
+}
+
+// tocLevels returns the nesting depths of the TOC items in reading order,
+// a depth is at most one more than the previous one even if some levels are
+// skipped in the chapters, e.g. levels 1, 3, 2 are nested as 1, 2, 2
+func (this *Epub) tocLevels() []int {
+	var levels, stack []int
 	for _, f := range this.files {
+		if (f.Attr & epub_CONTENT_FILE) == 0 {
+			continue
+		}
 		for _, c := range f.Chapters {
-			if c.Level > d {
-				d = c.Level
+			for len(stack) > 0 && stack[len(stack)-1] >= c.Level {
+				stack = stack[:len(stack)-1]
 			}
+			stack = append(stack, c.Level)
+			levels = append(levels, len(stack))
+		}
+	}
+	return levels
+}
+
+// Depth returns the max nesting depth of the TOC
+func (this *Epub) Depth() int {
+	d := 0
+	for _, l := range this.tocLevels() {
+		if l > d {
+			d = l
 		}
 	}
 	return d
 }
 
+// SetContainerXml sets the content of 'META-INF/container.xml', it is used
+// verbatim, but it must reference the generated package document
+func (this *Epub) SetContainerXml(data []byte) error {
+	var container xmlContainer
+	if e := xml.Unmarshal(data, &container); e != nil {
+		return fmt.Errorf("the container file is not well-formed: %s", e.Error())
+	}
+	opf := this.archivePath(path_of_content_opf)
+	for _, rf := range container.Rootfiles {
+		if rf.FullPath == opf && rf.MediaType == "application/oebps-package+xml" {
+			this.container_xml = data
+			return nil
+		}
+	}
+	return fmt.Errorf("the container file does not reference the package document '%s'", opf)
+}
+
 func (this *Epub) generateContainerXml() []byte {
+	if this.container_xml != nil {
+		return this.container_xml
+	}
 	return []byte("" +
 		"<?xml version=\"1.0\"?>\n" +
 		"<container version=\"1.0\" xmlns=\"urn:oasis:names:tc:opendocument:xmlns:container\">\n" +
 		"	<rootfiles>\n" +
-		"		<rootfile full-path=\"" + path_of_content_opf + "\" media-type=\"application/oebps-package+xml\"/>\n" +
+		"		<rootfile full-path=\"" + this.archivePath(path_of_content_opf) + "\" media-type=\"application/oebps-package+xml\"/>\n" +
 		"	</rootfiles>\n" +
 		"</container>")
 }
@@ -281,15 +935,24 @@ func (this *Epub) generateContentOpf(version int) []byte {
 	}
 	buf.WriteString("	<metadata xmlns:opf=\"http://www.idpf.org/2007/opf\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n")
 
+	titleId := ""
+	if version != EPUB_VERSION_200 && len(this.name_alt[0]) > 0 {
+		titleId = " id=\"title\""
+	}
 	fmt.Fprintf(buf, "		<dc:identifier id=\"uuid_id\">%s</dc:identifier>\n"+
-		"		<dc:title>%s</dc:title>\n"+
-		"		<dc:language>%s</dc:language>\n"+
-		"		<meta name=\"cover\" content=\"%s\"/>\n",
+		"		<dc:title%s>%s</dc:title>\n"+
+		"		<dc:language>%s</dc:language>\n",
 		html.EscapeString(this.Id()),
+		titleId,
 		html.EscapeString(this.Name()),
 		html.EscapeString(this.Language()),
-		this.cover,
 	)
+	if len(titleId) > 0 {
+		writeAlternateScript(buf, "title", this.name_alt)
+	}
+	if len(this.cover) > 0 {
+		buf.WriteString("		<meta name=\"cover\" content=\"cover-image\"/>\n")
+	}
 
 	if version == EPUB_VERSION_200 {
 		fmt.Fprintf(buf, "		<dc:creator opf:role=\"aut\">%s</dc:creator>\n", html.EscapeString(this.Author()))
@@ -297,6 +960,9 @@ func (this *Epub) generateContentOpf(version int) []byte {
 	} else {
 		fmt.Fprintf(buf, "		<dc:creator id=\"creator\">%s</dc:creator>\n", html.EscapeString(this.Author()))
 		buf.WriteString("		<meta refines=\"#creator\" property=\"role\" scheme=\"marc:relators\" id=\"role\">aut</meta>\n")
+		if len(this.author_alt[0]) > 0 {
+			writeAlternateScript(buf, "creator", this.author_alt)
+		}
 		fmt.Fprintf(buf, "		<meta property=\"dcterms:modified\">%s</meta>\n", time.Now().UTC().Format(time.RFC3339))
 	}
 
@@ -308,6 +974,34 @@ func (this *Epub) generateContentOpf(version int) []byte {
 		fmt.Fprintf(buf, "		<dc:description>%s</dc:description>\n", html.EscapeString(this.Description()))
 	}
 
+	if len(this.series) > 0 {
+		this.writeSeries(buf, version)
+	}
+
+	if this.fixed_layout && version != EPUB_VERSION_200 {
+		buf.WriteString("		<meta property=\"rendition:layout\">pre-paginated</meta>\n")
+		if len(this.orientation) > 0 {
+			fmt.Fprintf(buf, "		<meta property=\"rendition:orientation\">%s</meta>\n", this.orientation)
+		}
+		if len(this.spread) > 0 {
+			fmt.Fprintf(buf, "		<meta property=\"rendition:spread\">%s</meta>\n", this.spread)
+		}
+	}
+
+	for _, m := range this.metas {
+		if version == EPUB_VERSION_200 || m.Legacy {
+			fmt.Fprintf(buf, "		<meta name=\"%s\" content=\"%s\"/>\n", html.EscapeString(m.Name), html.EscapeString(m.Value))
+		} else {
+			fmt.Fprintf(buf, "		<meta property=\"%s\">%s</meta>\n", html.EscapeString(m.Name), html.EscapeString(m.Value))
+		}
+	}
+
+	// there's no EPUB3 property for the generator, and custom properties need
+	// a declared prefix, so the legacy form is used by all versions
+	if len(this.generator) > 0 {
+		fmt.Fprintf(buf, "		<meta name=\"generator\" content=\"%s\"/>\n", html.EscapeString(this.generator))
+	}
+
 	buf.WriteString("	</metadata>\n	<manifest>\n")
 
 	if version == EPUB_VERSION_200 {
@@ -317,18 +1011,37 @@ func (this *Epub) generateContentOpf(version int) []byte {
 	}
 
 	if len(this.cover) > 0 {
-		buf.WriteString("		<item href=\"" + path_of_cover_page + "\" id=\"cover\" media-type=\"application/xhtml+xml\"/>\n")
+		props := ""
+		if version != EPUB_VERSION_200 && this.cover_width > 0 && this.cover_height > 0 {
+			props = " properties=\"svg\""
+		}
+		buf.WriteString("		<item href=\"" + this.CoverPage() + "\" id=\"cover\"" + props + " media-type=\"application/xhtml+xml\"/>\n")
 	}
 
 	for i, f := range this.files {
 		if (f.Attr & epub_INTERNAL_FILE) != 0 {
 			continue
 		}
+		if f.Path == this.cover {
+			props := ""
+			if version != EPUB_VERSION_200 {
+				props = " properties=\"cover-image\""
+			}
+			fmt.Fprintf(buf, "		<item href=\"%s\" id=\"cover-image\"%s media-type=\"%s\"/>\n", f.Path, props, this.MediaType(f.Path))
+			continue
+		}
+		props := ""
+		if version != EPUB_VERSION_200 && isHtmlFile(f.Path) {
+			if p := contentProperties(f.Data); len(p) > 0 {
+				props = " properties=\"" + strings.Join(p, " ") + "\""
+			}
+		}
 		fmt.Fprintf(buf,
-			"		<item href=\"%s\" id=\"item%04d\" media-type=\"%s\"/>\n",
+			"		<item href=\"%s\" id=\"item%04d\"%s media-type=\"%s\"/>\n",
 			f.Path,
 			i,
-			getMediaType(f.Path),
+			props,
+			this.MediaType(f.Path),
 		)
 	}
 
@@ -339,35 +1052,83 @@ func (this *Epub) generateContentOpf(version int) []byte {
 	}
 
 	if len(this.cover) > 0 {
-		buf.WriteString("		<itemref idref=\"cover\" linear=\"no\"")
-		if this.duokan {
-			buf.WriteString(" properties=\"duokan-page-fullscreen\"/>\n")
-		} else {
-			buf.WriteString("/>\n")
-		}
+		fmt.Fprintf(buf, "		<itemref idref=\"cover\" linear=\"%s\"", this.linearOf(this.CoverPage(), false))
+		this.writeSpineProperties(buf, version, this.duokan)
 	}
 
 	for i, f := range this.files {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
-		fmt.Fprintf(buf, "		<itemref idref=\"item%04d\" linear=\"yes\"", i)
-		if this.duokan && (f.Attr&epub_FULL_SCREEN_PAGE) != 0 {
-			buf.WriteString(" properties=\"duokan-page-fullscreen\"/>\n")
-		} else {
-			buf.WriteString("/>\n")
-		}
+		fmt.Fprintf(buf, "		<itemref idref=\"item%04d\" linear=\"%s\"", i, this.linearOf(f.Path, true))
+		this.writeSpineProperties(buf, version, this.duokan && (f.Attr&epub_FULL_SCREEN_PAGE) != 0)
 	}
 
-	buf.WriteString("	</spine>\n</package>")
+	buf.WriteString("	</spine>\n")
+
+	if version == EPUB_VERSION_200 && this.guide {
+		this.writeGuide(buf)
+	}
+
+	buf.WriteString("</package>")
 
 	return buf.Bytes()
 }
 
+// writeSeries writes the series information, EPUB2 has no standard way for
+// this, so the calibre extension is used
+func (this *Epub) writeSeries(buf *bytes.Buffer, version int) {
+	if version == EPUB_VERSION_200 {
+		fmt.Fprintf(buf, "		<meta name=\"calibre:series\" content=\"%s\"/>\n", html.EscapeString(this.series))
+		if this.series_index > 0 {
+			fmt.Fprintf(buf, "		<meta name=\"calibre:series_index\" content=\"%d\"/>\n", this.series_index)
+		}
+		return
+	}
+	fmt.Fprintf(buf, "		<meta property=\"belongs-to-collection\" id=\"series\">%s</meta>\n", html.EscapeString(this.series))
+	buf.WriteString("		<meta refines=\"#series\" property=\"collection-type\">series</meta>\n")
+	if this.series_index > 0 {
+		fmt.Fprintf(buf, "		<meta refines=\"#series\" property=\"group-position\">%d</meta>\n", this.series_index)
+	}
+}
+
+// writeSpineProperties writes the 'properties' attribute of a spine item
+// and closes the element
+func (this *Epub) writeSpineProperties(buf *bytes.Buffer, version int, fullscreen bool) {
+	var props []string
+	if fullscreen {
+		props = append(props, "duokan-page-fullscreen")
+	}
+	if this.fixed_layout && version != EPUB_VERSION_200 {
+		props = append(props, "rendition:layout-pre-paginated")
+	}
+	if len(props) > 0 {
+		buf.WriteString(" properties=\"" + strings.Join(props, " ") + "\"")
+	}
+	buf.WriteString("/>\n")
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // epub 2.0
 
+// writeGuide writes the 'guide' element, there's no html TOC page in EPUB2
+// books, so only the cover page and the first chapter are referenced
+func (this *Epub) writeGuide(buf *bytes.Buffer) {
+	buf.WriteString("	<guide>\n")
+	if len(this.cover) > 0 {
+		buf.WriteString("		<reference type=\"cover\" title=\"Cover\" href=\"" + this.CoverPage() + "\"/>\n")
+	}
+	for _, f := range this.files {
+		if (f.Attr & epub_CONTENT_FILE) != 0 {
+			buf.WriteString("		<reference type=\"text\" title=\"Text\" href=\"" + f.Path + "\"/>\n")
+			break
+		}
+	}
+	buf.WriteString("	</guide>\n")
+}
+
 func (this *Epub) generateTocNcx() []byte {
+	markers := this.pageMarkers()
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, ""+
 		"<?xml version='1.0' encoding='utf-8'?>\n"+
@@ -375,34 +1136,39 @@ func (this *Epub) generateTocNcx() []byte {
 		"	<head>\n"+
 		"		<meta content=\"%s\" name=\"dtb:uid\"/>\n"+
 		"		<meta content=\"%d\" name=\"dtb:depth\"/>\n"+
-		"		<meta content=\"0\" name=\"dtb:totalPageCount\"/>\n"+
-		"		<meta content=\"0\" name=\"dtb:maxPageNumber\"/>\n"+
+		"		<meta content=\"%d\" name=\"dtb:totalPageCount\"/>\n"+
+		"		<meta content=\"%d\" name=\"dtb:maxPageNumber\"/>\n"+
 		"		<meta name=\"builder\" content=\"makeepub v"+version+"\"/>\n"+
 		"	</head>\n"+
 		"	<docTitle><text>%s</text></docTitle>\n"+
 		"	<docAuthor><text>%s</text></docAuthor>\n"+
 		"	<navMap>\n",
-		this.Id(),
+		html.EscapeString(this.Id()),
 		this.Depth(),
-		this.Name(),
-		this.Author(),
+		len(markers),
+		maxPageNumber(markers),
+		html.EscapeString(this.Name()),
+		html.EscapeString(this.Author()),
 	)
 
+	levels := this.tocLevels()
 	depth, playorder := 0, 0
 	for _, f := range this.files {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
 		for _, c := range f.Chapters {
-			if c.Level == depth {
+			level := levels[playorder]
+			if level == depth {
 				buf.WriteString("</navPoint>\n")
-			} else if c.Level > depth {
-				depth = c.Level
+			} else if level > depth {
+				depth = level
 			} else {
-				for c.Level <= depth {
+				for level <= depth {
 					buf.WriteString("</navPoint>\n")
 					depth--
 				}
+				depth = level
 			}
 			fmt.Fprintf(buf, ""+
 				"<navPoint id=\"navPoint-%d\" playOrder=\"%d\">\n"+
@@ -412,7 +1178,7 @@ func (this *Epub) generateTocNcx() []byte {
 				"	<content src=\"%s\"/>\n",
 				playorder,
 				playorder,
-				c.Title,
+				html.EscapeString(c.Title),
 				f.Path+c.Link,
 			)
 			playorder++
@@ -423,7 +1189,9 @@ func (this *Epub) generateTocNcx() []byte {
 		depth--
 	}
 
-	buf.WriteString("	</navMap>\n</ncx>")
+	buf.WriteString("	</navMap>\n")
+	writeNcxPageList(buf, markers, playorder)
+	buf.WriteString("</ncx>\n")
 
 	return buf.Bytes()
 }
@@ -441,22 +1209,24 @@ func (this *Epub) generateNavXhtml() []byte {
 			"	</head>\n"+
 			"	<body>\n"+
 			"		<nav id=\"toc\" epub:type=\"toc\">\n",
-		this.Name(),
+		html.EscapeString(this.Name()),
 	)
 
+	levels := this.tocLevels()
 	depth, playorder := 0, 0
 	for _, f := range this.files {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
 		for _, c := range f.Chapters {
-			if c.Level == depth {
+			level := levels[playorder]
+			if level == depth {
 				buf.WriteString("</li>\n<li")
-			} else if c.Level > depth {
+			} else if level > depth {
 				buf.WriteString("<ol>\n<li")
-				depth = c.Level
+				depth = level
 			} else {
-				for c.Level < depth {
+				for level < depth {
 					buf.WriteString("</li>\n</ol>\n")
 					depth--
 				}
@@ -466,7 +1236,7 @@ func (this *Epub) generateNavXhtml() []byte {
 				" id=\"chapter_%d\">\n	<a href=\"%s\">%s</a>\n",
 				playorder,
 				f.Path+c.Link,
-				c.Title,
+				html.EscapeString(c.Title),
 			)
 			playorder++
 		}
@@ -477,70 +1247,158 @@ func (this *Epub) generateNavXhtml() []byte {
 		depth--
 	}
 
-	buf.WriteString("		</nav>\n	</body>\n</html>")
+	buf.WriteString("		</nav>\n")
+	this.writeLandmarks(buf)
+	writeNavPageList(buf, this.pageMarkers())
+	buf.WriteString("	</body>\n</html>\n")
 
 	return buf.Bytes()
 }
 
+func writeLandmark(buf *bytes.Buffer, t, href, title string) {
+	fmt.Fprintf(buf,
+		"<li><a epub:type=\"%s\" href=\"%s\">%s</a></li>\n",
+		html.EscapeString(t),
+		href,
+		html.EscapeString(title),
+	)
+}
+
+// writeLandmarks writes the landmarks, which includes the cover page, the
+// first 'bodymatter' file and all files with a non-default 'epub:type'
+func (this *Epub) writeLandmarks(buf *bytes.Buffer) {
+	buf.WriteString("		<nav epub:type=\"landmarks\" hidden=\"\">\n<ol>\n")
+	if len(this.cover) > 0 {
+		writeLandmark(buf, "cover", this.CoverPage(), "Cover")
+	}
+	body := false
+	for _, f := range this.files {
+		if (f.Attr & epub_CONTENT_FILE) == 0 {
+			continue
+		}
+		title := f.Type
+		if len(f.Chapters) > 0 {
+			title = f.Chapters[0].Title
+		}
+		if f.Type != "bodymatter" {
+			writeLandmark(buf, f.Type, f.Path, title)
+		} else if !body {
+			writeLandmark(buf, f.Type, f.Path, title)
+			body = true
+		}
+	}
+	buf.WriteString("</ol>\n		</nav>\n")
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
-func (this *Epub) Build(version int) ([]byte, error) {
-	compressor := epubCompressor{}
-	if e := compressor.init(); e != nil {
-		return nil, e
+func (this *Epub) write(w io.Writer, version int) error {
+	return this.writeTo(&epubCompressor{}, w, version)
+}
+
+func (this *Epub) writeTo(compressor *epubCompressor, w io.Writer, version int) error {
+	if e := compressor.init(w); e != nil {
+		return e
 	}
 
 	if version != EPUB_VERSION_NONE {
 		data := this.generateContainerXml()
-		if e := compressor.addFile(path_of_container_xml, data); e != nil {
-			return nil, e
+		if e := compressor.addFile(path_of_container_xml, data, time.Time{}); e != nil {
+			return e
 		}
-		data = this.generateContentOpf(version)
-		if e := compressor.addFile(path_of_content_opf, data); e != nil {
-			return nil, e
+		for _, f := range this.meta_inf {
+			if e := compressor.addFile("META-INF/"+f.Path, f.Data, time.Time{}); e != nil {
+				return e
+			}
+		}
+		data = this.formatXml(this.generateContentOpf(version))
+		if e := compressor.addFile(this.archivePath(path_of_content_opf), data, time.Time{}); e != nil {
+			return e
 		}
 		if version == EPUB_VERSION_200 {
-			data = this.generateTocNcx()
-			if e := compressor.addFile(path_of_toc_ncx, data); e != nil {
-				return nil, e
+			data = this.formatXml(this.generateTocNcx())
+			if e := compressor.addFile(this.archivePath(path_of_toc_ncx), data, time.Time{}); e != nil {
+				return e
 			}
 		} else {
-			data = this.generateNavXhtml()
-			if e := compressor.addFile(path_of_nav_xhtml, data); e != nil {
-				return nil, e
+			data = this.formatXml(this.generateNavXhtml())
+			if e := compressor.addFile(this.archivePath(path_of_nav_xhtml), data, time.Time{}); e != nil {
+				return e
 			}
 		}
 		if len(this.cover) > 0 {
-			data = generateImagePage(this.cover, "cover")
-			if e := compressor.addFile(path_of_cover_page, data); e != nil {
-				return nil, e
+			data = this.generateCoverPage()
+			if e := compressor.addFile(this.archivePath(this.CoverPage()), data, time.Time{}); e != nil {
+				return e
 			}
 		}
 	}
 
 	for _, f := range this.files {
-		if e := compressor.addFile(f.Path, f.Data); e != nil {
-			return nil, e
+		path := f.Path
+		if version != EPUB_VERSION_NONE {
+			path = this.archivePath(path)
+		}
+		method := uint16(zip.Deflate)
+		if this.smart_compress && compressed_media_types[this.MediaType(f.Path)] {
+			method = zip.Store
+		}
+		if e := compressor.addEntry(path, f.Data, f.ModTime, method); e != nil {
+			return e
 		}
 	}
 
-	if e := compressor.close(); e != nil {
+	return compressor.close()
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, e := this.w.Write(p)
+	this.n += int64(n)
+	return n, e
+}
+
+// WriteTo writes the book to 'w' using the version set by 'SetVersion', it
+// implements io.WriterTo. 'w' need not be seekable, the 'mimetype' file is
+// still the first file and is stored without compression.
+func (this *Epub) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	e := this.write(cw, this.version)
+	return cw.n, e
+}
+
+func (this *Epub) Build(version int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if e := this.write(buf, version); e != nil {
 		return nil, e
 	}
+	return buf.Bytes(), nil
+}
 
-	return compressor.result(), nil
+// SaveUnpacked writes the files of the book to folder 'dir' instead of an
+// archive, existing files in the folder are overwritten
+func (this *Epub) SaveUnpacked(dir string, version int) error {
+	return this.writeTo(&epubCompressor{dir: dir}, nil, version)
 }
 
 func (this *Epub) Save(path string, version int) error {
-	data, e := this.Build(version)
+	f, e := os.Create(path)
 	if e != nil {
 		return e
 	}
 
-	f, e := os.Create(path)
-	if e == nil {
-		_, e = f.Write(data)
-		f.Close()
+	this.SetVersion(version)
+	_, e = this.WriteTo(f)
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	if e != nil {
+		os.Remove(path)
 	}
 
 	return e
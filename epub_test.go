@@ -0,0 +1,747 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reTestHref = regexp.MustCompile(`href="([^"#]+)[^"]*"`)
+
+func TestGuideReferences(t *testing.T) {
+	files := map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.jpg": "jpeg",
+	}
+	maker := makeBook(t, files)
+	zr := buildArchive(t, maker.book, EPUB_VERSION_200)
+	opf := readEntry(t, zr, "content.opf")
+
+	start, end := strings.Index(opf, "<guide>"), strings.Index(opf, "</guide>")
+	if start < 0 || end < start {
+		t.Fatalf("guide is missing in the OPF:\n%s", opf)
+	}
+	guide := opf[start:end]
+	for _, typ := range []string{"cover", "text"} {
+		if !strings.Contains(guide, "type=\""+typ+"\"") {
+			t.Errorf("guide has no '%s' reference:\n%s", typ, guide)
+		}
+	}
+	for _, m := range reTestHref.FindAllStringSubmatch(guide, -1) {
+		if findEntry(zr, m[1]) == nil {
+			t.Errorf("guide references '%s', which does not exist", m[1])
+		}
+	}
+
+	if opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf"); strings.Contains(opf, "<guide>") {
+		t.Errorf("guide is generated for EPUB3")
+	}
+
+	files["book.ini"] += "[build]\nguide=false\n"
+	maker = makeBook(t, files)
+	if opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_200), "content.opf"); strings.Contains(opf, "<guide>") {
+		t.Errorf("guide is generated while disabled")
+	}
+}
+
+func TestCompressorZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+
+	// more than 65535 entries requires the zip64 end of central directory,
+	// this is much faster than writing an entry over 4GB
+	const count = 0x10000
+	buf := new(bytes.Buffer)
+	compressor := epubCompressor{}
+	if e := compressor.init(buf); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < count; i++ {
+		if e := compressor.addFile(fmt.Sprintf("f%05d.txt", i), []byte("x"), time.Time{}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := compressor.close(); e != nil {
+		t.Fatal(e)
+	}
+
+	zr, e := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if e != nil {
+		t.Fatalf("failed to open the archive: %s", e)
+	}
+	if len(zr.File) != count+1 {
+		t.Errorf("got %d entries, want %d", len(zr.File), count+1)
+	}
+	if zr.File[0].Name != path_of_mimetype || zr.File[count].Name != fmt.Sprintf("f%05d.txt", count-1) {
+		t.Errorf("entries are out of order, first is '%s', last is '%s'", zr.File[0].Name, zr.File[count].Name)
+	}
+}
+
+func TestColophon(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":     "[book]\nname=Test\nauthor=Tester\ncolophon=@colophon.txt\n",
+		"book.html":    "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"colophon.txt": "Printed by <Tester> & Co.\n\nSecond line",
+	})
+	files := maker.book.ContentFiles()
+	f := files[len(files)-1]
+	if f.Path != path_of_colophon || f.Type != "colophon" {
+		t.Fatalf("the last content file is '%s' of type '%s', want '%s' of type 'colophon'", f.Path, f.Type, path_of_colophon)
+	}
+	s := string(f.Data)
+	for _, want := range []string{"<p>Printed by &lt;Tester&gt; &amp; Co.</p>", "<p>Second line</p>", "epub:type=\"colophon\""} {
+		if !strings.Contains(s, want) {
+			t.Errorf("'%s' is not in the colophon:\n%s", want, s)
+		}
+	}
+
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	if nav := readEntry(t, zr, "nav.xhtml"); !strings.Contains(nav, "epub:type=\"colophon\" href=\""+path_of_colophon+"\"") {
+		t.Errorf("the colophon is not in the landmarks:\n%s", nav)
+	}
+	assertWellFormed(t, path_of_colophon, readEntry(t, zr, path_of_colophon))
+}
+
+func TestFixedLayout(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\nlayout=fixed\norientation=landscape\nspread=none\nviewport=600x800\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+	})
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	for _, s := range []string{
+		"<meta property=\"rendition:layout\">pre-paginated</meta>",
+		"<meta property=\"rendition:orientation\">landscape</meta>",
+		"<meta property=\"rendition:spread\">none</meta>",
+	} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("'%s' is not in the OPF:\n%s", s, opf)
+		}
+	}
+	if n := strings.Count(opf, "properties=\"rendition:layout-pre-paginated\""); n != len(maker.book.ContentFiles()) {
+		t.Errorf("%d spine items are pre-paginated, want %d:\n%s", n, len(maker.book.ContentFiles()), opf)
+	}
+
+	// there's no fixed layout in EPUB2
+	if opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_200), "content.opf"); strings.Contains(opf, "rendition:") {
+		t.Errorf("rendition properties are in the EPUB2 OPF:\n%s", opf)
+	}
+}
+
+var (
+	reTestItem    = regexp.MustCompile(`<item [^>]*>`)
+	reTestItemref = regexp.MustCompile(`<itemref idref="([^"]+)" linear="([^"]+)"`)
+	reTestAttr    = regexp.MustCompile(`([\w-]+)="([^"]*)"`)
+)
+
+// spineItems returns the paths of the spine items in 'opf' in order, and
+// their 'linear' attributes, keys of which are the paths
+func spineItems(opf string) ([]string, map[string]string) {
+	hrefs := make(map[string]string)
+	for _, item := range reTestItem.FindAllString(opf, -1) {
+		attrs := make(map[string]string)
+		for _, m := range reTestAttr.FindAllStringSubmatch(item, -1) {
+			attrs[m[1]] = m[2]
+		}
+		hrefs[attrs["id"]] = attrs["href"]
+	}
+	var paths []string
+	linear := make(map[string]string)
+	for _, m := range reTestItemref.FindAllStringSubmatch(opf, -1) {
+		paths = append(paths, hrefs[m[1]])
+		linear[hrefs[m[1]]] = m[2]
+	}
+	return paths, linear
+}
+
+func TestSpineLinear(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\nchapter_name_pattern=chapter-{n}.html\n[linear]\nchapter-2.html=no\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"cover.jpg": "jpeg",
+	})
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	_, linear := spineItems(opf)
+	for p, want := range map[string]string{
+		maker.book.CoverPage(): "no",
+		"chapter-1.html":       "yes",
+		"chapter-2.html":       "no",
+	} {
+		if linear[p] != want {
+			t.Errorf("'linear' of '%s' is '%s', want '%s':\n%s", p, linear[p], want, opf)
+		}
+	}
+}
+
+func TestCoverPageId(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\ncover=front.xhtml\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.jpg": "jpeg",
+	})
+	for _, ver := range []int{EPUB_VERSION_200, EPUB_VERSION_300} {
+		opf := readEntry(t, buildArchive(t, maker.book, ver), "content.opf")
+		ids := make(map[string]string)
+		for _, item := range reTestItem.FindAllString(opf, -1) {
+			attrs := make(map[string]string)
+			for _, m := range reTestAttr.FindAllStringSubmatch(item, -1) {
+				attrs[m[1]] = m[2]
+			}
+			ids[attrs["href"]] = attrs["id"]
+		}
+		// the ids do not depend on the file names
+		if id := ids["front.xhtml"]; id != "cover" {
+			t.Errorf("id of the cover page is '%s' in version %d, want 'cover'", id, ver)
+		}
+		if id := ids["cover.jpg"]; id != "cover-image" {
+			t.Errorf("id of the cover image is '%s' in version %d, want 'cover-image'", id, ver)
+		}
+		if !strings.Contains(opf, `<itemref idref="cover" linear="no"`) {
+			t.Errorf("the cover page is not a non-linear spine item in version %d:\n%s", ver, opf)
+		}
+	}
+}
+
+func TestRightsFile(t *testing.T) {
+	files := map[string]string{
+		"book.ini":         "[book]\nname=Test\nauthor=Tester\n[output]\nrights_file=legal/rights.xml\ncontent_dir=OEBPS\n",
+		"book.html":        "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"legal/rights.xml": "<rights/>",
+	}
+	maker := makeBook(t, files)
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	if s := readEntry(t, zr, "META-INF/rights.xml"); s != "<rights/>" {
+		t.Errorf("content of the rights file is '%s', want '<rights/>'", s)
+	}
+	if findEntry(zr, "OEBPS/legal/rights.xml") != nil {
+		t.Errorf("the rights file is added as a content file")
+	}
+
+	// reserved names must not be overwritten
+	files["book.ini"] = "[book]\nname=Test\nauthor=Tester\n[output]\nrights_file=legal/container.xml\n"
+	files["legal/container.xml"] = "<rights/>"
+	maker = makeBook(t, files)
+	if !hasWarning(maker, "'container.xml' cannot be used") {
+		t.Errorf("reserved name 'container.xml' is accepted")
+	}
+	zr = buildArchive(t, maker.book, EPUB_VERSION_300)
+	if s := readEntry(t, zr, "META-INF/container.xml"); !strings.Contains(s, "rootfile") {
+		t.Errorf("container.xml is overwritten:\n%s", s)
+	}
+}
+
+func TestContainerFile(t *testing.T) {
+	const container = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+		<rootfile full-path="OEBPS/other.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`
+	files := map[string]string{
+		"book.ini":         "[book]\nname=Test\nauthor=Tester\n[output]\ncontainer_file=my_container.xml\ncontent_dir=OEBPS\n",
+		"book.html":        "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"my_container.xml": container,
+	}
+	maker := makeBook(t, files)
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	if s := readEntry(t, zr, "META-INF/container.xml"); s != container {
+		t.Errorf("container.xml is not the custom one:\n%s", s)
+	}
+	if findEntry(zr, "OEBPS/my_container.xml") != nil {
+		t.Errorf("the container file is added as a content file")
+	}
+
+	// the container must reference the generated package document
+	files["my_container.xml"] = strings.Replace(container, "OEBPS/content.opf", "content.opf", 1)
+	data := make(map[string][]byte)
+	for p, s := range files {
+		data[p] = []byte(s)
+	}
+	e := NewEpubMaker(testLogger).Process(NewMemoryFolder(data), false)
+	if e == nil || !strings.Contains(e.Error(), "does not reference the package document 'OEBPS/content.opf'") {
+		t.Errorf("got error '%v' with a container which does not reference the package document", e)
+	}
+}
+
+func TestBackCover(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":        "[book]\nname=Test\nauthor=Tester\nback_cover=images/back.jpg\ncolophon=Printed\n",
+		"book.html":       "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.jpg":       "jpeg",
+		"images/back.jpg": "jpeg",
+	})
+	files := maker.book.ContentFiles()
+	last := files[len(files)-1]
+	if last.Path != path_of_back_cover || last.Type != "backmatter" {
+		t.Fatalf("the last content file is '%s' of type '%s', want '%s' of type 'backmatter'", last.Path, last.Type, path_of_back_cover)
+	}
+	if !strings.Contains(string(last.Data), "images/back.jpg") {
+		t.Errorf("the back cover page does not show the image:\n%s", last.Data)
+	}
+
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	paths, _ := spineItems(opf)
+	if len(paths) == 0 || paths[len(paths)-1] != path_of_back_cover {
+		t.Errorf("the last spine item is not the back cover, spine is %v", paths)
+	}
+	if paths[0] != maker.book.CoverPage() {
+		t.Errorf("the first spine item is not the front cover, spine is %v", paths)
+	}
+}
+
+func TestTitlePage(t *testing.T) {
+	for _, c := range []struct {
+		option string
+		want   []string
+	}{
+		{"[book]\ntitle_page=<h1>Custom</h1>\n", []string{"<h1>Custom</h1>"}},
+		{"[build]\nauto_title_page=true\n", []string{"<h1>A &amp; B</h1>", "<p>Tester</p>"}},
+	} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=A & B\nauthor=Tester\n" + c.option,
+			"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+			"cover.jpg": "jpeg",
+		})
+		f := maker.book.ContentFiles()[0]
+		if f.Path != path_of_title_page || f.Type != "titlepage" {
+			t.Errorf("the first content file is '%s' of type '%s', want '%s' of type 'titlepage'", f.Path, f.Type, path_of_title_page)
+			continue
+		}
+		for _, s := range c.want {
+			if !strings.Contains(string(f.Data), s) {
+				t.Errorf("'%s' is not in the title page:\n%s", s, f.Data)
+			}
+		}
+
+		zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+		assertWellFormed(t, path_of_title_page, readEntry(t, zr, path_of_title_page))
+		if paths, _ := spineItems(readEntry(t, zr, "content.opf")); len(paths) < 2 || paths[1] != path_of_title_page {
+			t.Errorf("the title page is not after the cover, spine is %v", paths)
+		}
+		if nav := readEntry(t, zr, "nav.xhtml"); !strings.Contains(nav, "epub:type=\"titlepage\" href=\""+path_of_title_page+"\"") {
+			t.Errorf("the title page is not in the landmarks:\n%s", nav)
+		}
+	}
+}
+
+func TestCoverAlt(t *testing.T) {
+	book := NewEpub(false)
+	book.SetName("Tom & Jerry")
+	book.SetCoverImage("images/cover.jpg")
+	for _, c := range []struct {
+		alt, want string
+	}{
+		{"", "alt=\"Tom &amp; Jerry\""},
+		{"A \"cat\" <chasing> a mouse", "alt=\"A &#34;cat&#34; &lt;chasing&gt; a mouse\""},
+	} {
+		book.SetCoverAlt(c.alt)
+		s := string(book.generateCoverPage())
+		if !strings.Contains(s, c.want) {
+			t.Errorf("'%s' is not in the cover page:\n%s", c.want, s)
+		}
+		assertWellFormed(t, "cover page", s)
+	}
+
+	// the SVG wrapped cover uses the alt text as its title
+	book.SetCoverSize(600, 800)
+	s := string(book.generateCoverPage())
+	if !strings.Contains(s, "<title>A &#34;cat&#34; &lt;chasing&gt; a mouse</title>") {
+		t.Errorf("alt text is not the title of the SVG:\n%s", s)
+	}
+	assertWellFormed(t, "cover page", s)
+}
+
+func TestSaveUnpacked(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":     "[book]\nname=Test\nauthor=Tester\n",
+		"book.html":    "<html><head></head><body><h1>One</h1><p><img src=\"images/a.jpg\"/></p></body></html>",
+		"images/a.jpg": "jpeg",
+	})
+	dir := filepath.Join(t.TempDir(), "book")
+	if e := maker.book.SaveUnpacked(dir, EPUB_VERSION_300); e != nil {
+		t.Fatal(e)
+	}
+
+	// the folder has the same files as the archive
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	for _, f := range zr.File {
+		data, e := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if e != nil {
+			t.Errorf("'%s' is not written to the folder: %s", f.Name, e)
+		} else if s := readEntry(t, zr, f.Name); string(data) != s {
+			t.Errorf("'%s' in the folder differs from the archive", f.Name)
+		}
+	}
+	for _, name := range []string{"mimetype", "META-INF/container.xml", "content.opf", "nav.xhtml", "images/a.jpg"} {
+		if findEntry(zr, name) == nil {
+			t.Errorf("'%s' does not exist", name)
+		}
+	}
+}
+
+func TestSaveUnpackedOutOfFolder(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":       "[book]\nname=Test\nauthor=Tester\n",
+		"book.html":      "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"../escaped.txt": "escaped",
+	})
+	parent := t.TempDir()
+	if e := maker.book.SaveUnpacked(filepath.Join(parent, "book"), EPUB_VERSION_300); e == nil {
+		t.Errorf("no error for a file out of the output folder")
+	}
+	if _, e := os.Stat(filepath.Join(parent, "escaped.txt")); !os.IsNotExist(e) {
+		t.Errorf("a file is written out of the output folder")
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	maker.book.SetVersion(EPUB_VERSION_300)
+	buf := new(bytes.Buffer)
+	n, e := maker.book.WriteTo(buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returns %d, but %d bytes are written", n, buf.Len())
+	}
+
+	// reading systems look for the mimetype at a fixed offset of the archive
+	data := buf.Bytes()
+	if len(data) < 58 || string(data[30:58]) != "mimetypeapplication/epub+zip" {
+		t.Errorf("the archive does not start with the uncompressed mimetype file")
+	}
+	zr, e := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if f := zr.File[0]; f.Name != "mimetype" || f.Method != zip.Store {
+		t.Errorf("the first entry is '%s' with method %d, want 'mimetype' stored", f.Name, f.Method)
+	}
+	readEntry(t, zr, "content.opf")
+}
+
+// manifestProperties returns the 'properties' of the manifest items in 'opf'
+// by their paths
+func manifestProperties(opf string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range reTestItem.FindAllString(opf, -1) {
+		attrs := make(map[string]string)
+		for _, m := range reTestAttr.FindAllStringSubmatch(item, -1) {
+			attrs[m[1]] = m[2]
+		}
+		result[attrs["href"]] = attrs["properties"]
+	}
+	return result
+}
+
+func TestSmartCompression(t *testing.T) {
+	for _, smart := range []bool{true, false} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":       "[book]\nname=Test\nauthor=Tester\n[output]\nsmart_compression=" + fmt.Sprint(smart) + "\n",
+			"book.html":      "<html><head></head><body><h1>One</h1><p><img src=\"a.png\"/></p></body></html>",
+			"a.png":          "png",
+			"cover.jpg":      "jpeg",
+			"fonts/a.woff":   "woff",
+			"style/book.css": "p { margin: 0; }",
+		})
+		zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+		for _, f := range zr.File {
+			want := uint16(zip.Deflate)
+			switch {
+			case f.Name == "mimetype":
+				want = zip.Store
+			case smart && (f.Name == "a.png" || f.Name == "cover.jpg" || f.Name == "fonts/a.woff"):
+				want = zip.Store
+			}
+			if f.Method != want {
+				t.Errorf("smart_compression=%v: compression method of '%s' is %d, want %d", smart, f.Name, f.Method, want)
+			}
+		}
+		if findEntry(zr, "fonts/a.woff") == nil {
+			t.Errorf("'fonts/a.woff' is not in the book")
+		}
+	}
+}
+
+func TestScriptedProperty(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p><script>var x;</script></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	props := manifestProperties(readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf"))
+	if p := props[files[1].Path]; p != "scripted" {
+		t.Errorf("properties of the scripted chapter are '%s', want 'scripted'", p)
+	}
+	if p := props[files[0].Path]; p != "" {
+		t.Errorf("properties of the chapter without scripts are '%s', want none", p)
+	}
+	// EPUB2 has no manifest properties
+	if opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_200), "content.opf"); strings.Contains(opf, "scripted") {
+		t.Errorf("the scripted property is in the OPF of EPUB2:\n%s", opf)
+	}
+}
+
+func TestMathmlProperty(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p><math><mi>x</mi></math></p><h1>Two</h1><p>2</p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	props := manifestProperties(readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf"))
+	if p := props[files[0].Path]; p != "mathml" {
+		t.Errorf("properties of the chapter with MathML are '%s', want 'mathml'", p)
+	}
+	if p := props[files[1].Path]; p != "" {
+		t.Errorf("properties of the chapter without MathML are '%s', want none", p)
+	}
+}
+
+func TestSvgProperty(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p><svg width=\"1\" height=\"1\"><rect width=\"1\" height=\"1\"/></svg></p>" +
+			"<h1>Two</h1><p><math><mi>x</mi></math><svg width=\"1\" height=\"1\"></svg></p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	props := manifestProperties(readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf"))
+	if p := props[files[0].Path]; p != "svg" {
+		t.Errorf("properties of the chapter with SVG are '%s', want 'svg'", p)
+	}
+	if p := props[files[1].Path]; p != "mathml svg" {
+		t.Errorf("properties of the chapter with MathML & SVG are '%s', want 'mathml svg'", p)
+	}
+}
+
+func TestClosingTags(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>\n</body></html>\n<h1>Two</h1><p>2</p></body>\n</html>",
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	for _, f := range maker.book.ContentFiles() {
+		s := readEntry(t, zr, f.Path)
+		if strings.Count(s, "</body>") != 1 || strings.Count(s, "</html>") != 1 {
+			t.Errorf("closing tags of '%s' are not written exactly once:\n%s", f.Path, s)
+		}
+	}
+	for _, c := range []struct {
+		version int
+		name    string
+	}{{EPUB_VERSION_200, "toc.ncx"}, {EPUB_VERSION_300, "nav.xhtml"}} {
+		s := readEntry(t, buildArchive(t, maker.book, c.version), c.name)
+		assertWellFormed(t, c.name, s)
+		if !strings.HasSuffix(s, ">\n") {
+			t.Errorf("'%s' does not end with a newline", c.name)
+		}
+	}
+}
+
+func TestMediaTypes(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\ninclude=fonts/a.bin,fonts/b.bin\n" +
+			"[media_types]\nfonts/a.bin=font/otf\nfonts/b.bin=font/otf\" id=\"x\n",
+		"book.html":   "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"fonts/a.bin": "otf",
+		"fonts/b.bin": "otf",
+	})
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	assertWellFormed(t, "content.opf", opf)
+	types := make(map[string]string)
+	for _, item := range reTestItem.FindAllString(opf, -1) {
+		attrs := make(map[string]string)
+		for _, m := range reTestAttr.FindAllStringSubmatch(item, -1) {
+			attrs[m[1]] = m[2]
+		}
+		types[attrs["href"]] = attrs["media-type"]
+	}
+	if mt := types["fonts/a.bin"]; mt != "font/otf" {
+		t.Errorf("media type of 'fonts/a.bin' is '%s', want 'font/otf'", mt)
+	}
+	// invalid media types are ignored
+	if mt := types["fonts/b.bin"]; mt != "application/octet-stream" {
+		t.Errorf("media type of 'fonts/b.bin' is '%s', want 'application/octet-stream'", mt)
+	}
+	if !hasWarning(maker, "media type of 'fonts/b.bin' is invalid") {
+		t.Errorf("no warning for the invalid media type")
+	}
+}
+
+var reTestModified = regexp.MustCompile(`<meta property="dcterms:modified">[^<]*</meta>`)
+
+// xmlTree returns the tokens of XML document 'doc', white spaces between
+// elements are ignored
+func xmlTree(t *testing.T, name, doc string) []string {
+	t.Helper()
+	var tokens []string
+	d := xml.NewDecoder(strings.NewReader(reTestModified.ReplaceAllString(doc, "")))
+	for {
+		tok, e := d.Token()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			t.Fatalf("'%s' is not well-formed: %s\n%s", name, e, doc)
+		}
+		if cd, ok := tok.(xml.CharData); ok {
+			if cd = bytes.TrimSpace(cd); len(cd) == 0 {
+				continue
+			}
+			tok = cd
+		}
+		tokens = append(tokens, fmt.Sprintf("%T%v", tok, tok))
+	}
+	return tokens
+}
+
+func TestPrettyXml(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><pre>a\n  b</pre><h1>Two</h1><p>2</p></body></html>",
+		"cover.jpg": "jpeg",
+	})
+	for _, c := range []struct {
+		version int
+		files   []string
+	}{
+		{EPUB_VERSION_200, []string{"content.opf", "toc.ncx"}},
+		{EPUB_VERSION_300, []string{"content.opf", "nav.xhtml"}},
+	} {
+		maker.book.SetPrettyXml(false)
+		compact := buildArchive(t, maker.book, c.version)
+		maker.book.SetPrettyXml(true)
+		pretty := buildArchive(t, maker.book, c.version)
+		for _, name := range c.files {
+			a, b := readEntry(t, compact, name), readEntry(t, pretty, name)
+			if a == b {
+				t.Errorf("'%s' of version %d is not pretty-printed", name, c.version)
+			}
+			want, got := xmlTree(t, name, a), xmlTree(t, name, b)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("pretty '%s' of version %d is different from the compact one:\n%s\n%s",
+					name, c.version, strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		}
+		// content files are not changed
+		for _, f := range maker.book.ContentFiles() {
+			if a, b := readEntry(t, compact, f.Path), readEntry(t, pretty, f.Path); a != b {
+				t.Errorf("'%s' is changed by pretty-printing:\n%s", f.Path, b)
+			}
+		}
+	}
+}
+
+func TestAlternateScript(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=西游记\nauthor=吴承恩\nname_alt=Xi You Ji & More\nname_alt_lang=zh-Latn\n" +
+			"author_alt=Wu Cheng'en\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	assertWellFormed(t, "content.opf", opf)
+	for _, s := range []string{
+		`<dc:title id="title">西游记</dc:title>`,
+		`<meta refines="#title" property="alternate-script" xml:lang="zh-Latn">Xi You Ji &amp; More</meta>`,
+		`<dc:creator id="creator">吴承恩</dc:creator>`,
+		`<meta refines="#creator" property="alternate-script">Wu Cheng&#39;en</meta>`,
+	} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("'%s' is not in the OPF:\n%s", s, opf)
+		}
+	}
+	if !hasWarning(maker, "option 'author_alt_lang' is empty") {
+		t.Errorf("no warning for the missing language of 'author_alt'")
+	}
+
+	// refines are EPUB3 only
+	opf = readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_200), "content.opf")
+	if strings.Contains(opf, "alternate-script") || strings.Contains(opf, `<dc:title id=`) {
+		t.Errorf("alternate-script is in the EPUB2 OPF:\n%s", opf)
+	}
+}
+
+func TestGeneratorMeta(t *testing.T) {
+	const meta = "<meta name=\"generator\" content=\"makeepub v" + version + "\"/>"
+	for _, enabled := range []bool{true, false} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Test\nauthor=Tester\n[output]\ngenerator_meta=" + fmt.Sprint(enabled) + "\n",
+			"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		})
+		for _, v := range []int{EPUB_VERSION_200, EPUB_VERSION_300} {
+			opf := readEntry(t, buildArchive(t, maker.book, v), "content.opf")
+			if strings.Contains(opf, meta) != enabled {
+				t.Errorf("generator_meta=%v, version %d: the OPF is:\n%s", enabled, v, opf)
+			}
+			if strings.Contains(opf, "makeepub:") {
+				t.Errorf("undeclared prefix 'makeepub' is used in the OPF of version %d:\n%s", v, opf)
+			}
+		}
+	}
+}
+
+func TestCoverSize(t *testing.T) {
+	// the placeholder cover image cannot be decoded
+	files := map[string]string{
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.jpg": "jpeg",
+	}
+	files["book.ini"] = "[book]\nname=Test\nauthor=Tester\n[cover]\nwidth=600\nheight=800\n"
+	maker := makeBook(t, files)
+	cover := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "cover.html")
+	assertWellFormed(t, "cover.html", cover)
+	for _, want := range []string{"viewBox=\"0 0 600 800\"", "<image width=\"600\" height=\"800\" xlink:href=\"cover.jpg\"/>"} {
+		if !strings.Contains(cover, want) {
+			t.Errorf("'%s' is not in the cover page:\n%s", want, cover)
+		}
+	}
+
+	for _, size := range []string{"width=600\n", "width=600\nheight=0\n", "width=a\nheight=800\n"} {
+		files["book.ini"] = "[book]\nname=Test\nauthor=Tester\n[cover]\n" + size
+		maker = makeBook(t, files)
+		if !hasWarning(maker, "must both be positive integers") {
+			t.Errorf("no warning for invalid cover size '%s'", strings.Replace(size, "\n", " ", -1))
+		}
+		cover = readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "cover.html")
+		if strings.Contains(cover, "<svg") {
+			t.Errorf("the cover page of invalid size '%s' is SVG wrapped", strings.Replace(size, "\n", " ", -1))
+		}
+	}
+}
+
+func TestNcxDepth(t *testing.T) {
+	for _, c := range []struct {
+		html  string
+		depth int
+	}{
+		{"<h1>A</h1><p>1</p><h2>B</h2><p>2</p><h3>C</h3><p>3</p><h1>D &amp; E</h1><p>4</p>", 3},
+		// skipped levels are nested by one
+		{"<h1>A</h1><p>1</p><h3>B</h3><p>2</p><h2>C</h2><p>3</p>", 2},
+	} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Tom & Jerry\nauthor=Tester\ntoc=3\n",
+			"book.html": "<html><head></head><body>" + c.html + "</body></html>",
+		})
+		zr := buildArchive(t, maker.book, EPUB_VERSION_200)
+		ncx := readEntry(t, zr, "toc.ncx")
+		assertWellFormed(t, "toc.ncx", ncx)
+		if want := fmt.Sprintf("<meta content=\"%d\" name=\"dtb:depth\"/>", c.depth); !strings.Contains(ncx, want) {
+			t.Errorf("'%s' is not in the NCX:\n%s", want, ncx)
+		}
+		assertWellFormed(t, "nav.xhtml", readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "nav.xhtml"))
+	}
+}
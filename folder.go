@@ -3,11 +3,18 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -21,6 +28,12 @@ type VirtualFolder interface {
 	Name() string
 }
 
+// ModTimeFolder is a VirtualFolder which knows the modification time of its
+// files
+type ModTimeFolder interface {
+	ModTime(path string) (time.Time, error)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 type SystemFolder struct {
@@ -39,6 +52,14 @@ func (this *SystemFolder) Name() string {
 	return this.path
 }
 
+func (this *SystemFolder) ModTime(path string) (time.Time, error) {
+	stat, e := os.Stat(filepath.Join(this.path, path))
+	if e != nil {
+		return time.Time{}, e
+	}
+	return stat.ModTime(), nil
+}
+
 func (this *SystemFolder) Walk(fnWalk FxWalk) error {
 	walk := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -65,9 +86,30 @@ func (this *SystemFolder) ReadDirNames() ([]string, error) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// ZipFolder is a zip file. A malformed zip file may have several entries
+// with the same name (case-insensitive), the last entry wins in this case,
+// which is the same as most unzip tools.
 type ZipFolder struct {
-	zr   *zip.Reader
-	name string
+	zr         *zip.Reader
+	name       string
+	index      map[string]*zip.File // normalized name => the winning entry
+	duplicates []string
+}
+
+func normalizeZipName(name string) string {
+	return strings.ToLower(filepath.ToSlash(name))
+}
+
+func newZipFolder(zr *zip.Reader, name string) *ZipFolder {
+	this := &ZipFolder{zr: zr, name: name, index: make(map[string]*zip.File)}
+	for _, f := range zr.File {
+		n := normalizeZipName(f.Name)
+		if _, ok := this.index[n]; ok {
+			this.duplicates = append(this.duplicates, f.Name)
+		}
+		this.index[n] = f
+	}
+	return this
 }
 
 func NewZipFolder(data []byte) (*ZipFolder, error) {
@@ -75,7 +117,7 @@ func NewZipFolder(data []byte) (*ZipFolder, error) {
 	if zr, e := zip.NewReader(r, int64(len(data))); e != nil {
 		return nil, e
 	} else {
-		return &ZipFolder{zr: zr, name: "<memory>"}, nil
+		return newZipFolder(zr, "<memory>"), nil
 	}
 }
 
@@ -94,17 +136,36 @@ func (this *ZipFolder) Name() string {
 	return this.name
 }
 
+// Duplicates returns the names of entries which have the same name as an
+// earlier entry
+func (this *ZipFolder) Duplicates() []string {
+	return this.duplicates
+}
+
 func (this *ZipFolder) OpenFile(path string) (io.ReadCloser, error) {
-	for _, f := range this.zr.File {
-		if strings.ToLower(f.Name) == path {
-			return f.Open()
-		}
+	if f, ok := this.index[normalizeZipName(path)]; ok {
+		return f.Open()
 	}
 	return nil, os.ErrNotExist
 }
 
+func (this *ZipFolder) ModTime(path string) (time.Time, error) {
+	if f, ok := this.index[normalizeZipName(path)]; ok {
+		return f.Modified, nil
+	}
+	return time.Time{}, os.ErrNotExist
+}
+
+// winner reports whether 'f' is the entry used for its name
+func (this *ZipFolder) winner(f *zip.File) bool {
+	return this.index[normalizeZipName(f.Name)] == f
+}
+
 func (this *ZipFolder) Walk(fnWalk FxWalk) error {
 	for _, f := range this.zr.File {
+		if !this.winner(f) {
+			continue
+		}
 		if e := fnWalk(f.Name); e != nil {
 			return e
 		}
@@ -113,16 +174,247 @@ func (this *ZipFolder) Walk(fnWalk FxWalk) error {
 }
 
 func (this *ZipFolder) ReadDirNames() ([]string, error) {
-	names := make([]string, len(this.zr.File))
-	for i, f := range this.zr.File {
-		names[i] = f.Name
+	names := make([]string, 0, len(this.zr.File))
+	for _, f := range this.zr.File {
+		if this.winner(f) {
+			names = append(names, f.Name)
+		}
 	}
 	return names, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// MemoryFolder is a virtual folder whose files are stored in memory, keys of
+// the map are file paths and values are file contents
+type MemoryFolder struct {
+	files map[string][]byte
+}
+
+func NewMemoryFolder(files map[string][]byte) *MemoryFolder {
+	return &MemoryFolder{files: files}
+}
+
+func (this *MemoryFolder) Name() string {
+	return "<memory>"
+}
+
+func (this *MemoryFolder) OpenFile(path string) (io.ReadCloser, error) {
+	path = filepath.ToSlash(path)
+	if data, ok := this.files[path]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	for name, data := range this.files {
+		if strings.EqualFold(name, path) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (this *MemoryFolder) Walk(fnWalk FxWalk) error {
+	names, _ := this.ReadDirNames()
+	for _, name := range names {
+		if e := fnWalk(name); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (this *MemoryFolder) ReadDirNames() ([]string, error) {
+	names := make([]string, 0, len(this.files))
+	for name := range this.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// HttpFolder is a virtual folder on a web server, it has a manifest file which
+// is a JSON array of the paths of all files
+type HttpFolder struct {
+	base   string // base url, ends with '/'
+	client *http.Client
+	names  []string
+}
+
+const (
+	path_of_http_manifest = "manifest.json"
+	http_folder_timeout   = 30 * time.Second
+)
+
+// OpenHttpFolder opens the folder at 'rawurl', which is the url of the folder,
+// or the url of the manifest file if it ends with '.json'
+func OpenHttpFolder(rawurl string) (*HttpFolder, error) {
+	this := &HttpFolder{client: &http.Client{Timeout: http_folder_timeout}}
+	manifest := rawurl
+	if strings.HasSuffix(strings.ToLower(rawurl), ".json") {
+		this.base = rawurl[:strings.LastIndex(rawurl, "/")+1]
+	} else {
+		this.base = strings.TrimSuffix(rawurl, "/") + "/"
+		manifest = this.base + path_of_http_manifest
+	}
+
+	rc, e := this.get(manifest)
+	if e != nil {
+		return nil, e
+	}
+	defer rc.Close()
+	if e = json.NewDecoder(rc).Decode(&this.names); e != nil {
+		return nil, e
+	}
+	return this, nil
+}
+
+func (this *HttpFolder) get(url string) (io.ReadCloser, error) {
+	resp, e := this.client.Get(url)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("failed to get '%s': %s", url, resp.Status)
+}
+
+func (this *HttpFolder) Name() string {
+	return this.base
+}
+
+func (this *HttpFolder) OpenFile(path string) (io.ReadCloser, error) {
+	path = filepath.ToSlash(path)
+	for _, name := range this.names {
+		if strings.EqualFold(name, path) {
+			path = name
+			break
+		}
+	}
+	return this.get(this.base + (&url.URL{Path: path}).EscapedPath())
+}
+
+func (this *HttpFolder) Walk(fnWalk FxWalk) error {
+	for _, name := range this.names {
+		if e := fnWalk(name); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (this *HttpFolder) ReadDirNames() ([]string, error) {
+	return this.names, nil
+}
+
+func isHttpUrl(path string) bool {
+	path = strings.ToLower(path)
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GitFolder is the tree of a commit in a git repository, it runs the 'git'
+// command to read files, so git must be installed
+type GitFolder struct {
+	repo  string
+	ref   string
+	tree  string // object id of the tree at 'ref'
+	names []string
+}
+
+const git_folder_prefix = "git:"
+
+// OpenGitFolder opens the tree at 'ref' (HEAD if empty) of repository 'repo'
+func OpenGitFolder(repo, ref string) (*GitFolder, error) {
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	this := &GitFolder{repo: repo, ref: ref}
+
+	// '--end-of-options' prevents a ref starting with '-' from being parsed
+	// as an option, and the tree id is used later for the same reason
+	out, e := this.git("rev-parse", "--verify", "--end-of-options", ref+"^{tree}")
+	if e != nil {
+		return nil, e
+	}
+	this.tree = strings.TrimSpace(string(out))
+
+	out, e = this.git("ls-tree", "-r", "-z", "--name-only", this.tree)
+	if e != nil {
+		return nil, e
+	}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if len(name) > 0 {
+			this.names = append(this.names, name)
+		}
+	}
+	return this, nil
+}
+
+func (this *GitFolder) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", this.repo}, args...)...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, e := cmd.Output()
+	if e != nil {
+		return nil, fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (this *GitFolder) Name() string {
+	return git_folder_prefix + this.repo + "#" + this.ref
+}
+
+func (this *GitFolder) OpenFile(path string) (io.ReadCloser, error) {
+	path = filepath.ToSlash(path)
+	for _, name := range this.names {
+		if strings.EqualFold(name, path) {
+			data, e := this.git("cat-file", "blob", this.tree+":"+name)
+			if e != nil {
+				return nil, e
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (this *GitFolder) Walk(fnWalk FxWalk) error {
+	for _, name := range this.names {
+		if e := fnWalk(name); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (this *GitFolder) ReadDirNames() ([]string, error) {
+	return this.names, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 func OpenVirtualFolder(path string) (VirtualFolder, error) {
+	if isHttpUrl(path) {
+		return OpenHttpFolder(path)
+	}
+
+	// 'git:<repo>[#<ref>]'
+	if strings.HasPrefix(path, git_folder_prefix) {
+		repo, ref := path[len(git_folder_prefix):], ""
+		if i := strings.LastIndexByte(repo, '#'); i != -1 {
+			repo, ref = repo[:i], repo[i+1:]
+		}
+		return OpenGitFolder(repo, ref)
+	}
+
 	stat, e := os.Stat(path)
 	if e != nil {
 		return nil, e
@@ -135,4 +427,16 @@ func OpenVirtualFolder(path string) (VirtualFolder, error) {
 	return OpenZipFolder(path)
 }
 
+// OpenBookFolder is the same as 'OpenVirtualFolder', but an epub file is
+// unpacked to the source files of a book, it is for the commands which build
+// books, other commands process the files of an epub file as is
+func OpenBookFolder(path string) (VirtualFolder, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".epub" {
+		if stat, e := os.Stat(path); e == nil && !stat.IsDir() {
+			return OpenEpubFolder(path)
+		}
+	}
+	return OpenVirtualFolder(path)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
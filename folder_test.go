@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemoryFolder(t *testing.T) {
+	folder := NewMemoryFolder(map[string][]byte{
+		"b.html":     []byte("b"),
+		"images/a.x": []byte("a"),
+		"a.html":     []byte("a.html"),
+	})
+
+	var names []string
+	e := folder.Walk(func(path string) error {
+		names = append(names, path)
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s := strings.Join(names, ","); s != "a.html,b.html,images/a.x" {
+		t.Errorf("walked '%s', want 'a.html,b.html,images/a.x'", s)
+	}
+
+	rc, e := folder.OpenFile("A.HTML")
+	if e != nil {
+		t.Fatalf("failed to open a file case-insensitively: %s", e)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(data) != "a.html" {
+		t.Errorf("content is '%s', want 'a.html'", data)
+	}
+
+	if _, e = folder.OpenFile("c.html"); !os.IsNotExist(e) {
+		t.Errorf("opening a missing file returns '%v', want not exist", e)
+	}
+}
+
+func TestGitFolder(t *testing.T) {
+	if _, e := exec.LookPath("git"); e != nil {
+		t.Skip("git is not installed")
+	}
+	repo := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		if out, e := cmd.CombinedOutput(); e != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+	run("init", "-q")
+	if e := ioutil.WriteFile(filepath.Join(repo, "book.html"), []byte("v1"), 0666); e != nil {
+		t.Fatal(e)
+	}
+	run("add", "book.html")
+	run("-c", "user.name=Tester", "-c", "user.email=tester@example.com", "commit", "-q", "-m", "v1")
+	run("tag", "v1")
+	// changes in the working tree must not be read
+	if e := ioutil.WriteFile(filepath.Join(repo, "book.html"), []byte("v2"), 0666); e != nil {
+		t.Fatal(e)
+	}
+
+	folder, e := OpenGitFolder(repo, "v1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if names, _ := folder.ReadDirNames(); len(names) != 1 || names[0] != "book.html" {
+		t.Errorf("files are %v, want [book.html]", names)
+	}
+	rc, e := folder.OpenFile("book.html")
+	if e != nil {
+		t.Fatal(e)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(data) != "v1" {
+		t.Errorf("content is '%s', want 'v1'", data)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if _, e = OpenGitFolder(repo, "--output="+out); e == nil {
+		t.Errorf("a ref starting with '-' is accepted")
+	}
+	if _, e = os.Stat(out); e == nil {
+		t.Errorf("a ref starting with '-' is parsed as an option")
+	}
+}
+
+func TestZipFolderDuplicates(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range []struct{ name, data string }{
+		{"book.html", "first"},
+		{"a.css", "a"},
+		{"BOOK.html", "last"},
+	} {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.data))
+	}
+	if e := zw.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	folder, e := NewZipFolder(buf.Bytes())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if d := folder.Duplicates(); len(d) != 1 || d[0] != "BOOK.html" {
+		t.Errorf("duplicates are %v, want [BOOK.html]", d)
+	}
+	if names, _ := folder.ReadDirNames(); strings.Join(names, ",") != "a.css,BOOK.html" {
+		t.Errorf("files are %v, want [a.css BOOK.html]", names)
+	}
+	rc, e := folder.OpenFile("book.html")
+	if e != nil {
+		t.Fatal(e)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(data) != "last" {
+		t.Errorf("content is '%s', the last entry should win", data)
+	}
+}
+
+func TestOpenBookFolder(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	p := filepath.Join(t.TempDir(), "test.epub")
+	if e := maker.book.Save(p, EPUB_VERSION_300); e != nil {
+		t.Fatal(e)
+	}
+
+	// only the commands which build books unpack epub files
+	if folder, e := OpenBookFolder(p); e != nil {
+		t.Fatal(e)
+	} else if _, ok := folder.(*EpubFolder); !ok {
+		t.Errorf("an epub file is opened as %T by OpenBookFolder, want *EpubFolder", folder)
+	}
+	if folder, e := OpenVirtualFolder(p); e != nil {
+		t.Fatal(e)
+	} else if _, ok := folder.(*ZipFolder); !ok {
+		t.Errorf("an epub file is opened as %T by OpenVirtualFolder, want *ZipFolder", folder)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A content file may start with a front matter block, which is a list of
+// 'key: value' lines between two '---' lines, for example:
+//
+//	---
+//	title: Part Two
+//	type: bodymatter
+//	linear: yes
+//	---
+//	<html>...
+//
+// The block is removed from the content, and a chapter tag is inserted at the
+// beginning of the 'body' of the file to start a new chapter file, whose TOC
+// title, 'epub:type' and 'linear' attribute are set by the values.
+
+const (
+	front_matter_delimiter = "---"
+	data_chapter_type      = "data-chapter-type"
+	data_chapter_linear    = "data-chapter-linear"
+)
+
+// splitFrontMatter returns the front matter block & the remaining content of
+// 'data', the block is nil if 'data' does not start with a front matter
+func splitFrontMatter(data []byte) (map[string]string, []byte) {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) == 0 || strings.TrimSpace(string(lines[0])) != front_matter_delimiter {
+		return nil, data
+	}
+
+	fm, size := make(map[string]string), len(lines[0])
+	for _, line := range lines[1:] {
+		size += len(line)
+		s := strings.TrimSpace(string(line))
+		if s == front_matter_delimiter {
+			return fm, data[size:]
+		}
+		if i := strings.IndexByte(s, ':'); i > 0 {
+			fm[strings.ToLower(strings.TrimSpace(s[:i]))] = strings.TrimSpace(s[i+1:])
+		}
+	}
+
+	// no end delimiter, so it is not a front matter
+	return nil, data
+}
+
+// frontMatterTag creates the chapter tag for front matter 'fm' of file 'path'
+func (this *EpubMaker) frontMatterTag(path string, fm map[string]string) *html.Node {
+	level := 0
+	title, hasTitle := fm["title"]
+	if hasTitle {
+		level = 1
+	}
+	if s, ok := fm["level"]; ok {
+		if l, e := strconv.Atoi(s); e != nil || l < 0 || l > lowest_level {
+			this.writeWarning("invalid level '" + s + "' in front matter of '" + path + "', ignored.")
+		} else {
+			level = l
+		}
+	}
+
+	node := newChapterTag(level)
+	if hasTitle {
+		node.Attr = append(node.Attr, html.Attribute{Key: data_chapter_title, Val: title})
+	}
+	if t, ok := fm["type"]; ok {
+		node.Attr = append(node.Attr, html.Attribute{Key: data_chapter_type, Val: t})
+	}
+	if s, ok := fm["linear"]; ok {
+		switch strings.ToLower(s) {
+		case "yes", "true":
+			node.Attr = append(node.Attr, html.Attribute{Key: data_chapter_linear, Val: "yes"})
+		case "no", "false":
+			node.Attr = append(node.Attr, html.Attribute{Key: data_chapter_linear, Val: "no"})
+		default:
+			this.writeWarning("invalid linear attribute '" + s + "' in front matter of '" + path + "', ignored.")
+		}
+	}
+
+	for key := range fm {
+		switch key {
+		case "title", "level", "type", "linear":
+		default:
+			this.writeWarning("unknown key '" + key + "' in front matter of '" + path + "', ignored.")
+		}
+	}
+	return node
+}
+
+// checkFrontMatterTag records the 'epub:type' & 'linear' attribute of the
+// chapter file started by a front matter tag, they are applied when the file
+// is saved
+func (this *EpubMaker) checkFrontMatterTag(node *html.Node) {
+	if node.DataAtom != atom.Div {
+		return
+	}
+	if t := getAttributeValue(node, data_chapter_type, ""); len(t) > 0 {
+		this.front_type = t
+		removeAttribute(node, data_chapter_type)
+	}
+	if l := getAttributeValue(node, data_chapter_linear, ""); len(l) > 0 {
+		this.front_linear = l
+		removeAttribute(node, data_chapter_linear)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFrontMatter(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":   "[book]\nname=Test\nauthor=Tester\n[build]\ncontent_files=part1.html,part2.html\n",
+		"part1.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"part2.html": "---\ntitle: Notes\ntype: appendix\nlinear: no\n---\n<html><head></head><body><p>2</p></body></html>",
+	})
+	if s := chapterTitles(maker); s != "One,Notes" {
+		t.Errorf("chapters are '%s', want 'One,Notes'", s)
+	}
+
+	files := maker.book.ContentFiles()
+	data := string(files[1].Data)
+	if strings.Contains(data, "---") || strings.Contains(data, "title:") {
+		t.Errorf("the front matter is not removed:\n%s", data)
+	}
+	if s := maker.book.FileType(files[1].Path); s != "appendix" {
+		t.Errorf("type of the chapter is '%s', want 'appendix'", s)
+	}
+	_, linear := spineItems(readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf"))
+	if s := linear[files[0].Path]; s != "yes" {
+		t.Errorf("linear attribute of the first chapter is '%s', want 'yes'", s)
+	}
+	if s := linear[files[1].Path]; s != "no" {
+		t.Errorf("linear attribute of the chapter with front matter is '%s', want 'no'", s)
+	}
+}
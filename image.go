@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/webp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// modern image formats which are not supported by many reading systems
+func isModernImage(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	return ext == ".webp" || ext == ".avif"
+}
+
+// transcodeImage decodes a WebP image and encodes it to JPEG if it is opaque,
+// otherwise PNG. It returns the new data and the new extension.
+func transcodeImage(data []byte) ([]byte, string, error) {
+	img, e := webp.Decode(bytes.NewReader(data))
+	if e != nil {
+		return nil, "", e
+	}
+
+	buf, ext := new(bytes.Buffer), ".png"
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		ext = ".jpg"
+		e = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		e = png.Encode(buf, img)
+	}
+	if e != nil {
+		return nil, "", e
+	}
+	return buf.Bytes(), ext, nil
+}
+
+// transcode_params identifies the parameters of 'transcodeImage', it must be
+// changed when the parameters change to invalidate the cached results
+const transcode_params = "webp:jpeg-q90,png"
+
+// cacheFolder returns the path of folder 'cache_dir' in the OS, it is empty
+// if there's no cache or the book is not in an OS folder
+func (this *EpubMaker) cacheFolder() string {
+	sf, ok := this.folder.(*SystemFolder)
+	if !ok || len(this.cache_dir) == 0 {
+		return ""
+	}
+	return filepath.Join(sf.path, filepath.FromSlash(this.cache_dir))
+}
+
+// cachedTranscodeImage is the same as 'transcodeImage', but the result is
+// cached in folder 'cache_dir' (if not empty) to skip unchanged images in
+// later builds. The cache key is the hash of the parameters and the data.
+func (this *EpubMaker) cachedTranscodeImage(data []byte) ([]byte, string, error) {
+	dir := this.cacheFolder()
+	if len(dir) == 0 {
+		return transcodeImage(data)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(transcode_params))
+	h.Write(data)
+	key := filepath.Join(dir, hex.EncodeToString(h.Sum(nil)))
+	for _, ext := range []string{".jpg", ".png"} {
+		if d, e := ioutil.ReadFile(key + ext); e == nil {
+			this.writeDebug("transcoded image found in cache '" + key + ext + "'.")
+			return d, ext, nil
+		}
+	}
+
+	d, ext, e := transcodeImage(data)
+	if e != nil {
+		return nil, "", e
+	}
+	if e = os.MkdirAll(dir, os.ModeDir|0755); e == nil {
+		e = ioutil.WriteFile(key+ext, d, 0666)
+	}
+	if e != nil {
+		this.writeWarning("failed to cache transcoded image: " + e.Error())
+	}
+	return d, ext, nil
+}
+
+// transcodeImages converts WebP images to PNG/JPEG, and updates references
+// to them. There's no AVIF decoder, so AVIF images are kept as is.
+func (this *EpubMaker) transcodeImages() {
+	exists := make(map[string]bool)
+	for _, f := range this.files {
+		exists[strings.ToLower(f.path)] = true
+	}
+
+	count := 0
+	for _, f := range this.files {
+		if !isModernImage(f.path) {
+			continue
+		}
+		if strings.ToLower(path.Ext(f.path)) == ".avif" {
+			this.writeWarning("AVIF image '" + f.path + "' cannot be transcoded, it is kept as is.")
+			continue
+		}
+
+		data, ext, e := this.cachedTranscodeImage(f.data)
+		if e != nil {
+			this.writeWarning("failed to transcode '" + f.path + "': " + e.Error())
+			continue
+		}
+		np := strings.TrimSuffix(f.path, path.Ext(f.path)) + ext
+		if exists[strings.ToLower(np)] {
+			this.writeWarning("'" + f.path + "' is not transcoded, because '" + np + "' already exists.")
+			continue
+		}
+		exists[strings.ToLower(np)] = true
+
+		if this.renames == nil {
+			this.renames = make(map[string]string)
+		}
+		for k, v := range this.renames {
+			if v == f.path {
+				this.renames[k] = np
+			}
+		}
+		this.renames[f.path] = np
+		this.writeDebug("image '" + f.path + "' is transcoded to '" + np + "'.")
+		f.path, f.data = np, data
+		count++
+	}
+
+	if count > 0 {
+		this.updateReferences()
+	}
+}
+
+// imageSize returns the width and height of image 'data'
+func imageSize(data []byte) (int, int, bool) {
+	cfg, _, e := image.DecodeConfig(bytes.NewReader(data))
+	if e != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// imageFormat returns the format of image 'data' detected by its header, e.g.
+// 'jpeg', 'png', or an empty string if unknown
+func imageFormat(data []byte) string {
+	if _, format, e := image.DecodeConfig(bytes.NewReader(data)); e == nil {
+		return format
+	}
+	// formats without a registered decoder
+	if bytes.HasPrefix(data, []byte("BM")) {
+		return "bmp"
+	}
+	if len(data) >= 12 && string(data[4:12]) == "ftypavif" {
+		return "avif"
+	}
+	return ""
+}
+
+// isImageAllowed reports whether the format of image file 'f' is in option
+// 'allowed_image_formats', all images are allowed if the option is empty.
+// The header of every non-text file is checked, so an image cannot escape by
+// an unknown or wrong extension.
+func (this *EpubMaker) isImageAllowed(f *sourceFile) bool {
+	if len(this.image_formats) == 0 {
+		return true
+	}
+	format := ""
+	if !isTextFile(f.path) {
+		format = imageFormat(f.data)
+	}
+	if len(format) == 0 && !strings.HasPrefix(getMediaType(f.path), "image/") {
+		return true // not an image
+	}
+	if this.image_formats[format] {
+		return true
+	}
+	if len(format) == 0 {
+		format = "unknown"
+	}
+	this.writeWarning("format of image '" + f.path + "' is '" + format + "', which is not allowed, the image is skipped.")
+	return false
+}
+
+func isRasterImage(p string) bool {
+	switch getMediaType(p) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// inlineSmallImages replaces the references to raster images smaller than
+// 'inline_below' bytes in the 'src' attribute of 'img' elements with data
+// URIs, images which are no longer referenced are removed from the book.
+// Images in option 'include' are never inlined.
+func (this *EpubMaker) inlineSmallImages() {
+	small := make(map[string]*File)
+	for _, f := range this.book.Files() {
+		if this.book.IsIncluded(f.Path) || f.Path == this.book.CoverImage() {
+			continue
+		}
+		if isRasterImage(f.Path) && len(f.Data) < this.inline_below {
+			small[f.Path] = f
+		}
+	}
+	if len(small) == 0 {
+		return
+	}
+
+	for _, f := range this.book.ContentFiles() {
+		if !isHtmlFile(f.Path) {
+			continue
+		}
+		changed := false
+		data, e := processHtmlFile(f.Data, func(root *html.Node) {
+			for _, img := range findChildren(root, atom.Img) {
+				attr := findAttribute(img, "src")
+				if attr == nil {
+					continue
+				}
+				if sf, ok := small[resolveReference(f.Path, attr.Val)]; ok {
+					attr.Val = "data:" + getMediaType(sf.Path) + ";base64," + base64.StdEncoding.EncodeToString(sf.Data)
+					changed = true
+				}
+			}
+		})
+		if e != nil {
+			this.writeWarning("failed to inline images in '" + f.Path + "': " + e.Error())
+		} else if changed {
+			f.Data = data
+		}
+	}
+
+	// images may still be referenced by css files, links and so on
+	referenced := make(map[string]bool)
+	for _, f := range this.book.Files() {
+		for _, p := range findReferences(f) {
+			referenced[p] = true
+		}
+	}
+	for p := range small {
+		if !referenced[p] {
+			this.book.RemoveFile(p)
+			this.writeDebug("image '" + p + "' is inlined.")
+		}
+	}
+}
+
+// scaleImage scales 'src' to 'width' x 'height', every pixel of the result is
+// the average of the pixels in the corresponding area of 'src', so it is only
+// suitable for downscaling
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+const path_of_cover_thumbnail = "cover_thumbnail"
+
+// addCoverThumbnail adds a thumbnail of the cover image whose width is
+// 'thumbnail_width', it is referenced by meta 'makeepub:thumbnail' in the
+// EPUB2 form, so the prefix need not be declared
+func (this *EpubMaker) addCoverThumbnail() {
+	cover := this.book.FindFile(this.book.CoverImage())
+	if cover == nil {
+		this.writeWarning("thumbnail is not generated, because the book has no cover image.")
+		return
+	}
+	img, _, e := image.Decode(bytes.NewReader(cover.Data))
+	if e != nil {
+		this.writeWarning("thumbnail is not generated, failed to decode cover image: " + e.Error())
+		return
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if this.thumbnail_width >= w {
+		this.writeWarning("thumbnail is not generated, because the cover image is not wider than 'thumbnail_width'.")
+		return
+	}
+	height := h * this.thumbnail_width / w
+	if height < 1 {
+		height = 1
+	}
+	thumb := scaleImage(img, this.thumbnail_width, height)
+
+	buf, p := new(bytes.Buffer), path_of_cover_thumbnail+".png"
+	if thumb.Opaque() {
+		p = path_of_cover_thumbnail + ".jpg"
+		e = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		e = png.Encode(buf, thumb)
+	}
+	if e != nil {
+		this.writeWarning("failed to encode thumbnail: " + e.Error())
+		return
+	}
+	if this.book.FindFile(p) != nil {
+		this.writeWarning("thumbnail is not generated, because '" + p + "' already exists.")
+		return
+	}
+
+	this.book.AddFile(p, buf.Bytes())
+	this.book.Include(p)
+	this.book.AddLegacyMeta("makeepub:thumbnail", p)
+	this.writeDebug(fmt.Sprintf("cover thumbnail '%s' generated, %dx%d.", p, this.thumbnail_width, height))
+}
+
+// splitTallImages splits the image of every full screen page which is taller
+// than 'split_height' into tiles, and every tile becomes a full screen page
+func (this *EpubMaker) splitTallImages() {
+	for _, f := range this.book.ContentFiles() {
+		if (f.Attr & epub_FULL_SCREEN_PAGE) == 0 {
+			continue
+		}
+		root, e := html.Parse(bytes.NewReader(f.Data))
+		if e != nil {
+			continue
+		}
+		img := findFirstChild(root, atom.Img)
+		if img == nil {
+			continue
+		}
+		imgf := this.book.FindFile(resolveReference(f.Path, getAttributeValue(img, "src", "")))
+		if imgf == nil {
+			continue
+		}
+		if _, h, ok := imageSize(imgf.Data); !ok || h <= this.split_height {
+			continue
+		}
+		if paths := this.splitImage(imgf); len(paths) > 0 {
+			this.book.SplitFullScreenImage(f, paths, getAttributeValue(img, "alt", ""))
+			if !this.isImageReferenced(imgf.Path) {
+				this.book.RemoveFile(imgf.Path)
+			}
+			this.writeDebug(fmt.Sprintf("image '%s' is split into %d pages.", imgf.Path, len(paths)))
+		}
+	}
+}
+
+// isImageReferenced reports whether image 'p' is the cover, in option
+// 'include' or referenced by any file of the book
+func (this *EpubMaker) isImageReferenced(p string) bool {
+	if strings.EqualFold(this.book.CoverImage(), p) || this.book.IsIncluded(p) {
+		return true
+	}
+	for _, f := range this.book.Files() {
+		for _, r := range findReferences(f) {
+			if strings.EqualFold(r, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitImage splits image 'f' into tiles whose height is 'split_height' (the
+// last one may be shorter), adds them to the book and returns their paths
+func (this *EpubMaker) splitImage(f *File) []string {
+	img, format, e := image.Decode(bytes.NewReader(f.Data))
+	if e != nil {
+		this.writeWarning("failed to decode image '" + f.Path + "': " + e.Error())
+		return nil
+	}
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		this.writeWarning("image '" + f.Path + "' cannot be split.")
+		return nil
+	}
+
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	base := strings.TrimSuffix(f.Path, path.Ext(f.Path))
+	b := img.Bounds()
+
+	var paths []string
+	var tiles [][]byte
+	for y := b.Min.Y; y < b.Max.Y; y += this.split_height {
+		r := image.Rect(b.Min.X, y, b.Max.X, y+this.split_height).Intersect(b)
+		buf := new(bytes.Buffer)
+		if format == "jpeg" {
+			e = jpeg.Encode(buf, sub.SubImage(r), &jpeg.Options{Quality: 90})
+		} else {
+			e = png.Encode(buf, sub.SubImage(r))
+		}
+		if e != nil {
+			this.writeWarning("failed to encode tile of image '" + f.Path + "': " + e.Error())
+			return nil
+		}
+		p := fmt.Sprintf("%s_%02d%s", base, len(paths)+1, ext)
+		if this.book.FindFile(p) != nil {
+			this.writeWarning("image '" + f.Path + "' is not split, because '" + p + "' already exists.")
+			return nil
+		}
+		paths, tiles = append(paths, p), append(tiles, buf.Bytes())
+	}
+
+	for i, p := range paths {
+		this.book.AddFile(p, tiles[i])
+	}
+	return paths
+}
+
+func formatViewport(width, height int) string {
+	return fmt.Sprintf("width=%d, height=%d", width, height)
+}
+
+// pageViewport returns the viewport of content file 'f', which is the size
+// of its first image, or the default viewport if the size is unknown
+func (this *EpubMaker) pageViewport(f *File, root *html.Node) string {
+	if img := findFirstChild(root, atom.Img); img != nil {
+		p := resolveReference(f.Path, getAttributeValue(img, "src", ""))
+		if imgf := this.book.FindFile(p); imgf != nil {
+			if w, h, ok := imageSize(imgf.Data); ok {
+				return formatViewport(w, h)
+			}
+		}
+	}
+	return this.viewport
+}
+
+// addViewports adds the viewport meta to content files of fixed layout
+// books, an existing viewport is not changed
+func (this *EpubMaker) addViewports() {
+	for _, f := range this.book.ContentFiles() {
+		if !isHtmlFile(f.Path) {
+			continue
+		}
+		update := func(root *html.Node) {
+			head := findFirstChild(root, atom.Head)
+			if head == nil {
+				return
+			}
+			for _, m := range findDirectChildren(head, atom.Meta) {
+				if strings.EqualFold(getAttributeValue(m, "name", ""), "viewport") {
+					return
+				}
+			}
+			vp := this.pageViewport(f, root)
+			if len(vp) == 0 {
+				this.writeWarning("viewport of '" + f.Path + "' is unknown.")
+				return
+			}
+			head.AppendChild(&html.Node{
+				Type:     html.ElementNode,
+				DataAtom: atom.Meta,
+				Data:     "meta",
+				Attr: []html.Attribute{
+					{Key: "name", Val: "viewport"},
+					{Key: "content", Val: vp},
+				},
+			})
+		}
+		if d, e := processHtmlFile(f.Data, update); e != nil {
+			this.writeWarning("failed to add viewport to '" + f.Path + "'.")
+		} else {
+			f.Data = d
+		}
+	}
+}
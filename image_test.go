@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 1x1 images, the lossy WebP image is opaque, and the other one has alpha
+const (
+	testLossyWebp = "UklGRiIAAABXRUJQVlA4IBYAAAAwAQCdASoBAAEADsD+JaQAA3AAAAAA"
+	testPng       = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+	testAlphaWebp = "UklGRkoAAABXRUJQVlA4WAoAAAAQAAAAAAAAAAAAQUxQSAwAAAARBxAR/Q9ERP8DAABWUDggGAAAABQBAJ0BKgEAAQAAAP4AAA3AAP7mtQAAAA=="
+)
+
+func testImage(t *testing.T, s string) string {
+	t.Helper()
+	data, e := base64.StdEncoding.DecodeString(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return string(data)
+}
+
+// opaquePng returns a white PNG image of 'width' x 'height'
+func opaquePng(t *testing.T, width, height int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	buf := new(bytes.Buffer)
+	if e := png.Encode(buf, img); e != nil {
+		t.Fatal(e)
+	}
+	return buf.String()
+}
+
+func TestTranscodeModern(t *testing.T) {
+	files := map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[image]\ntranscode_modern=true\n",
+		"book.html": "<html><head></head><body><h1>One</h1>" +
+			"<p><img src=\"images/a.webp\"/><img src=\"images/b.webp\"/><img src=\"images/c.avif\"/></p></body></html>",
+		"images/a.webp": testImage(t, testLossyWebp),
+		"images/b.webp": testImage(t, testAlphaWebp),
+		"images/c.avif": "\x00\x00\x00\x1cftypavif",
+	}
+	maker := makeBook(t, files)
+	chapter := string(maker.book.ContentFiles()[0].Data)
+	for _, c := range []struct{ path, format string }{
+		{"images/a.jpg", "jpeg"},
+		{"images/b.png", "png"},
+	} {
+		f := maker.book.FindFile(c.path)
+		if f == nil {
+			t.Errorf("'%s' does not exist in the book", c.path)
+			continue
+		}
+		if _, format, e := image.DecodeConfig(bytes.NewReader(f.Data)); e != nil || format != c.format {
+			t.Errorf("'%s' is not a %s image: %v", c.path, c.format, e)
+		}
+		if !strings.Contains(chapter, "src=\""+c.path+"\"") {
+			t.Errorf("reference to '%s' is not updated:\n%s", c.path, chapter)
+		}
+	}
+	if maker.book.FindFile("images/a.webp") != nil || maker.book.FindFile("images/b.webp") != nil {
+		t.Errorf("WebP images are kept in the book")
+	}
+	if maker.book.FindFile("images/c.avif") == nil || !strings.Contains(chapter, "src=\"images/c.avif\"") {
+		t.Errorf("AVIF image is not passed through")
+	}
+
+	// without the option, images are passed through with the right media type
+	files["book.ini"] = "[book]\nname=Test\nauthor=Tester\n"
+	maker = makeBook(t, files)
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	for _, s := range []string{
+		`href="images/a.webp"[^>]* media-type="image/webp"`,
+		`href="images/c.avif"[^>]* media-type="image/avif"`,
+	} {
+		if !regexp.MustCompile(s).MatchString(opf) {
+			t.Errorf("'%s' is not in the manifest:\n%s", s, opf)
+		}
+	}
+}
+
+func TestIncludeNotInlined(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":           "[book]\nname=Test\nauthor=Tester\n[build]\ninclude=images/a.png,fonts/fallback.ttf\n[image]\ninline_below_bytes=1000\n",
+		"book.html":          "<html><head></head><body><h1>One</h1><p><img src=\"images/a.png\"/><img src=\"images/b.png\"/></p></body></html>",
+		"images/a.png":       testImage(t, testPng),
+		"images/b.png":       testImage(t, testPng),
+		"fonts/fallback.ttf": "ttf",
+	})
+	chapter := string(maker.book.ContentFiles()[0].Data)
+	if maker.book.FindFile("images/a.png") == nil || !strings.Contains(chapter, "src=\"images/a.png\"") {
+		t.Errorf("included image is inlined:\n%s", chapter)
+	}
+	if maker.book.FindFile("images/b.png") != nil || !strings.Contains(chapter, "src=\"data:image/png;base64,") {
+		t.Errorf("small image is not inlined:\n%s", chapter)
+	}
+	if maker.book.FindFile("fonts/fallback.ttf") == nil {
+		t.Errorf("included file is not in the book")
+	}
+	if hasWarning(maker, "'fonts/fallback.ttf' is not referenced") {
+		t.Errorf("unreferenced included file is reported")
+	}
+}
+
+func TestInlineSmallImages(t *testing.T) {
+	png := testImage(t, testPng)
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[image]\ninline_below_bytes=" + strconv.Itoa(len(png)+1) + "\n",
+		"book.html": "<html><head></head><body><h1>One</h1>" +
+			"<p><img src=\"images/a.png\"/><img src=\"images/b.png\"/><img src=\"images/c.svg\"/></p></body></html>",
+		"images/a.png": png,
+		"images/b.png": png + "\x00",
+		"images/c.svg": "<svg/>",
+	})
+	chapter := string(maker.book.ContentFiles()[0].Data)
+	want := "src=\"data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(png)) + "\""
+	if !strings.Contains(chapter, want) {
+		t.Errorf("the small image is not inlined:\n%s", chapter)
+	}
+	if maker.book.FindFile("images/a.png") != nil {
+		t.Errorf("the inlined image is still in the book")
+	}
+	// images at the threshold & vector images are not inlined
+	for _, p := range []string{"images/b.png", "images/c.svg"} {
+		if maker.book.FindFile(p) == nil || !strings.Contains(chapter, "src=\""+p+"\"") {
+			t.Errorf("'%s' is inlined:\n%s", p, chapter)
+		}
+	}
+}
+
+func TestFixedLayoutViewport(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\nlayout=fixed\nviewport=600x800\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p><img src=\"images/a.png\"/></p>" +
+			"<h1>Two</h1><p>2</p></body></html>",
+		"images/a.png": testImage(t, testPng),
+	})
+	files := maker.book.ContentFiles()
+	if len(files) != 2 {
+		t.Fatalf("got %d content files, want 2", len(files))
+	}
+	for i, vp := range []string{"width=1, height=1", "width=600, height=800"} {
+		if s := string(files[i].Data); strings.Count(s, "<meta name=\"viewport\" content=\""+vp+"\"/>") != 1 {
+			t.Errorf("viewport of '%s' is not '%s':\n%s", files[i].Path, vp, s)
+		}
+	}
+}
+
+func TestTranscodeCache(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"book.ini":      "[book]\nname=Test\nauthor=Tester\n[build]\ncache_dir=.cache\n[image]\ntranscode_modern=true\n",
+		"book.html":     "<html><head></head><body><h1>One</h1><p><img src=\"images/a.webp\"/></p></body></html>",
+		"images/a.webp": testImage(t, testLossyWebp),
+	}
+	for p, s := range files {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if e := os.MkdirAll(filepath.Dir(p), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := ioutil.WriteFile(p, []byte(s), 0666); e != nil {
+			t.Fatal(e)
+		}
+	}
+	build := func() *EpubMaker {
+		maker := NewEpubMaker(testLogger)
+		if e := maker.Process(OpenSystemFolder(dir), false); e != nil {
+			t.Fatal(e)
+		}
+		return maker
+	}
+
+	build()
+	cached, _ := filepath.Glob(filepath.Join(dir, ".cache", "*.jpg"))
+	if len(cached) != 1 {
+		t.Fatalf("got %d cached images, want 1", len(cached))
+	}
+
+	// a cache hit returns the cached data instead of encoding the image again
+	if e := ioutil.WriteFile(cached[0], []byte("cached"), 0666); e != nil {
+		t.Fatal(e)
+	}
+	maker := build()
+	if f := maker.book.FindFile("images/a.jpg"); f == nil || string(f.Data) != "cached" {
+		t.Errorf("the cached image is not used")
+	}
+	for _, f := range maker.book.Files() {
+		if strings.HasPrefix(f.Path, ".cache/") {
+			t.Errorf("cached file '%s' is added to the book", f.Path)
+		}
+	}
+}
+
+func TestTranscodeCacheOutsideBook(t *testing.T) {
+	for _, dir := range []string{"../cache", "/tmp/cache", "."} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\ncache_dir=" + dir + "\n",
+			"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		})
+		if !hasWarning(maker, "option 'cache_dir' is invalid") || len(maker.cache_dir) > 0 {
+			t.Errorf("cache folder '%s' is accepted", dir)
+		}
+	}
+
+	// the cache is not used if the book is not in an OS folder
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\ncache_dir=.cache\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	if dir := maker.cacheFolder(); len(dir) > 0 {
+		t.Errorf("cache folder is '%s' for a book in memory, want empty", dir)
+	}
+}
+
+func TestAllowedImageFormats(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\nallowed_image_formats=png\n",
+		"book.html": "<html><head></head><body><h1>One</h1>" +
+			"<p><img src=\"images/a.png\"/><img src=\"images/b.png\"/><img src=\"images/c.bmp\"/></p></body></html>",
+		"images/a.png": testImage(t, testPng),
+		"images/b.png": "BM\x36\x00\x00\x00",
+		"images/c.bmp": "BM\x36\x00\x00\x00",
+		"images/d.dat": "BM\x36\x00\x00\x00",
+		"data/e.dat":   "data",
+	})
+	if maker.book.FindFile("images/a.png") == nil {
+		t.Errorf("allowed image 'images/a.png' is skipped")
+	}
+	if maker.book.FindFile("data/e.dat") == nil {
+		t.Errorf("non-image file 'data/e.dat' is skipped")
+	}
+	// the format is detected by the header, not the extension
+	for _, p := range []string{"images/b.png", "images/c.bmp", "images/d.dat"} {
+		if maker.book.FindFile(p) != nil {
+			t.Errorf("BMP image '%s' is not skipped", p)
+		}
+		if !hasWarning(maker, "format of image '"+p+"' is 'bmp'") {
+			t.Errorf("no warning for BMP image '%s'", p)
+		}
+	}
+}
+
+func TestCoverThumbnail(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[cover]\nthumbnail_width=10\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.png": opaquePng(t, 40, 20),
+	})
+
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	// the thumbnail of an opaque cover is a JPEG image
+	cfg, format, e := image.DecodeConfig(strings.NewReader(readEntry(t, zr, "cover_thumbnail.jpg")))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if format != "jpeg" || cfg.Width != 10 || cfg.Height != 5 {
+		t.Errorf("the thumbnail is a %dx%d %s image, want a 10x5 jpeg image", cfg.Width, cfg.Height, format)
+	}
+
+	opf := readEntry(t, zr, "content.opf")
+	if !strings.Contains(opf, "href=\"cover_thumbnail.jpg\"") {
+		t.Errorf("the thumbnail is not in the manifest:\n%s", opf)
+	}
+	if !strings.Contains(opf, "<meta name=\"makeepub:thumbnail\" content=\"cover_thumbnail.jpg\"/>") {
+		t.Errorf("the thumbnail is not referenced by meta 'makeepub:thumbnail':\n%s", opf)
+	}
+}
+
+func TestSplitTallImages(t *testing.T) {
+	// full screen pages are only generated for duokan
+	maker := NewEpubMaker(testLogger)
+	e := maker.Process(NewMemoryFolder(map[string][]byte{
+		"book.ini":     []byte("[book]\nname=Test\nauthor=Tester\nlayout=fixed\n[image]\nsplit_height=10\n"),
+		"book.html":    []byte("<html><head></head><body><h1>One</h1><img class=\"" + duokan_fullscreen + "\" src=\"images/a.png\"/></body></html>"),
+		"images/a.png": []byte(opaquePng(t, 4, 25)),
+	}), true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if maker.book.FindFile("images/a.png") != nil {
+		t.Errorf("the tall image is still in the book")
+	}
+	var pages []*File
+	for _, f := range maker.book.ContentFiles() {
+		if (f.Attr & epub_FULL_SCREEN_PAGE) != 0 {
+			pages = append(pages, f)
+		}
+	}
+	if len(pages) != 3 {
+		t.Fatalf("got %d full screen pages, want 3", len(pages))
+	}
+	for i, height := range []int{10, 10, 5} {
+		p := fmt.Sprintf("images/a_%02d.png", i+1)
+		tile := maker.book.FindFile(p)
+		if tile == nil {
+			t.Errorf("tile '%s' does not exist", p)
+			continue
+		}
+		if w, h, ok := imageSize(tile.Data); !ok || w != 4 || h != height {
+			t.Errorf("tile '%s' is %dx%d, want 4x%d", p, w, h, height)
+		}
+		s := string(pages[i].Data)
+		if !strings.Contains(s, "src=\""+p+"\"") {
+			t.Errorf("page %d does not contain tile '%s':\n%s", i+1, p, s)
+		}
+		if vp := fmt.Sprintf("content=\"width=4, height=%d\"", height); !strings.Contains(s, vp) {
+			t.Errorf("viewport of page %d is not '%s':\n%s", i+1, vp, s)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+func RunList() {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 {
+		onCommandLineError()
+	}
+
+	folder, e := OpenZipFolder(inpath)
+	if e != nil {
+		logger.Fatalf("failed to open '%s'.\n", inpath)
+	}
+
+	names, e := folder.ReadDirNames()
+	if e != nil {
+		logger.Fatalln("failed to get file list.")
+	}
+	sort.Strings(names)
+
+	fmt.Println("Files:")
+	total := int64(0)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		rc, e := folder.OpenFile(name)
+		if e != nil {
+			logger.Fatalf("failed to open '%s'.\n", name)
+		}
+		size, e := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if e != nil {
+			logger.Fatalf("error reading '%s'.\n", name)
+		}
+		total += size
+		fmt.Printf("  %10d  %s\n", size, name)
+	}
+	fmt.Printf("  %10d  total\n\n", total)
+
+	reader, e := NewEpubReader(folder)
+	if e != nil {
+		logger.Fatalln("failed to parse package information:", e.Error())
+	}
+	fmt.Println("Title   :", reader.Title())
+	fmt.Println("Author  :", reader.Author())
+	fmt.Println("Chapters:", len(reader.Toc()))
+}
+
+func init() {
+	AddCommandHandler("l", RunList)
+}
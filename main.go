@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -11,25 +12,61 @@ import (
 const version = "1.1.0"
 
 func showUsage() {
-	usage := `Create/Batch Create/Pack/Extract EPUB file(s). Merge HTML/Text files.
+	usage := `Create/Batch Create/Pack/Extract/List/Unpack EPUB file(s). Merge HTML/Text files.
 It can also work as a web server to convert an uploaded zip file to an EPUB.
 Please refer to manual for detailed usage.
 
 COMMAND LINE
   Create       : makeepub <VirtualFolder> [OutputFolder] [-epub2] [-noduokan]
+                 [-config=<ConfigFile>] [-v|-vv] [-quiet] [-opds]
+                 [-strict] [-unpacked] [-require-utf8] [-report=<ReportFile>]
   Batch Create : makeepub -b <InputFolder> [OutputFolder] [-epub2] [-noduokan]
+                 [-config=<ConfigFile>] [-jobs=<N>] [-v|-vv] [-opds]
+                 [-strict] [-unpacked] [-require-utf8]
                  makeepub -b <BatchFile> [OutputFolder] [-epub2] [-noduokan]
+                 [-config=<ConfigFile>] [-jobs=<N>] [-v|-vv] [-opds]
+                 [-strict] [-unpacked] [-require-utf8]
+  Omnibus      : makeepub -omnibus <OutputFile> <VirtualFolder>...
+                 [-name=<BookName>] [-epub2] [-noduokan]
+                 [-config=<ConfigFile>] [-v|-vv] [-strict] [-require-utf8]
+  Doctor       : makeepub -doctor <VirtualFolder> [-config=<ConfigFile>]
+                 [-v|-vv]
   Pack         : makeepub -p <VirtualFolder> <OutputFile>
   Extract      : makeepub -e <EpubFile> <OutputFolder>
+  List         : makeepub -l <EpubFile>
+  Unpack       : makeepub -u <EpubFile> <OutputFolder>
+  Validate     : makeepub -validate <EpubFile>
   Merge HTML   : makeepub -mh <VirtualFolder> <OutputFile>
   Merge Text   : makeepub -mt <VirtualFolder> <OutputFile>
   Web Server   : makeepub -s [Port]
 
 ARGUMENT
-  VirtualFolder: An OS folder or a zip file which contains the input files.
+  VirtualFolder: An OS folder or a zip file which contains the input files,
+                 or an http(s) url of a folder which has a 'manifest.json',
+                 or 'git:<RepoPath>[#<Ref>]' for a commit in a git repository,
+                 or an existing epub book to rebuild.
+  BookName     : The name of the omnibus, default is the series name or the
+                 name of the first book.
   OutputFolder : An OS folder to store the output file(s).
   -epub2       : Generate books using EPUB2 format, otherwise EPUB3.
   -noduokan    : Disable DuoKan externsion.
+  -v           : Print informational messages besides warnings and errors.
+  -vv          : Print debug messages also.
+  -quiet       : Do not show the progress bar.
+  -opds        : Create an OPDS entry next to the output file.
+  -strict      : Regard warnings as errors, the book is not created if there
+                 are any warnings.
+  -unpacked    : Write the files of the book to a folder instead of an EPUB.
+  -require-utf8: Fail if any text file is not valid UTF-8.
+  ReportFile   : An OS file to save the JSON summary of the build, including
+                 the metadata, statistics, warnings and validation errors.
+  ConfigFile   : An OS file which has the same format as 'book.ini', its
+                 values override the ones in 'book.ini' of 'VirtualFolder'.
+  -global-config=<File>: A file which has the same format as 'book.ini', its
+                 values are the defaults of all books. It can also be set by
+                 environment variable 'MAKEEPUB_CONFIG', and '.makeepub.ini' in
+                 the home folder is used if neither is set.
+  N            : Max number of books to build concurrently, default is 1.
   InputFolder  : An OS folder which contains the input folder(s)/file(s).
   BatchFile    : A text which lists the path of 'VirtualFolders' to be
                  processed, one line for one 'VirtualFolder'
@@ -71,6 +108,16 @@ func getFlag(index int) string {
 	return ""
 }
 
+func getFlagValue(flag string, dflt string) string {
+	flag = strings.ToLower(flag) + "="
+	for _, arg := range os.Args[1:] {
+		if isFlag(arg) && strings.HasPrefix(strings.ToLower(arg[1:]), flag) {
+			return arg[1+len(flag):]
+		}
+	}
+	return dflt
+}
+
 func isFlag(arg string) bool {
 	if os.PathSeparator == '/' {
 		return arg[0] == '-'
@@ -88,6 +135,43 @@ func getFlagBool(flag string) bool {
 	return false
 }
 
+const (
+	log_WARNING = iota // warnings and errors only
+	log_INFO
+	log_DEBUG
+)
+
+// getLogLevel returns the log level specified by '-v' or '-vv'
+func getLogLevel() int {
+	if getFlagBool("vv") {
+		return log_DEBUG
+	} else if getFlagBool("v") {
+		return log_INFO
+	}
+	return log_WARNING
+}
+
+const path_of_global_config = ".makeepub.ini"
+
+// getGlobalConfigPath returns the path of the global configuration file, it
+// is specified by '-global-config', or environment variable 'MAKEEPUB_CONFIG',
+// or '.makeepub.ini' in the home folder if exists
+func getGlobalConfigPath() string {
+	if p := getFlagValue("global-config", ""); len(p) > 0 {
+		return p
+	}
+	if p := os.Getenv("MAKEEPUB_CONFIG"); len(p) > 0 {
+		return p
+	}
+	if home, e := os.UserHomeDir(); e == nil {
+		p := filepath.Join(home, path_of_global_config)
+		if fi, e := os.Stat(p); e == nil && !fi.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
 type CommandHandler struct {
 	command string
 	handler func()
@@ -96,6 +180,7 @@ type CommandHandler struct {
 var (
 	logger   = log.New(os.Stderr, "makeepub: ", 0)
 	handlers = make([]CommandHandler, 0, 8)
+	exitCode = 0 // set by command handlers on failure
 )
 
 func AddCommandHandler(cmd string, handler func()) {
@@ -134,5 +219,5 @@ func main() {
 	handler()
 	logger.Println("done, time used:", time.Now().Sub(start).String())
 
-	os.Exit(0)
+	os.Exit(exitCode)
 }
@@ -2,13 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
@@ -22,35 +30,386 @@ const (
 	makeepub_chapter_id  = "makeepub-chapter-%d"
 	makeepub_chapter     = "makeepub-chapter"
 	makeepub_not_chapter = "makeepub-not-chapter"
+	makeepub_page_break  = "makeepub-page-break"
 	data_chapter_level   = "data-chapter-level"
 	data_chapter_title   = "data-chapter-title"
+	path_of_base_style   = "makeepub_base.css"
+	makeepub_progress_id = "makeepub-progress-%d"
+	makeepub_part_id     = "makeepub-part-%d"
 )
 
 type EpubMaker struct {
-	folder      VirtualFolder
-	book        *Epub
-	logger      *log.Logger
-	output_path string
-	chapter_id  int
-	toc         int
-	split       int
-	by_header   int
-	body        *html.Node // 'body' element of the original html
-	skip        bool       // skip next header (<h1>,<h2>...)?
-	blank       bool       // current chapter is blank?
+	folder           VirtualFolder
+	book             *Epub
+	logger           *log.Logger
+	output_path      string
+	config_path      string // path of the external configuration file
+	chapter_id       int
+	toc              int
+	split            int
+	by_header        int
+	body             *html.Node // 'body' element of the original html
+	skip             bool       // skip next header (<h1>,<h2>...)?
+	blank            bool       // current chapter is blank?
+	minify           bool       // minify html files?
+	saved            int        // bytes saved by minify
+	files            []*sourceFile
+	renames          map[string]string // original path => final path
+	strip_prefix     bool              // strip order prefix from file names?
+	split_levels     []bool            // levels to split at, nil for 1 to 'split'
+	titles           map[string]bool   // used chapter titles, nil if no need to check
+	stylesheet       string            // path of the style sheet for all chapters
+	charset          bool              // normalize charset declarations?
+	body_type        bool              // set 'epub:type' on the 'body' of chapters?
+	header           string            // html inserted at the beginning of each chapter
+	footer           string            // html inserted at the end of each chapter
+	sample           int               // max number of top-level chapters, 0 for no limit
+	sample_text      string            // text of the 'end of sample' page
+	sample_count     int               // number of top-level chapters saved
+	chapter_count    int               // number of chapter files saved
+	truncated        bool              // some chapters are dropped because of 'sample'
+	defaults         *Config           // configuration shared by a set of books
+	series_index     int               // position of the book in its series, from the batch
+	log_level        int               // level of messages to print
+	cover_image      string            // path of the cover image specified by option
+	transcode        bool              // transcode WebP images to PNG/JPEG?
+	post_command     string            // command to run after the book is saved
+	kindle           bool              // generate kindle friendly books?
+	root_cover       bool              // copy the cover image to the root folder?
+	progress         bool              // show the progress bar?
+	css_vars         map[string]string // values of the css variables
+	notes            string            // path of the notes file, which is added to the end of the spine
+	colophon         string            // text of the colophon page
+	includes         []string          // files which must be in the book even if not referenced
+	viewport         string            // default viewport of fixed layout pages
+	page_break       bool              // start every chapter on a new page?
+	count            bool              // count the words of the book?
+	opds             bool              // create the OPDS entry?
+	warnings         int               // number of warnings
+	strict           bool              // regard warnings as errors?
+	rights_file      string            // file to be stored in 'META-INF'
+	back_cover       string            // path of the back cover image
+	skip_empty       bool              // drop chapters which only contain headers?
+	dropped          []int             // levels of dropped TOC items which are ancestors of next chapters
+	title_page       string            // xhtml content of the title page
+	auto_title       bool              // generate the title page from book name and author?
+	preserve_mtime   bool              // keep the modification time of source files in the archive?
+	cache_dir        string            // folder in the book folder to cache processed images
+	content_files    []string          // files concatenated as 'book.html'
+	unpacked         bool              // write the files of the book to a folder instead of an epub file?
+	search_index     bool              // generate a JSON index of the terms in content files?
+	stopwords        string            // comma separated words excluded from the search index
+	newline          string            // line break of text files, empty to keep as is
+	image_formats    map[string]bool   // allowed image formats, nil for all
+	ctx              context.Context   // cancels the build, checked between files
+	inline_below     int               // size limit in bytes of images to inline
+	messages         []string          // all warnings
+	validation       []string          // warnings from validation
+	output           string            // path of the output file
+	front_type       string            // epub:type of the next chapter file from front matter
+	front_linear     string            // linear attribute of the next chapter file from front matter
+	thumbnail_width  int               // width of the cover thumbnail, 0 to disable
+	require_utf8     bool              // fail if a text file is not valid UTF-8?
+	base_style       string            // generated style rules of 'body', lowest priority
+	split_height     int               // max height of full screen images, taller ones are split
+	number_chapters  bool              // prefix TOC titles with hierarchical numbers?
+	slug_ids         map[string]bool   // ids used in the book if anchor ids are generated from titles, nil otherwise
+	progress_anchors int               // number of paragraphs between progress anchors, 0 to disable
+	progress_id      int               // id of the next progress anchor
+	typography       bool              // convert straight quotes to curly quotes & '--' to em dashes?
+	global_path      string            // path of the global configuration file
+	sign_key         string            // path of the key to sign the output file, not signed if empty
+	container_file   string            // file to be used as 'META-INF/container.xml'
+	spine            []string          // reading order directives, literal files or 'split:<file>'
+	checked          map[string]bool   // files whose headings are checked
+	track_mtime      bool              // record the sources & modification time of chapters?
+	source           string            // source file of the content being split
+	chapter_mtimes   []chapterMtime    // records of 'chapter_mtimes.json'
+	// first element of the content of each source file => path of the file
+	sources map[*html.Node]string
 }
 
 func NewEpubMaker(logger *log.Logger) *EpubMaker {
 	return &EpubMaker{logger: logger}
 }
 
-func (this *EpubMaker) parseBook() (*html.Node, error) {
-	f, e := this.folder.OpenFile("book.html")
+// SetOpds sets whether to create the OPDS entry, it can also be enabled by
+// option 'opds'
+func (this *EpubMaker) SetOpds(opds bool) {
+	this.opds = opds
+}
+
+// SetRequireUtf8 sets whether the build fails if any text file is not valid
+// UTF-8
+func (this *EpubMaker) SetRequireUtf8(require bool) {
+	this.require_utf8 = require
+}
+
+// checkUtf8 returns an error if 'data' of text file 'path' is not valid UTF-8
+// and UTF-8 is required
+func (this *EpubMaker) checkUtf8(path string, data []byte) error {
+	if this.require_utf8 && !utf8.Valid(data) {
+		return fmt.Errorf("'%s' is not valid UTF-8.", path)
+	}
+	return nil
+}
+
+// SetUnpacked sets whether to write the book as a folder instead of an epub
+// file, it can also be enabled by option '/output/unpacked'
+func (this *EpubMaker) SetUnpacked(unpacked bool) {
+	this.unpacked = unpacked
+}
+
+func (this *EpubMaker) SetConfigFile(path string) {
+	this.config_path = path
+}
+
+// SetGlobalConfigFile sets the global configuration file, its values are the
+// defaults of all books, which are overridden by any other configuration
+func (this *EpubMaker) SetGlobalConfigFile(path string) {
+	this.global_path = path
+}
+
+// SetDefaultConfig sets the configuration shared by a set of books, values
+// in 'book.ini' override the ones in 'cfg'
+func (this *EpubMaker) SetDefaultConfig(cfg *Config) {
+	this.defaults = cfg
+}
+
+// SetSeriesIndex sets the position of the book in its series, it is used
+// when option 'series_index' is not specified
+func (this *EpubMaker) SetSeriesIndex(index int) {
+	this.series_index = index
+}
+
+var reHeading = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>.*?</h([1-6])\s*>`)
+
+// checkHeadings warns about headings of 'data' whose end tag has a different
+// level, like '<h1>...</h2>', the parser regards the heading as the level of
+// the start tag, so the split is likely different from what the author wants
+func (this *EpubMaker) checkHeadings(path string, data []byte) {
+	// a file may be parsed more than once, e.g. by 'diagnose'
+	if this.checked == nil {
+		this.checked = make(map[string]bool)
+	}
+	if this.checked[path] {
+		return
+	}
+	this.checked[path] = true
+
+	for _, m := range reHeading.FindAllSubmatchIndex(data, -1) {
+		open, end := data[m[2]], data[m[4]]
+		if open == end {
+			continue
+		}
+		line := bytes.Count(data[:m[0]], []byte("\n")) + 1
+		this.writeWarning(fmt.Sprintf("'%s' line %d: <h%c> is closed by </h%c>, it is regarded as <h%c>, please check whether it is a typo.",
+			path, line, open, end, open))
+	}
+}
+
+func (this *EpubMaker) parseHtmlFile(path string) (*html.Node, error) {
+	f, e := this.folder.OpenFile(path)
 	if e != nil {
 		return nil, e
 	}
 	defer f.Close()
-	root, e := html.Parse(f)
+	data, e := ioutil.ReadAll(f)
+	if e != nil {
+		return nil, e
+	}
+	if e = this.checkUtf8(path, data); e != nil {
+		return nil, e
+	}
+	this.checkHeadings(path, data)
+	return html.Parse(bytes.NewReader(removeUtf8Bom(data)))
+}
+
+// parseContentFiles parses the files in 'content_files' and concatenates
+// them, the 'head' of the first file is used, and the style sheets in the
+// 'head' of other files are merged into it, the content of the 'body' of other
+// files are appended to the 'body' of the first file. References, including
+// the ones in 'style' elements, are rewritten to be relative to 'book.html'.
+func (this *EpubMaker) parseContentFiles() (*html.Node, error) {
+	docs := make([]*html.Node, len(this.content_files))
+	for i, p := range this.content_files {
+		data, e := readAll(this.folder, p)
+		if e != nil {
+			return nil, fmt.Errorf("failed to read content file '%s': %s", p, e.Error())
+		}
+		if e = this.checkUtf8(p, data); e != nil {
+			return nil, e
+		}
+		this.checkHeadings(p, data)
+		fm, data := splitFrontMatter(removeUtf8Bom(data))
+		doc, e := html.Parse(bytes.NewReader(data))
+		if e != nil {
+			return nil, fmt.Errorf("failed to parse content file '%s': %s", p, e.Error())
+		}
+		b := findFirstChild(doc, atom.Body)
+		if b == nil {
+			return nil, fmt.Errorf("content file '%s' has no 'body' element.", p)
+		}
+		if fm != nil {
+			b.InsertBefore(this.frontMatterTag(p, fm), b.FirstChild)
+		}
+		docs[i] = doc
+	}
+
+	var root, body *html.Node
+	for i, doc := range docs {
+		p := this.content_files[i]
+		// links to the content files become links to fragments, and other
+		// references are relative to 'book.html' after concatenation
+		this.rewritePartLinks(doc, p, docs)
+		rewriteReferences(doc, p, "book.html", nil)
+		rewriteStyleReferences(doc, p, "book.html")
+		b := findFirstChild(doc, atom.Body)
+		this.markSource(b, p)
+		this.writeDebug("content file '" + p + "' loaded.")
+		if root == nil {
+			root, body = doc, b
+			continue
+		}
+		if h := findFirstChild(doc, atom.Head); h != nil {
+			this.mergeStyleSheets(findFirstChild(root, atom.Head), h)
+		}
+		for n := b.FirstChild; n != nil; n = b.FirstChild {
+			b.RemoveChild(n)
+			body.AppendChild(n)
+		}
+	}
+	return root, nil
+}
+
+// rewritePartLinks rewrites the links in 'doc', which is content file 'from',
+// to content files (parsed as 'docs') to links to fragments. A link to a
+// whole content file points to the first element of its 'body' instead.
+func (this *EpubMaker) rewritePartLinks(doc *html.Node, from string, docs []*html.Node) {
+	for _, a := range findChildren(doc, atom.A) {
+		attr := findAttribute(a, "href")
+		if attr == nil {
+			continue
+		}
+		target := resolveReference(from, attr.Val)
+		if len(target) == 0 {
+			continue
+		}
+		target = cleanBookPath(target)
+		for i, p := range this.content_files {
+			if !strings.EqualFold(target, p) {
+				continue
+			}
+			fragment := ""
+			if j := strings.IndexByte(attr.Val, '#'); j != -1 {
+				fragment = attr.Val[j+1:]
+			}
+			if len(fragment) == 0 {
+				fragment = partAnchor(docs[i], i)
+			}
+			if len(fragment) > 0 {
+				attr.Val = "#" + fragment
+			}
+			break
+		}
+	}
+}
+
+// partAnchor returns the id of the first element in the 'body' of 'doc', the
+// i-th content file, it is generated if the element has no id
+func partAnchor(doc *html.Node, i int) string {
+	body := findFirstChild(doc, atom.Body)
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		id := getAttributeValue(n, "id", "")
+		if len(id) == 0 {
+			id = fmt.Sprintf(makeepub_part_id, i)
+			setAttribute(n, "id", id)
+		}
+		return id
+	}
+	return ""
+}
+
+// mergeStyleSheets adds the style sheets linked or embedded by 'other', which
+// is the 'head' of a content file other than the first one, to 'head', so the
+// chapters from every content file are styled, and a style sheet shared by
+// several content files is only linked once
+func (this *EpubMaker) mergeStyleSheets(head, other *html.Node) {
+	for _, link := range findDirectChildren(other, atom.Link) {
+		rel := strings.Fields(strings.ToLower(getAttributeValue(link, "rel", "")))
+		if len(rel) == 0 || rel[0] != "stylesheet" {
+			continue
+		}
+		if p := resolveReference("book.html", getAttributeValue(link, "href", "")); len(p) > 0 {
+			this.addStyleSheet(head, cleanBookPath(p))
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, style := range findDirectChildren(head, atom.Style) {
+		existing[nodeText(style)] = true
+	}
+	for _, style := range findDirectChildren(other, atom.Style) {
+		if text := nodeText(style); !existing[text] {
+			existing[text] = true
+			other.RemoveChild(style)
+			head.AppendChild(style)
+		}
+	}
+}
+
+// detectContentFiles finds the main content if there's no 'book.html': if
+// there's only one html file in the root folder (the cover page and notes
+// are excluded), it is used as 'book.html', if there are several, they are
+// concatenated in name order as option 'content_files'
+func (this *EpubMaker) detectContentFiles() {
+	if rc, e := this.folder.OpenFile("book.html"); e == nil {
+		rc.Close()
+		return
+	}
+
+	names, e := this.folder.ReadDirNames()
+	if e != nil {
+		return
+	}
+	var found []string
+	for _, name := range names {
+		name = filepath.ToSlash(name)
+		if strings.Contains(name, "/") || !isHtmlFile(name) {
+			continue
+		}
+		if strings.EqualFold(name, this.book.CoverPage()) || strings.EqualFold(name, this.notes) {
+			continue
+		}
+		found = append(found, name)
+	}
+	if len(found) == 0 {
+		return
+	}
+
+	sort.Strings(found)
+	if this.strip_prefix {
+		sortByOrderPrefix(found)
+	}
+	this.content_files = found
+	if len(found) == 1 {
+		this.writeInfo("'book.html' does not exist, '" + found[0] + "' is used as the main content.")
+	} else {
+		this.writeInfo("'book.html' does not exist, " + strings.Join(found, ", ") + " are concatenated as the main content.")
+	}
+}
+
+func (this *EpubMaker) parseBook() (*html.Node, error) {
+	var root *html.Node
+	var e error
+	if len(this.content_files) > 0 {
+		root, e = this.parseContentFiles()
+	} else {
+		root, e = this.parseHtmlFile("book.html")
+	}
 	if e != nil {
 		return root, e
 	}
@@ -99,13 +458,51 @@ func (this *EpubMaker) parseBook() (*html.Node, error) {
 		return root, e
 	}
 
+	if len(this.content_files) == 0 {
+		this.markSource(body, "book.html")
+	}
 	return root, nil
 }
 
-func (this *EpubMaker) addFilesToBook() error {
+type sourceFile struct {
+	path     string // path in the book
+	data     []byte
+	mtime    time.Time // zero if unknown or not preserved
+	modified time.Time // modification time of the source file, zero if unknown
+}
+
+var reOrderPrefix = regexp.MustCompile(`^(\d+)[-_](.+)$`)
+
+func (this *EpubMaker) loadFiles() error {
+	if zf, ok := this.folder.(*ZipFolder); ok {
+		for _, name := range zf.Duplicates() {
+			this.writeWarning("duplicate entry '" + name + "' in zip file, the last one is used.")
+		}
+	}
+	if ef, ok := this.folder.(*EpubFolder); ok {
+		for _, msg := range ef.Lossy() {
+			this.writeWarning("lossy rebuild: " + msg)
+		}
+	}
+
+	cover := strings.ToLower(this.book.CoverPage())
 	walk := func(path string) error {
-		p := strings.ToLower(path)
-		if p == "book.ini" || p == "book.html" {
+		if e := this.ctx.Err(); e != nil {
+			return e
+		}
+		p := strings.ToLower(filepath.ToSlash(path))
+		if p == "book.ini" || p == "book.html" || p == cover {
+			return nil
+		}
+		for _, cf := range this.content_files {
+			if strings.EqualFold(p, cf) {
+				return nil
+			}
+		}
+		if this.isSplitTarget(p) {
+			return nil
+		}
+		if len(this.cache_dir) > 0 && strings.HasPrefix(p, strings.ToLower(this.cache_dir)+"/") {
 			return nil
 		}
 
@@ -119,14 +516,372 @@ func (this *EpubMaker) addFilesToBook() error {
 			return e
 		}
 
-		if p == "cover.png" || p == "cover.jpg" || p == "cover.gif" {
-			this.book.SetCoverImage(p)
+		// the BOM may break the xml declaration or appear as a stray character
+		if isTextFile(path) {
+			data = removeUtf8Bom(data)
+			if len(this.newline) > 0 {
+				data = normalizeNewlines(data, this.newline)
+			}
 		}
-		this.book.AddFile(path, data)
+		f := &sourceFile{path: filepath.ToSlash(path), data: data}
+		if mtf, ok := this.folder.(ModTimeFolder); ok {
+			f.modified, _ = mtf.ModTime(path)
+			if this.preserve_mtime {
+				f.mtime = f.modified
+			}
+		}
+		this.files = append(this.files, f)
 		return nil
 	}
 
-	return this.folder.Walk(walk)
+	if e := this.folder.Walk(walk); e != nil {
+		return e
+	}
+
+	if this.strip_prefix {
+		this.stripOrderPrefix()
+	}
+
+	if this.transcode {
+		this.transcodeImages()
+	}
+
+	if len(this.css_vars) > 0 {
+		for _, f := range this.files {
+			if isCssFile(f.path) {
+				f.data = this.substituteCssVars(f)
+			}
+		}
+	}
+
+	for _, f := range this.files {
+		if this.minify && isHtmlFile(f.path) {
+			if d, e := minifyHtmlFile(f.data); e != nil {
+				this.writeWarning("failed to minify '" + f.path + "', original content is used.")
+			} else {
+				this.saved += len(f.data) - len(d)
+				f.data = d
+			}
+		}
+	}
+
+	invalid := 0
+	for _, f := range this.files {
+		if !isTextFile(f.path) {
+			continue
+		}
+		if e := this.checkUtf8(f.path, f.data); e != nil {
+			this.writeLog(e.Error())
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d file(s) are not valid UTF-8.", invalid)
+	}
+
+	return nil
+}
+
+var reCssVar = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// substituteCssVars replaces '{{name}}' in css file 'f' with the value of
+// option 'name' of section 'css_vars', unknown names are kept as is
+func (this *EpubMaker) substituteCssVars(f *sourceFile) []byte {
+	return reCssVar.ReplaceAllFunc(f.data, func(m []byte) []byte {
+		name := strings.ToLower(string(reCssVar.FindSubmatch(m)[1]))
+		if v, ok := this.css_vars[name]; ok {
+			return []byte(v)
+		}
+		this.writeWarning("css variable '" + name + "' in '" + f.path + "' is not defined.")
+		return m
+	})
+}
+
+// sortByOrderPrefix sorts the names which have an order prefix by the number
+// in the prefix, names without prefix keep their positions
+func sortByOrderPrefix(names []string) {
+	orders, slots := make(map[string]int), make([]int, 0)
+	for i, name := range names {
+		if m := reOrderPrefix.FindStringSubmatch(path.Base(name)); m != nil {
+			orders[name], _ = strconv.Atoi(m[1])
+			slots = append(slots, i)
+		}
+	}
+	sorted := make([]string, len(slots))
+	for i, slot := range slots {
+		sorted[i] = names[slot]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return orders[sorted[i]] < orders[sorted[j]]
+	})
+	for i, slot := range slots {
+		names[slot] = sorted[i]
+	}
+}
+
+// rename returns the final path of a file in the book
+func (this *EpubMaker) rename(path string) string {
+	if p, ok := this.renames[path]; ok {
+		return p
+	}
+	return path
+}
+
+// stripOrderPrefix removes the order prefix ('NNN-' or 'NNN_') from file
+// names, sorts the files by the prefix and updates references to them
+func (this *EpubMaker) stripOrderPrefix() {
+	exists := make(map[string]bool)
+	for _, f := range this.files {
+		exists[strings.ToLower(f.path)] = true
+	}
+
+	this.renames = make(map[string]string)
+	orders, slots := make(map[*sourceFile]int), make([]int, 0)
+	for i, f := range this.files {
+		dir, name := path.Split(f.path)
+		m := reOrderPrefix.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		np := dir + m[2]
+		if exists[strings.ToLower(np)] {
+			this.writeWarning("order prefix of '" + f.path + "' is not removed, because '" + np + "' already exists.")
+			continue
+		}
+		exists[strings.ToLower(np)] = true
+		orders[f], _ = strconv.Atoi(m[1])
+		this.renames[f.path] = np
+		f.path = np
+		slots = append(slots, i)
+	}
+
+	if len(slots) == 0 {
+		return
+	}
+
+	// only files with prefix are sorted, other files keep their positions
+	sorted := make([]*sourceFile, len(slots))
+	for i, slot := range slots {
+		sorted[i] = this.files[slot]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return orders[sorted[i]] < orders[sorted[j]]
+	})
+	for i, slot := range slots {
+		this.files[slot] = sorted[i]
+	}
+
+	this.updateReferences()
+}
+
+// updateReferences updates the references in html and css files according
+// to the renames
+func (this *EpubMaker) updateReferences() {
+	for _, f := range this.files {
+		if isHtmlFile(f.path) {
+			update := func(root *html.Node) {
+				rewriteReferences(root, f.path, f.path, this.rename)
+			}
+			if d, e := processHtmlFile(f.data, update); e != nil {
+				this.writeWarning("failed to update references in '" + f.path + "'.")
+			} else {
+				f.data = d
+			}
+		} else if isCssFile(f.path) {
+			f.data = rewriteCssReferences(f.data, f.path, this.rename)
+		}
+	}
+}
+
+func (this *EpubMaker) addFilesToBook() error {
+	// paths are case-insensitive in most reading systems. Every source file is
+	// loaded once, so a file shared by several chapters is also added once.
+	paths := make(map[string]string)
+	for _, f := range this.files {
+		p := strings.ToLower(cleanBookPath(f.path))
+		if other, ok := paths[p]; ok {
+			return fmt.Errorf("file '%s' conflicts with '%s'", f.path, other)
+		}
+		if other := this.book.FindFile(p); other != nil {
+			return fmt.Errorf("file '%s' conflicts with generated file '%s'", f.path, other.Path)
+		}
+		paths[p] = f.path
+	}
+
+	cover := ""
+	if len(this.cover_image) > 0 {
+		cover = this.rename(cleanBookPath(filepath.ToSlash(this.cover_image)))
+		if !isCoverImage(cover) {
+			this.writeWarning("cover image '" + this.cover_image + "' is not a supported image, ignored.")
+			cover = ""
+		} else if !this.hasFile(cover) {
+			this.writeWarning("cover image '" + this.cover_image + "' does not exist, ignored.")
+			cover = ""
+		}
+	}
+
+	if len(this.notes) > 0 {
+		this.notes = this.rename(this.notes)
+	}
+
+	if len(this.rights_file) > 0 {
+		this.rights_file = this.rename(this.rights_file)
+	}
+	rights := false
+
+	if len(this.container_file) > 0 {
+		this.container_file = this.rename(this.container_file)
+	}
+	container := false
+
+	var bar *progressBar
+	if this.progress {
+		bar = newProgressBar(os.Stdout, "adding files", len(this.files))
+	}
+
+	for _, f := range this.files {
+		if e := this.ctx.Err(); e != nil {
+			return e
+		}
+		if bar != nil {
+			bar.step()
+		}
+		if !this.isImageAllowed(f) {
+			continue
+		}
+		p := strings.ToLower(f.path)
+		if len(cover) > 0 {
+			if strings.EqualFold(f.path, cover) {
+				this.book.SetCoverImage(f.path)
+			}
+		} else if p == "cover.png" || p == "cover.jpg" || p == "cover.gif" {
+			this.book.SetCoverImage(p)
+		}
+		if len(this.container_file) > 0 && strings.EqualFold(f.path, this.container_file) {
+			if e := this.book.SetContainerXml(f.data); e != nil {
+				return e
+			}
+			container = true
+			continue
+		}
+		if len(this.rights_file) > 0 && strings.EqualFold(f.path, this.rights_file) {
+			if e := this.book.AddMetaInfFile(path.Base(f.path), f.data); e != nil {
+				this.writeWarning(e.Error())
+			}
+			rights = true
+			continue
+		}
+		if len(this.notes) > 0 && strings.EqualFold(f.path, this.notes) {
+			this.book.AddContentFile(f.path, f.data, "endnotes")
+		} else {
+			this.book.AddFile(f.path, f.data)
+		}
+		if bf := this.book.FindFile(f.path); bf != nil && !f.mtime.IsZero() {
+			bf.ModTime = f.mtime
+		}
+		if mt := this.book.MediaType(f.path); mt == "application/octet-stream" {
+			this.writeWarning("media type of '" + f.path + "' is unknown.")
+		} else if this.log_level >= log_DEBUG {
+			modified := "unknown"
+			if !f.modified.IsZero() {
+				modified = f.modified.Format("2006-01-02 15:04:05")
+			}
+			this.writeDebug(fmt.Sprintf("file '%s' added, media type is '%s', modified at %s, compression ratio %.1f%%.",
+				f.path, mt, modified, compressionRatio(f.data)*100))
+		}
+	}
+	if bar != nil {
+		bar.finish()
+	}
+
+	if len(this.rights_file) > 0 && !rights {
+		this.writeWarning("rights file '" + this.rights_file + "' does not exist.")
+	}
+
+	if len(this.container_file) > 0 && !container {
+		this.writeWarning("container file '" + this.container_file + "' does not exist, it is generated.")
+	}
+
+	if this.root_cover {
+		this.copyCoverToRoot()
+	}
+
+	for _, p := range this.includes {
+		p = this.rename(p)
+		if f := this.book.FindFile(p); f == nil {
+			this.writeWarning("file '" + p + "' in option 'include' does not exist.")
+		} else {
+			this.book.Include(f.Path)
+		}
+	}
+
+	if len(this.notes) > 0 {
+		if !this.hasFile(this.notes) {
+			this.writeWarning("notes file '" + this.notes + "' does not exist.")
+		} else {
+			for _, msg := range this.book.ValidateAnchors(this.notes) {
+				this.writeWarning(msg)
+			}
+		}
+	}
+	return nil
+}
+
+// addTitlePage adds the title page, it is generated from the book name and
+// author if option 'title_page' is not specified
+func (this *EpubMaker) addTitlePage() {
+	if this.book.FindFile(path_of_title_page) != nil {
+		this.writeWarning("title page is not generated, because '" + path_of_title_page + "' already exists.")
+		return
+	}
+	body := this.title_page
+	if len(body) == 0 {
+		body = "	<h1>" + html.EscapeString(this.book.Name()) + "</h1>\n" +
+			"	<p>" + html.EscapeString(this.book.Author()) + "</p>"
+	}
+	this.book.AddTitlePage(body)
+}
+
+// addBackCover adds the back cover page, it must be the last one in spine
+func (this *EpubMaker) addBackCover() {
+	p := this.rename(this.back_cover)
+	if !isCoverImage(p) {
+		this.writeWarning("back cover '" + this.back_cover + "' is not a supported image, ignored.")
+	} else if f := this.book.FindFile(p); f == nil {
+		this.writeWarning("back cover '" + this.back_cover + "' does not exist, ignored.")
+	} else if this.book.FindFile(path_of_back_cover) != nil {
+		this.writeWarning("back cover is not generated, because '" + path_of_back_cover + "' already exists.")
+	} else {
+		this.book.AddBackCover(f.Path)
+	}
+}
+
+// copyCoverToRoot copies the cover image to 'cover.<ext>' in the root folder
+// of the book, because some reading systems only look for it there
+func (this *EpubMaker) copyCoverToRoot() {
+	cover := this.book.CoverImage()
+	if len(cover) == 0 {
+		return
+	}
+	target := "cover" + strings.ToLower(path.Ext(cover))
+	if strings.EqualFold(cover, target) {
+		return
+	}
+	if this.book.FindFile(target) != nil {
+		this.writeWarning("cover image is not copied, because '" + target + "' already exists.")
+		return
+	}
+	this.book.AddFile(target, this.book.FindFile(cover).Data)
+	this.book.SetCoverImage(target)
+}
+
+// isCoverImage reports whether 'path' is an image which can be used as cover
+func isCoverImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
 }
 
 func checkHeaderNode(node *html.Node) *Chapter {
@@ -157,7 +912,7 @@ func (this *EpubMaker) checkChapterNode(node *html.Node) *Chapter {
 	if attr := findAttribute(node, data_chapter_level); attr != nil {
 		level, e := strconv.Atoi(attr.Val)
 		if e != nil || level < 0 || level > lowest_level {
-			this.writeLog("invalid chapter level '" + attr.Val + "', ignored.")
+			this.writeWarning("invalid chapter level '" + attr.Val + "', ignored.")
 			return nil
 		}
 		title := getAttributeValue(node, data_chapter_title, "")
@@ -203,6 +958,9 @@ func (this *EpubMaker) checkNewChapter(node *html.Node) *Chapter {
 		if c.Level < this.by_header || hasClass(node, makeepub_not_chapter) {
 			return nil
 		}
+		if this.split_levels != nil && !this.split_levels[c.Level] {
+			return nil
+		}
 	}
 
 	// only chapters in TOC need a Link
@@ -213,19 +971,51 @@ func (this *EpubMaker) checkNewChapter(node *html.Node) *Chapter {
 			id = &node.Attr[len(node.Attr)-1]
 		}
 		if len(id.Val) == 0 {
-			id.Val = fmt.Sprintf(makeepub_chapter_id, this.chapter_id)
-			this.chapter_id++
+			id.Val = this.newAnchorId(c.Title)
 		}
 		c.Link = "#" + id.Val
 	}
 
-	c.Title = strings.TrimSpace(c.Title)
+	if this.page_break && c.Level > 0 && !hasPageBreak(node) {
+		addClass(node, makeepub_page_break)
+	}
+
+	// titles from pretty-printed html may contain line breaks, tabs and so on
+	c.Title = strings.Join(strings.Fields(c.Title), " ")
+	this.writeDebug(fmt.Sprintf("split point found: <%s>, level %d, title '%s'.", node.Data, c.Level, c.Title))
 	return c
 }
 
-func (this *EpubMaker) checkFullScreenImage(node *html.Node) (string, string) {
-	if !this.book.Duokan() {
-		return "", ""
+// newAnchorId returns a new id for the split point whose title is 'title',
+// it is a slug of the title if enabled, otherwise or if the title has no
+// ASCII letters & digits (e.g. a CJK title), it is a counter-based id
+func (this *EpubMaker) newAnchorId(title string) string {
+	if this.slug_ids == nil {
+		id := fmt.Sprintf(makeepub_chapter_id, this.chapter_id)
+		this.chapter_id++
+		return id
+	}
+
+	base := slugify(title)
+	if len(base) == 0 {
+		for base = ""; len(base) == 0 || this.slug_ids[base]; this.chapter_id++ {
+			base = fmt.Sprintf(makeepub_chapter_id, this.chapter_id)
+		}
+	} else if base[0] >= '0' && base[0] <= '9' {
+		// an id of xhtml must not start with a digit
+		base = "chapter-" + base
+	}
+	id := base
+	for n := 2; this.slug_ids[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	this.slug_ids[id] = true
+	return id
+}
+
+func (this *EpubMaker) checkFullScreenImage(node *html.Node) (string, string) {
+	if !this.book.Duokan() {
+		return "", ""
 	}
 	if node.Type != html.ElementNode || node.DataAtom != atom.Img {
 		return "", ""
@@ -247,7 +1037,191 @@ func (this *EpubMaker) checkFullScreenImage(node *html.Node) (string, string) {
 	return "", ""
 }
 
+func (this *EpubMaker) hasFile(path string) bool {
+	for _, f := range this.files {
+		if strings.EqualFold(f.path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// addStyleSheet adds a link to style sheet 'path' into 'head' if not exists
+func (this *EpubMaker) addStyleSheet(head *html.Node, path string) {
+	for _, link := range findDirectChildren(head, atom.Link) {
+		href := getAttributeValue(link, "href", "")
+		if p := resolveReference("book.html", href); strings.EqualFold(p, path) {
+			return
+		}
+	}
+	head.AppendChild(&html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Link,
+		Data:     "link",
+		Attr: []html.Attribute{
+			{Key: "href", Val: path},
+			{Key: "type", Val: "text/css"},
+			{Key: "rel", Val: "stylesheet"},
+		},
+	})
+}
+
+// normalizeCharset removes all charset declarations in 'root', and declares
+// the charset of all chapters as 'utf-8'
+func normalizeCharset(root *html.Node) {
+	// the xml declaration is parsed as a comment
+	var next *html.Node
+	for node := root.FirstChild; node != nil; node = next {
+		next = node.NextSibling
+		if node.Type == html.CommentNode && strings.HasPrefix(node.Data, "?xml") {
+			root.RemoveChild(node)
+		}
+	}
+
+	head := findFirstChild(root, atom.Head)
+	for _, meta := range findDirectChildren(head, atom.Meta) {
+		equiv := strings.ToLower(getAttributeValue(meta, "http-equiv", ""))
+		if findAttribute(meta, "charset") != nil || equiv == "content-type" {
+			head.RemoveChild(meta)
+		}
+	}
+
+	meta := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Meta,
+		Data:     "meta",
+		Attr:     []html.Attribute{{Key: "charset", Val: "utf-8"}},
+	}
+	head.InsertBefore(meta, head.FirstChild)
+}
+
+// updateHead updates the 'head' element which is shared by all chapters
+func (this *EpubMaker) updateHead(head *html.Node) {
+	if len(this.base_style) > 0 {
+		this.addBaseStyle(head)
+	}
+	if len(this.stylesheet) > 0 {
+		if !this.hasFile(this.stylesheet) {
+			this.writeWarning("style sheet '" + this.stylesheet + "' does not exist.")
+		}
+		this.addStyleSheet(head, this.stylesheet)
+	}
+	if this.page_break {
+		addPageBreakStyle(head)
+	}
+}
+
+// addBaseStyleSheet generates the base style sheet, it is linked into all
+// chapters and generated pages. 'makeepub_base.css' is a reserved name, so
+// the file in the source folder is ignored.
+func (this *EpubMaker) addBaseStyleSheet() {
+	for i, f := range this.files {
+		if strings.EqualFold(f.path, path_of_base_style) {
+			this.writeWarning("'" + path_of_base_style + "' is a reserved name, the file in the source folder is ignored.")
+			this.files = append(this.files[:i], this.files[i+1:]...)
+			break
+		}
+	}
+	this.book.AddFile(path_of_base_style, []byte("body { "+this.base_style+"}\n"))
+	this.book.SetBaseStyle(path_of_base_style)
+}
+
+// addBaseStyle links the base style sheet into 'head' before all other style
+// sheets, so the author's rules always win
+func (this *EpubMaker) addBaseStyle(head *html.Node) {
+	link := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Link,
+		Data:     "link",
+		Attr: []html.Attribute{
+			{Key: "href", Val: path_of_base_style},
+			{Key: "type", Val: "text/css"},
+			{Key: "rel", Val: "stylesheet"},
+		},
+	}
+	for n := head.FirstChild; n != nil; n = n.NextSibling {
+		if n.DataAtom == atom.Link || n.DataAtom == atom.Style {
+			head.InsertBefore(link, n)
+			return
+		}
+	}
+	head.AppendChild(link)
+}
+
+// loadBaseStyle loads the style rules of 'body' from section 'style'
+func (this *EpubMaker) loadBaseStyle(cfg *Config) string {
+	style := ""
+	for _, p := range []struct{ option, property string }{
+		{"font_size", "font-size"},
+		{"line_height", "line-height"},
+	} {
+		s := strings.TrimSpace(cfg.GetString("/style/"+p.option, ""))
+		if len(s) == 0 {
+			continue
+		}
+		if strings.ContainsAny(s, ";{}<>\"'\\") {
+			this.writeWarning("option '" + p.option + "' of section 'style' is invalid, ignored.")
+			continue
+		}
+		style += p.property + ": " + s + "; "
+	}
+	return style
+}
+
+// addPageBreakStyle adds the style rule of the page break class into 'head'
+func addPageBreakStyle(head *html.Node) {
+	for _, style := range findDirectChildren(head, atom.Style) {
+		if style.FirstChild != nil && strings.Contains(style.FirstChild.Data, "."+makeepub_page_break) {
+			return
+		}
+	}
+	style := &html.Node{Type: html.ElementNode, DataAtom: atom.Style, Data: "style"}
+	style.Attr = []html.Attribute{{Key: "type", Val: "text/css"}}
+	style.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: "." + makeepub_page_break + " { page-break-before: always; break-before: page; }",
+	})
+	head.AppendChild(style)
+}
+
+// hasPageBreak reports whether the author already set a page break on 'node'
+func hasPageBreak(node *html.Node) bool {
+	s := strings.ToLower(getAttributeValue(node, "style", ""))
+	return strings.Contains(s, "page-break-before") || strings.Contains(s, "break-before")
+}
+
 func (this *EpubMaker) splitChapter(root *html.Node) {
+	// chapters are stored in the same folder as 'book.html', only references
+	// point to outside of the book need to be fixed
+	rewriteReferences(root, "book.html", "book.html", this.rename)
+	first := len(this.book.Files())
+	this.source = ""
+	if this.typography {
+		smartenTypography(findFirstChild(root, atom.Body))
+	}
+	if this.slug_ids != nil {
+		// generated ids must not conflict with the ones from the author
+		collectNodeIds(root, this.slug_ids)
+	}
+	if this.charset {
+		normalizeCharset(root)
+	}
+	this.updateHead(findFirstChild(root, atom.Head))
+
+	// reading systems use the language for hyphenation & text-to-speech, the
+	// language set by the author is kept
+	if node := findFirstDirectChild(root, atom.Html); node != nil && len(this.book.Language()) > 0 {
+		for _, name := range []string{"lang", "xml:lang"} {
+			if findAttribute(node, name) == nil {
+				setAttribute(node, name, this.book.Language())
+			}
+		}
+	}
+
+	if this.minify {
+		this.saved += minifyHtml(root)
+	}
+
 	this.body = findFirstDirectChild(root, atom.Html)
 	this.body = findFirstDirectChild(this.body, atom.Body)
 	this.blank = true
@@ -268,6 +1242,9 @@ func (this *EpubMaker) splitChapter(root *html.Node) {
 
 		if path, alt := this.checkFullScreenImage(node); len(path) > 0 {
 			this.saveChapter(root, chapters)
+			if p, ok := this.sources[node]; ok {
+				this.source = p
+			}
 			body = resetBody(body)
 			chapters = nil
 			lastLevel = unknown_level
@@ -285,15 +1262,17 @@ func (this *EpubMaker) splitChapter(root *html.Node) {
 		// c.Level > lastLevel means current chapter is a child of last
 		// chapter, and there's no text (only chapter names), so merge it into
 		// last chapter
-		if c.Level <= this.split && c.Level <= lastLevel {
+		if this.isSplitLevel(c.Level) && c.Level <= lastLevel {
 			this.saveChapter(root, chapters)
 			body = resetBody(body)
 			chapters = nil
 			lastLevel = c.Level
 		}
+		this.checkFrontMatterTag(node)
 
 		// level 0 is only for chapter split, will not be added to chapter list
 		if c.Level > 0 && c.Level <= this.toc && len(c.Title) > 0 {
+			this.checkDuplicateTitle(c.Title)
 			chapters = append(chapters, *c)
 		}
 
@@ -302,6 +1281,91 @@ func (this *EpubMaker) splitChapter(root *html.Node) {
 	}
 
 	this.saveChapter(root, chapters)
+	this.fixFragmentLinks(this.book.Files()[first:])
+}
+
+// fixFragmentLinks updates the fragment only links in 'files', which are
+// split from the same file, to point to the file holding the fragment
+func (this *EpubMaker) fixFragmentLinks(files []*File) {
+	owners := make(map[string]string)
+	for _, f := range files {
+		if !isHtmlFile(f.Path) {
+			continue
+		}
+		ids := collectIds(f)
+		for id := range ids {
+			if _, ok := owners[id]; !ok {
+				owners[id] = f.Path
+			}
+		}
+	}
+
+	for _, f := range files {
+		if !isHtmlFile(f.Path) {
+			continue
+		}
+		changed := false
+		data, e := processHtmlFile(f.Data, func(root *html.Node) {
+			for _, a := range findChildren(root, atom.A) {
+				attr := findAttribute(a, "href")
+				if attr == nil || !strings.HasPrefix(attr.Val, "#") {
+					continue
+				}
+				if owner, ok := owners[attr.Val[1:]]; ok && owner != f.Path {
+					attr.Val = relativeReference(f.Path, owner) + attr.Val
+					changed = true
+				}
+			}
+		})
+		if e == nil && changed {
+			f.Data = data
+		}
+	}
+}
+
+// checkDuplicateTitle warns if 'title' is already used by another chapter
+func (this *EpubMaker) checkDuplicateTitle(title string) {
+	if this.titles == nil {
+		return
+	}
+	if this.titles[title] {
+		this.writeWarning("duplicate chapter title '" + title + "'.")
+	}
+	this.titles[title] = true
+}
+
+// numberChapters prefixes the TOC titles with hierarchical numbers like '1.',
+// '1.1' and '1.2', the headers in the content are not changed
+func (this *EpubMaker) numberChapters() {
+	var counters [lowest_level + 1]int
+	for _, f := range this.book.ContentFiles() {
+		for i := range f.Chapters {
+			c := &f.Chapters[i]
+			if c.Level < 1 || c.Level > lowest_level {
+				continue
+			}
+			counters[c.Level]++
+			for l := c.Level + 1; l <= lowest_level; l++ {
+				counters[l] = 0
+			}
+			nums := make([]string, 0, c.Level)
+			for l := 1; l <= c.Level; l++ {
+				nums = append(nums, strconv.Itoa(counters[l]))
+			}
+			prefix := strings.Join(nums, ".")
+			if c.Level == 1 {
+				prefix += "."
+			}
+			c.Title = prefix + " " + c.Title
+		}
+	}
+}
+
+func (this *EpubMaker) isSplitLevel(level int) bool {
+	if this.split_levels != nil {
+		return level == 0 || this.split_levels[level]
+	}
+	return level <= this.split
 }
 
 func resetBody(body *html.Node) *html.Node {
@@ -311,85 +1375,665 @@ func resetBody(body *html.Node) *html.Node {
 	return nb
 }
 
+// sampleFull reports whether the sample has enough top-level chapters, so a
+// chapter file with TOC items 'chapters' must be dropped, the sub chapters of
+// the last top-level chapter are kept
+func (this *EpubMaker) sampleFull(chapters []Chapter) bool {
+	if this.sample <= 0 {
+		return false
+	}
+	if this.truncated {
+		return true
+	}
+	return this.sample_count >= this.sample && countTopChapters(chapters) > 0
+}
+
+// countTopChapters returns the number of top-level items in 'chapters'
+func countTopChapters(chapters []Chapter) int {
+	count := 0
+	for _, c := range chapters {
+		if c.Level == 1 {
+			count++
+		}
+	}
+	return count
+}
+
 func (this *EpubMaker) saveFullScreenImage(path, alt string, c *Chapter) {
 	chapters := make([]Chapter, 0)
 	if c != nil && c.Level > 0 && c.Level <= this.toc && len(c.Title) > 0 {
-		c.Link = ""
 		chapters = append(chapters, *c)
 	}
+	if this.sampleFull(chapters) {
+		this.truncated = true
+		return
+	}
+	this.sample_count += countTopChapters(chapters)
+	if len(chapters) > 0 {
+		chapters[0].Link = ""
+		this.checkDuplicateTitle(c.Title)
+		chapters = this.promoteChapters(chapters)
+	}
 	this.book.AddFullScreenImage(path, alt, chapters)
 }
 
+// insertTemplate parses 'tmpl' as children of 'body', and inserts them before
+// 'before' (or at the end if 'before' is nil), the inserted nodes are returned
+func insertTemplate(body, before *html.Node, tmpl, title string) []*html.Node {
+	tmpl = strings.Replace(tmpl, "{title}", html.EscapeString(title), -1)
+	nodes, e := html.ParseFragment(strings.NewReader(tmpl), body)
+	if e != nil {
+		return nil
+	}
+	for _, n := range nodes {
+		body.InsertBefore(n, before)
+	}
+	return nodes
+}
+
+// isEmptyChapter reports whether 'body' only contains headers
+func isEmptyChapter(body *html.Node) bool {
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode {
+			if checkHeaderNode(n) == nil {
+				return false
+			}
+		} else if n.Type == html.TextNode && !isBlankNode(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropChapters records the levels of the TOC items of a dropped chapter, so
+// that their children can be promoted
+func (this *EpubMaker) dropChapters(chapters []Chapter) {
+	for _, c := range chapters {
+		this.popDropped(c.Level)
+		this.dropped = append(this.dropped, c.Level)
+	}
+}
+
+func (this *EpubMaker) popDropped(level int) {
+	for n := len(this.dropped); n > 0 && this.dropped[n-1] >= level; n-- {
+		this.dropped = this.dropped[:n-1]
+	}
+}
+
+// promoteChapters promotes the children of dropped TOC items by one level
+// for each dropped ancestor
+func (this *EpubMaker) promoteChapters(chapters []Chapter) []Chapter {
+	if len(this.dropped) == 0 {
+		return chapters
+	}
+	for i := range chapters {
+		c := &chapters[i]
+		this.popDropped(c.Level)
+		if c.Level -= len(this.dropped); c.Level < 1 {
+			c.Level = 1
+		}
+	}
+	return chapters
+}
+
 func (this *EpubMaker) saveChapter(root *html.Node, chapters []Chapter) {
+	if !this.blank && this.sampleFull(chapters) {
+		this.truncated = true
+		this.blank = true
+	}
+	body := findFirstDirectChild(findFirstDirectChild(root, atom.Html), atom.Body)
+	if !this.blank && this.skip_empty && isEmptyChapter(body) {
+		this.writeDebug(fmt.Sprintf("empty chapter dropped, %d TOC item(s) removed.", len(chapters)))
+		this.dropChapters(chapters)
+		this.blank = true
+	}
 	if !this.blank {
+		this.chapter_count++
+		this.sample_count += countTopChapters(chapters)
+		chapters = this.promoteChapters(chapters)
+		title := this.book.Name()
+		if len(chapters) > 0 {
+			title = chapters[0].Title
+		}
+		var sources []string
+		if this.track_mtime {
+			sources = this.chapterSources(body)
+		}
+		var nodes []*html.Node
+		if len(this.header) > 0 {
+			nodes = insertTemplate(body, body.FirstChild, this.header, title)
+		}
+		if len(this.footer) > 0 {
+			nodes = append(nodes, insertTemplate(body, nil, this.footer, title)...)
+		}
+		defer func() {
+			for _, n := range nodes {
+				body.RemoveChild(n)
+			}
+		}()
+
+		if len(this.front_type) > 0 {
+			this.book.SetFileType(this.book.nextChapterPath(), this.front_type)
+			this.front_type = ""
+		}
+		if len(this.front_linear) > 0 {
+			this.book.SetFileLinear(this.book.nextChapterPath(), this.front_linear == "yes")
+			this.front_linear = ""
+		}
+
+		if this.progress_anchors > 0 {
+			this.addProgressAnchors(body)
+		}
+
 		buf := new(bytes.Buffer)
-		html.Render(buf, root)
-		this.book.AddChapter(chapters, buf.Bytes())
+		if this.charset && strings.ToLower(path.Ext(this.book.nextChapterPath())) == ".xhtml" {
+			buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+		}
+		if this.body_type {
+			this.renderWithType(buf, root)
+		} else {
+			html.Render(buf, root)
+		}
+		data := buf.Bytes()
+		if len(this.newline) > 0 {
+			data = normalizeNewlines(data, this.newline)
+		}
+		this.book.AddChapter(chapters, data)
+		if this.track_mtime {
+			this.recordChapterMtime(sources, this.sourceModTime(sources))
+		}
 		this.blank = true
 	}
 }
 
+// addProgressAnchors inserts an empty anchor at the beginning of every
+// 'progress_anchors' paragraphs in 'body', so reading systems which bookmark
+// by anchors have a finer granularity
+func (this *EpubMaker) addProgressAnchors(body *html.Node) {
+	for i, p := range findChildren(body, atom.P) {
+		if (i+1)%this.progress_anchors != 0 {
+			continue
+		}
+		a := &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.A,
+			Data:     "a",
+			Attr:     []html.Attribute{{Key: "id", Val: fmt.Sprintf(makeepub_progress_id, this.progress_id)}},
+		}
+		this.progress_id++
+		p.InsertBefore(a, p.FirstChild)
+	}
+}
+
+// renderWithType renders 'root' with the 'epub:type' of the chapter set on
+// the 'body' element
+func (this *EpubMaker) renderWithType(buf *bytes.Buffer, root *html.Node) {
+	node := findFirstDirectChild(root, atom.Html)
+	body := findFirstDirectChild(node, atom.Body)
+	t := this.book.FileType(this.book.nextChapterPath())
+
+	attrs, battrs := node.Attr, body.Attr
+	if findAttribute(node, "xmlns:epub") == nil {
+		node.Attr = append(node.Attr[:len(node.Attr):len(node.Attr)],
+			html.Attribute{Key: "xmlns:epub", Val: "http://www.idpf.org/2007/ops"})
+	}
+	body.Attr = append(body.Attr[:len(body.Attr):len(body.Attr)],
+		html.Attribute{Key: "epub:type", Val: t})
+
+	html.Render(buf, root)
+	node.Attr, body.Attr = attrs, battrs
+}
+
+// SetProgress sets whether to show the progress bar, it should only be
+// enabled if the output is a terminal
+func (this *EpubMaker) SetProgress(progress bool) {
+	this.progress = progress
+}
+
+// SetLogLevel sets the level of messages to print, warnings and errors are
+// always printed
+func (this *EpubMaker) SetLogLevel(level int) {
+	this.log_level = level
+}
+
 func (this *EpubMaker) writeLog(msg string) {
 	this.logger.Printf("%s: %s\n", this.folder.Name(), msg)
 }
 
+// writeWarning prints a warning, which is an error in strict mode
+func (this *EpubMaker) writeWarning(msg string) {
+	this.warnings++
+	this.messages = append(this.messages, msg)
+	this.writeLog(msg)
+}
+
+func (this *EpubMaker) writeInfo(msg string) {
+	if this.log_level >= log_INFO {
+		this.writeLog(msg)
+	}
+}
+
+func (this *EpubMaker) writeDebug(msg string) {
+	if this.log_level >= log_DEBUG {
+		this.writeLog(msg)
+	}
+}
+
+// getTextOption returns the value of a text option, if the value starts
+// with '@', the rest is the path of a file, and the file content is returned
+func (this *EpubMaker) getTextOption(cfg *Config, path string) string {
+	s := cfg.GetString(path, "")
+	if !strings.HasPrefix(s, "@") {
+		return s
+	}
+	data, e := readAll(this.folder, strings.TrimSpace(s[1:]))
+	if e != nil {
+		this.writeWarning("failed to read '" + s[1:] + "' for option '" + path + "'.")
+		return ""
+	}
+	return string(removeUtf8Bom(data))
+}
+
+// loadLinear loads the 'linear' attribute of spine items from section 'linear'
+func (this *EpubMaker) loadLinear(cfg *Config) map[string]bool {
+	names, values := cfg.GetSection("linear")
+	linear := make(map[string]bool)
+	for _, name := range names {
+		switch strings.ToLower(values[name]) {
+		case "yes", "true":
+			linear[name] = true
+		case "no", "false":
+			linear[name] = false
+		default:
+			this.writeWarning("linear attribute of '" + name + "' is invalid, ignored.")
+		}
+	}
+	return linear
+}
+
+// media types must be 'type/subtype', parameters are not allowed in the OPF
+var reMediaType = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*$`)
+
+func (this *EpubMaker) loadMediaTypes(cfg *Config) map[string]string {
+	names, values := cfg.GetSection("media_types")
+	types := make(map[string]string)
+	for _, name := range names {
+		if mt := strings.TrimSpace(values[name]); reMediaType.MatchString(mt) {
+			types[name] = mt
+		} else {
+			this.writeWarning("media type of '" + name + "' is invalid, ignored.")
+		}
+	}
+	return types
+}
+
 func (this *EpubMaker) loadConfig() error {
+	// the post build command runs any program, so it is only taken from the
+	// configuration files specified by the user, but not from the ones which
+	// come with the book, e.g. from a remote source or a git repository
+	cfg, command := NewConfig(), ""
+	if len(this.global_path) > 0 {
+		global, e := OpenIniFile(this.global_path)
+		if e != nil {
+			return e
+		}
+		global.ResolvePath("/output/sign", filepath.Dir(this.global_path))
+		command = global.GetString("/output/post_command", command)
+		cfg.Merge(global)
+	}
+	if this.defaults != nil {
+		this.checkPostCommand(this.defaults, path_of_series_ini)
+		cfg.Merge(this.defaults)
+	}
+
 	rc, e := this.folder.OpenFile("book.ini")
-	if e != nil {
+	if e == nil {
+		ini, e := ParseIni(rc)
+		rc.Close()
+		if e != nil {
+			return e
+		}
+		if sf, ok := this.folder.(*SystemFolder); ok {
+			ini.ResolvePath("/output/sign", sf.path)
+		}
+		this.checkPostCommand(ini, "book.ini")
+		cfg.Merge(ini)
+	} else if !os.IsNotExist(e) || (len(this.config_path) == 0 && this.defaults == nil) {
+		// 'book.ini' is optional if an external or default one is specified
 		return e
 	}
 
-	cfg, e := ParseIni(rc)
-	rc.Close()
-	if e != nil {
-		return e
+	if len(this.config_path) > 0 {
+		ext, e := OpenIniFile(this.config_path)
+		if e != nil {
+			return e
+		}
+		ext.ResolvePath("/output/sign", filepath.Dir(this.config_path))
+		command = ext.GetString("/output/post_command", command)
+		cfg.Merge(ext)
+	}
+
+	if this.log_level >= log_DEBUG {
+		for _, k := range cfg.Keys() {
+			this.writeDebug("option '" + k + "' = '" + cfg.GetString(k, "") + "'.")
+		}
+	}
+
+	for _, n := range cfg.UndefinedVariables() {
+		this.writeWarning("environment variable '" + n + "' is not defined, will use empty string.")
 	}
 
 	this.toc = cfg.GetInt("/book/toc", 2)
 	if this.toc < 1 || this.toc > lowest_level {
-		this.writeLog("option 'toc' is invalid, will use default value 2.")
+		this.writeWarning("option 'toc' is invalid, will use default value 2.")
 		this.toc = 2
 	}
 	this.split = cfg.GetInt("/split/AtLevel", 1)
 	if this.split < 0 || this.split > lowest_level {
-		this.writeLog("option 'AtLevel' is invalid, will use default value 1.")
+		this.writeWarning("option 'AtLevel' is invalid, will use default value 1.")
 		this.split = 1
 	}
 	this.by_header = cfg.GetInt("/split/ByHeader", 1)
 	if this.by_header < 1 || this.by_header > (lowest_level+1) {
-		this.writeLog("option 'ByHeader' is invalid, will use default value 1.")
+		this.writeWarning("option 'ByHeader' is invalid, will use default value 1.")
 		this.by_header = 1
 	}
+	if s := cfg.GetString("/book/split_levels", ""); len(s) > 0 {
+		this.split_levels = make([]bool, lowest_level+1)
+		for _, v := range strings.Split(s, ",") {
+			level, e := strconv.Atoi(strings.TrimSpace(v))
+			if e != nil || level < 1 || level > lowest_level {
+				this.writeWarning("option 'split_levels' is invalid, ignored.")
+				this.split_levels = nil
+				break
+			}
+			this.split_levels[level] = true
+		}
+	}
+	// only checked if set explicitly, the defaults (toc=2, AtLevel=1) are kept
+	// for compatibility; level 0 means only level 0 split points split files
+	explicit := len(cfg.GetString("/book/toc", "")) > 0 || len(cfg.GetString("/split/AtLevel", "")) > 0
+	if explicit && this.split_levels == nil && this.split > 0 && this.toc > this.split {
+		this.writeWarning(fmt.Sprintf("option 'toc' (%d) is greater than 'AtLevel' (%d), TOC items deeper than the split level link into the middle of chapter files.", this.toc, this.split))
+	}
+
 	this.output_path = cfg.GetString("/output/path", "")
+	if s := cfg.GetString("/output/rights_file", ""); len(s) > 0 {
+		this.rights_file = cleanBookPath(filepath.ToSlash(s))
+	}
+	if s := cfg.GetString("/output/container_file", ""); len(s) > 0 {
+		this.container_file = cleanBookPath(filepath.ToSlash(s))
+	}
+	this.opds = this.opds || cfg.GetBool("/output/opds", false)
+	this.unpacked = this.unpacked || cfg.GetBool("/output/unpacked", false)
+	this.post_command = strings.TrimSpace(command)
+	this.preserve_mtime = cfg.GetBool("/output/preserve_mtime", false)
+	this.minify = cfg.GetBool("/build/minify_html", false)
+	this.strip_prefix = cfg.GetBool("/build/strip_order_prefix", false)
+	this.cache_dir = ""
+	if s := filepath.ToSlash(strings.TrimSpace(cfg.GetString("/build/cache_dir", ""))); len(s) > 0 {
+		// the cache must be in the book folder, so a book (e.g. an uploaded
+		// one in server mode) cannot write to anywhere else
+		if p := path.Clean(s); path.IsAbs(p) || filepath.IsAbs(s) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			this.writeWarning("option 'cache_dir' is invalid, ignored.")
+		} else {
+			this.cache_dir = p
+		}
+	}
+	this.book.SetGuide(cfg.GetBool("/build/guide", true))
+	this.charset = cfg.GetBool("/build/normalize_charset", true)
+	this.body_type = cfg.GetBool("/build/body_epub_type", false)
+	this.page_break = cfg.GetBool("/build/page_break_before", false)
+	this.count = cfg.GetBool("/build/count", false)
+	this.search_index = cfg.GetBool("/build/search_index", false)
+	this.stopwords = cfg.GetString("/build/stopwords", default_stopwords)
+	this.skip_empty = cfg.GetBool("/build/skip_empty_chapters", false)
+	switch s := strings.ToLower(cfg.GetString("/build/normalize_newlines", "none")); s {
+	case "none":
+		this.newline = ""
+	case "lf":
+		this.newline = "\n"
+	case "crlf":
+		this.newline = "\r\n"
+	default:
+		this.writeWarning("option 'normalize_newlines' is invalid, will use default value 'none'.")
+		this.newline = ""
+	}
+	switch layout := strings.ToLower(cfg.GetString("/book/layout", "reflowable")); layout {
+	case "fixed", "pre-paginated":
+		orientation := strings.ToLower(cfg.GetString("/book/orientation", ""))
+		if orientation != "" && orientation != "auto" && orientation != "landscape" && orientation != "portrait" {
+			this.writeWarning("option 'orientation' is invalid, will use default value 'auto'.")
+			orientation = ""
+		}
+		spread := strings.ToLower(cfg.GetString("/book/spread", ""))
+		if spread != "" && spread != "auto" && spread != "none" && spread != "landscape" && spread != "both" {
+			this.writeWarning("option 'spread' is invalid, will use default value 'auto'.")
+			spread = ""
+		}
+		this.book.SetFixedLayout(true, orientation, spread)
+		if vp := cfg.GetString("/book/viewport", ""); len(vp) > 0 {
+			var w, h int
+			if n, _ := fmt.Sscanf(strings.ToLower(vp), "%dx%d", &w, &h); n != 2 || w <= 0 || h <= 0 {
+				this.writeWarning("option 'viewport' is invalid, ignored.")
+			} else {
+				this.viewport = formatViewport(w, h)
+			}
+		}
+	case "reflowable":
+	default:
+		this.writeWarning("option 'layout' is invalid, will use default value 'reflowable'.")
+	}
+
+	if this.kindle = cfg.GetBool("/build/kindle_mode", false); this.kindle {
+		// a preset for the kindle converters, overrides the related options
+		this.book.SetGuide(true)
+		this.book.SetDuokan(false)
+		this.body_type = false
+		if this.book.FixedLayout() {
+			this.writeWarning("fixed layout is not supported in kindle mode, ignored.")
+			this.book.SetFixedLayout(false, "", "")
+		}
+	}
+	this.sample = cfg.GetInt("/build/sample_chapters", 0)
+	if this.sample < 0 {
+		this.writeWarning("option 'sample_chapters' is invalid, ignored.")
+		this.sample = 0
+	}
+	this.sample_text = cfg.GetString("/build/sample_end_text", "End of sample")
+	this.colophon = strings.TrimSpace(this.getTextOption(cfg, "/book/colophon"))
+	this.title_page = strings.TrimSpace(this.getTextOption(cfg, "/book/title_page"))
+	this.auto_title = cfg.GetBool("/build/auto_title_page", false)
+	this.header = this.getTextOption(cfg, "/build/header_html")
+	this.footer = this.getTextOption(cfg, "/build/footer_html")
+	_, this.css_vars = cfg.GetSection("css_vars")
+	this.base_style = this.loadBaseStyle(cfg)
+	this.book.SetLinear(this.loadLinear(cfg))
+	_, semantics := cfg.GetSection("semantics")
+	this.book.SetSemantics(semantics)
+	this.book.SetMediaTypes(this.loadMediaTypes(cfg))
+	this.stylesheet = cleanBookPath(filepath.ToSlash(cfg.GetString("/build/stylesheet", "")))
+	if this.stylesheet == "." {
+		this.stylesheet = ""
+	}
+	this.number_chapters = cfg.GetBool("/build/number_chapters", false)
+	this.track_mtime = cfg.GetBool("/build/track_chapter_mtime", false)
+	this.typography = cfg.GetBool("/build/typography", false)
+	if this.progress_anchors = cfg.GetInt("/build/progress_anchors", 0); this.progress_anchors < 0 {
+		this.writeWarning("option 'progress_anchors' is invalid, ignored.")
+		this.progress_anchors = 0
+	}
+	switch s := strings.ToLower(cfg.GetString("/build/anchor_ids", "counter")); s {
+	case "slug":
+		this.slug_ids = make(map[string]bool)
+	case "counter":
+		this.slug_ids = nil
+	default:
+		this.writeWarning("option 'anchor_ids' is invalid, will use default value 'counter'.")
+		this.slug_ids = nil
+	}
+	if cfg.GetBool("/build/warn_duplicate_titles", false) {
+		this.titles = make(map[string]bool)
+	}
+
+	if s := cfg.GetString("/build/chapter_name_pattern", ""); len(s) > 0 {
+		if !strings.Contains(s, "{n}") {
+			this.writeWarning("option 'chapter_name_pattern' does not contain '{n}', ignored.")
+		} else if strings.ContainsAny(s, "/\\") {
+			// chapters must be in the same folder as 'book.html' to keep the
+			// relative references valid
+			this.writeWarning("option 'chapter_name_pattern' is invalid, will use default value.")
+		} else {
+			this.book.SetChapterPattern(s)
+		}
+	}
+
+	if s := cfg.GetString("/output/content_dir", ""); len(s) > 0 {
+		s = path.Clean(filepath.ToSlash(s))
+		if s == "." || strings.HasPrefix(s, "../") || s == ".." || path.IsAbs(s) || strings.EqualFold(s, "META-INF") {
+			this.writeWarning("option 'content_dir' is invalid, files will be stored at the root folder.")
+		} else {
+			this.book.SetContentDir(s)
+		}
+	}
+
+	this.cover_image = cfg.GetString("/book/cover", "")
+	this.book.SetCoverAlt(strings.TrimSpace(cfg.GetString("/book/cover_alt", "")))
+	if s := cfg.GetString("/book/back_cover", ""); len(s) > 0 {
+		this.back_cover = cleanBookPath(filepath.ToSlash(s))
+	}
+	this.includes = nil
+	for _, p := range strings.Split(cfg.GetString("/build/include", ""), ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			this.includes = append(this.includes, cleanBookPath(filepath.ToSlash(p)))
+		}
+	}
+	this.image_formats = nil
+	for _, s := range strings.Split(cfg.GetString("/build/allowed_image_formats", ""), ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s == "jpg" {
+			s = "jpeg"
+		}
+		if len(s) > 0 {
+			if this.image_formats == nil {
+				this.image_formats = make(map[string]bool)
+			}
+			this.image_formats[s] = true
+		}
+	}
+	this.content_files = nil
+	for _, p := range strings.Split(cfg.GetString("/build/content_files", ""), ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			this.content_files = append(this.content_files, cleanBookPath(filepath.ToSlash(p)))
+		}
+	}
+	this.spine = nil
+	for _, d := range strings.Split(cfg.GetString("/build/spine", ""), ",") {
+		if d = strings.TrimSpace(d); strings.HasPrefix(d, spine_split_prefix) {
+			d = spine_split_prefix + cleanBookPath(filepath.ToSlash(strings.TrimSpace(d[len(spine_split_prefix):])))
+			this.spine = append(this.spine, d)
+		} else if len(d) > 0 {
+			this.spine = append(this.spine, cleanBookPath(filepath.ToSlash(d)))
+		}
+	}
+	if s := cfg.GetString("/build/notes", ""); len(s) > 0 {
+		this.notes = cleanBookPath(filepath.ToSlash(s))
+	}
+	this.root_cover = cfg.GetBool("/build/cover_at_root", false)
+	this.transcode = cfg.GetBool("/image/transcode_modern", false)
+	this.inline_below = cfg.GetInt("/image/inline_below_bytes", 0)
+	this.split_height = cfg.GetInt("/image/split_height", 0)
+	this.thumbnail_width = cfg.GetInt("/cover/thumbnail_width", 0)
+	if sw, sh := cfg.GetString("/cover/width", ""), cfg.GetString("/cover/height", ""); len(sw) > 0 || len(sh) > 0 {
+		w, ew := strconv.Atoi(sw)
+		h, eh := strconv.Atoi(sh)
+		if ew != nil || eh != nil || w <= 0 || h <= 0 {
+			this.writeWarning("option 'width' and 'height' of section 'cover' must both be positive integers, ignored.")
+		} else {
+			this.book.SetCoverSize(w, h)
+		}
+	}
+
+	if s := cfg.GetString("/build/cover", ""); len(s) > 0 {
+		if ext := strings.ToLower(filepath.Ext(s)); ext != ".html" && ext != ".htm" && ext != ".xhtml" {
+			this.writeWarning("option 'cover' is invalid, will use default value '" + path_of_cover_page + "'.")
+		} else {
+			this.book.SetCoverPage(s)
+		}
+	}
 
 	s := cfg.GetString("/book/id", "")
 	this.book.SetId(s)
 
 	s = cfg.GetString("/book/name", "")
 	if len(s) == 0 {
-		this.writeLog("book name is empty.")
+		this.writeWarning("book name is empty.")
 	}
 	this.book.SetName(s)
 
 	s = cfg.GetString("/book/author", "")
 	if len(s) == 0 {
-		this.writeLog("author name is empty.")
+		this.writeWarning("author name is empty.")
 	}
 	this.book.SetAuthor(s)
 
+	for _, alt := range []struct {
+		option string
+		set    func(string, string)
+	}{
+		{"name_alt", this.book.SetNameAlt},
+		{"author_alt", this.book.SetAuthorAlt},
+	} {
+		if s = strings.TrimSpace(cfg.GetString("/book/"+alt.option, "")); len(s) > 0 {
+			lang := strings.TrimSpace(cfg.GetString("/book/"+alt.option+"_lang", ""))
+			if len(lang) == 0 {
+				this.writeWarning("option '" + alt.option + "_lang' is empty, the language of '" + alt.option + "' is unknown.")
+			}
+			alt.set(s, lang)
+		}
+	}
+
 	s = cfg.GetString("/book/publisher", "")
 	this.book.SetPublisher(s)
 
 	s = cfg.GetString("/book/description", "")
+	if note := cfg.GetString("/build/sample_note", ""); this.sample > 0 && len(note) > 0 {
+		if len(s) > 0 {
+			s += "\n"
+		}
+		s += note
+	}
 	this.book.SetDescription(s)
 
 	s = cfg.GetString("/book/language", "zh-CN")
 	this.book.SetLanguage(s)
 
+	if s = cfg.GetString("/book/series", ""); len(s) > 0 {
+		this.book.SetSeries(s, cfg.GetInt("/book/series_index", this.series_index))
+	}
+
+	this.sign_key = cfg.GetString("/output/sign", "")
+	this.book.SetSmartCompression(cfg.GetBool("/output/smart_compression", true))
+	this.book.SetPrettyXml(cfg.GetBool("/output/pretty_xml", false))
+	if cfg.GetBool("/output/generator_meta", true) {
+		this.book.SetGenerator("makeepub v" + version)
+	}
+
+	names, values := cfg.GetSection("metadata")
+	for _, name := range names {
+		this.book.AddMeta(name, values[name])
+	}
+
 	return nil
 }
 
 func (this *EpubMaker) Process(folder VirtualFolder, duokan bool) error {
+	return this.ProcessContext(context.Background(), folder, duokan)
+}
+
+// ProcessContext is the same as 'Process', but the build can be canceled by
+// 'ctx', it is checked between files and ctx.Err() is returned if canceled
+func (this *EpubMaker) ProcessContext(ctx context.Context, folder VirtualFolder, duokan bool) error {
+	this.ctx = ctx
 	this.folder = folder
 	this.book = NewEpub(duokan)
 
@@ -399,7 +2043,32 @@ func (this *EpubMaker) Process(folder VirtualFolder, duokan bool) error {
 		return e
 	}
 
-	if root, e := this.parseBook(); e != nil {
+	if len(this.spine) > 0 {
+		if len(this.content_files) > 0 {
+			this.writeWarning("option 'content_files' is ignored because option 'spine' is specified.")
+			this.content_files = nil
+		}
+	} else if len(this.content_files) == 0 {
+		this.detectContentFiles()
+	}
+
+	if e := this.loadFiles(); e != nil {
+		this.writeLog(e.Error())
+		this.writeLog("failed to load files.")
+		return e
+	}
+
+	if len(this.base_style) > 0 {
+		this.addBaseStyleSheet()
+	}
+
+	if len(this.spine) > 0 {
+		if e := this.composeSpine(); e != nil {
+			this.writeLog(e.Error())
+			this.writeLog("failed to compose the spine.")
+			return e
+		}
+	} else if root, e := this.parseBook(); e != nil {
 		this.writeLog(e.Error())
 		this.writeLog("failed to parse 'book.html'.")
 		return e
@@ -407,20 +2076,114 @@ func (this *EpubMaker) Process(folder VirtualFolder, duokan bool) error {
 		this.splitChapter(root)
 	}
 
+	if this.number_chapters {
+		this.numberChapters()
+	}
+
+	if this.track_mtime {
+		this.addChapterMtimes()
+	}
+
+	if e := this.ctx.Err(); e != nil {
+		this.writeLog("build canceled.")
+		return e
+	}
+
+	if this.truncated {
+		body, style := "	<p>"+html.EscapeString(this.sample_text)+"</p>", ""
+		if len(this.base_style) > 0 {
+			style = path_of_base_style
+		}
+		this.book.AddChapter(nil, generateTextPage(this.sample_text, style, body))
+	}
+
 	if e := this.addFilesToBook(); e != nil {
 		this.writeLog(e.Error())
 		this.writeLog("failed to add files to book.")
 		return e
 	}
 
-	return nil
+	if len(this.colophon) > 0 {
+		if this.book.FindFile(path_of_colophon) != nil {
+			this.writeWarning("colophon is not generated, because '" + path_of_colophon + "' already exists.")
+		} else {
+			this.book.AddColophon(this.colophon)
+		}
+	}
+
+	if len(this.back_cover) > 0 {
+		this.addBackCover()
+	}
+
+	if len(this.title_page) > 0 || this.auto_title {
+		this.addTitlePage()
+	}
+
+	if this.split_height > 0 {
+		if this.book.FixedLayout() {
+			this.splitTallImages()
+		} else {
+			this.writeWarning("option 'split_height' only works with fixed layout, ignored.")
+		}
+	}
+
+	if this.book.FixedLayout() {
+		this.addViewports()
+	}
+
+	if this.thumbnail_width > 0 {
+		this.addCoverThumbnail()
+	}
+
+	if this.inline_below > 0 {
+		this.inlineSmallImages()
+	}
+
+	if this.search_index {
+		this.addSearchIndex()
+	}
+
+	if this.count {
+		n := this.countWords()
+		this.book.AddLegacyMeta("calibre:word_count", strconv.Itoa(n))
+		if isCjkLanguage(this.book.Language()) {
+			this.writeLog(fmt.Sprintf("%d characters in total.", n))
+		} else {
+			this.writeLog(fmt.Sprintf("%d words in total.", n))
+		}
+	}
+
+	if this.minify {
+		this.writeInfo(fmt.Sprintf("html minified, %d bytes saved.", this.saved))
+	}
+
+	for _, msg := range this.book.Validate() {
+		this.validation = append(this.validation, msg)
+		this.writeWarning(msg)
+	}
+
+	return this.checkStrict()
+}
+
+// checkStrict returns an error if there are warnings in strict mode
+func (this *EpubMaker) checkStrict() error {
+	if !this.strict || this.warnings == 0 {
+		return nil
+	}
+	this.writeLog(fmt.Sprintf("%d warning(s), aborted in strict mode.", this.warnings))
+	return fmt.Errorf("%d warning(s) in strict mode", this.warnings)
+}
+
+// SetStrict sets whether warnings are regarded as errors
+func (this *EpubMaker) SetStrict(strict bool) {
+	this.strict = strict
 }
 
 func (this *EpubMaker) SaveTo(outdir string, version int) error {
 	path := this.output_path
 	if len(path) == 0 {
-		this.writeLog("output path is empty, no file will be created.")
-		return nil
+		this.writeWarning("output path is empty, no file will be created.")
+		return this.checkStrict()
 	}
 
 	if len(outdir) != 0 {
@@ -428,12 +2191,87 @@ func (this *EpubMaker) SaveTo(outdir string, version int) error {
 		path = filepath.Join(outdir, path)
 	}
 
-	if e := this.book.Save(path, version); e != nil {
+	version = this.checkVersion(version)
+	if this.unpacked {
+		// the folder has the same name as the book, but without extension
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+		if e := this.book.SaveUnpacked(path, version); e != nil {
+			this.writeLog("failed to create output folder.")
+			return e
+		}
+	} else if e := this.book.Save(path, version); e != nil {
 		this.writeLog("failed to create output file.")
 		return e
 	}
 
-	this.writeLog("output file created at '" + path + "'.")
+	this.output = path
+	this.writeInfo("output file created at '" + path + "'.")
+
+	if len(this.sign_key) > 0 {
+		if this.unpacked {
+			this.writeWarning("the book is not signed, because it is written to a folder.")
+		} else if e := signFile(path, this.sign_key); e != nil {
+			this.writeLog("failed to sign the output file: " + e.Error())
+			return e
+		} else {
+			this.writeInfo("signature created at '" + path + ".sig'.")
+		}
+	}
+
+	if this.opds {
+		if e := this.saveOpdsEntry(path); e != nil {
+			return e
+		}
+	}
+
+	if len(this.post_command) > 0 {
+		return this.runPostCommand(path)
+	}
+	return nil
+}
+
+// saveOpdsEntry saves the OPDS entry of the book next to the output file
+func (this *EpubMaker) saveOpdsEntry(output string) error {
+	path := strings.TrimSuffix(output, filepath.Ext(output)) + ".opds.xml"
+	_, name := filepath.Split(output)
+	href := (&url.URL{Path: name}).EscapedPath()
+	if e := ioutil.WriteFile(path, this.book.GenerateOpdsEntry(href), 0666); e != nil {
+		this.writeLog("failed to create OPDS entry.")
+		return e
+	}
+	this.writeInfo("OPDS entry created at '" + path + "'.")
+	return nil
+}
+
+// checkPostCommand warns that option 'post_command' in 'cfg', which is loaded
+// from file 'name', is ignored
+func (this *EpubMaker) checkPostCommand(cfg *Config, name string) {
+	if len(cfg.GetString("/output/post_command", "")) > 0 {
+		this.writeWarning("option 'post_command' in '" + name + "' is ignored, it is only allowed in the global configuration file or the file specified by '-config'.")
+	}
+}
+
+// runPostCommand runs the post build command, '{output}' in the command is
+// replaced by the path of the output file. The command is not run by a shell,
+// so arguments are separated by white spaces and cannot be quoted.
+func (this *EpubMaker) runPostCommand(output string) error {
+	args := strings.Fields(this.post_command)
+	for i := range args {
+		args[i] = strings.Replace(args[i], "{output}", output, -1)
+	}
+
+	this.writeInfo("running post build command '" + strings.Join(args, " ") + "'.")
+	out, e := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if e != nil {
+		if len(out) > 0 {
+			this.writeLog("output of post build command:\n" + string(out))
+		}
+		this.writeLog("post build command failed: " + e.Error())
+		return e
+	}
+	if len(out) > 0 {
+		this.writeInfo("output of post build command:\n" + string(out))
+	}
 	return nil
 }
 
@@ -445,10 +2283,19 @@ func (this *EpubMaker) GetResult(ver int) ([]byte, string, error) {
 		path = "book.epub"
 	}
 
-	data, e := this.book.Build(ver)
+	data, e := this.book.Build(this.checkVersion(ver))
 	return data, path, e
 }
 
+// checkVersion returns the epub version to use, kindle mode requires EPUB2
+func (this *EpubMaker) checkVersion(version int) int {
+	if this.kindle && version == EPUB_VERSION_300 {
+		this.writeInfo("kindle mode is enabled, EPUB2 is used.")
+		return EPUB_VERSION_200
+	}
+	return version
+}
+
 func RunMake() {
 	duokan := !getFlagBool("noduokan")
 	ver := EPUB_VERSION_300
@@ -457,14 +2304,30 @@ func RunMake() {
 	}
 
 	maker := NewEpubMaker(logger)
+	maker.SetLogLevel(getLogLevel())
+	maker.SetConfigFile(getFlagValue("config", ""))
+	maker.SetGlobalConfigFile(getGlobalConfigPath())
+	maker.SetOpds(getFlagBool("opds"))
+	maker.SetStrict(getFlagBool("strict"))
+	maker.SetUnpacked(getFlagBool("unpacked"))
+	maker.SetRequireUtf8(getFlagBool("require-utf8"))
+	// debug messages would break the progress bar
+	maker.SetProgress(!getFlagBool("quiet") && getLogLevel() < log_DEBUG && isTerminal(os.Stdout))
 
 	if inpath := getArg(0, ""); len(inpath) == 0 {
 		onCommandLineError()
-	} else if folder, e := OpenVirtualFolder(inpath); e != nil {
+	} else if folder, e := OpenBookFolder(inpath); e != nil {
 		logger.Fatalf("%s: failed to open source folder/file.\n", inpath)
-	} else if maker.Process(folder, duokan) != nil {
-		os.Exit(1)
-	} else if maker.SaveTo(getArg(1, ""), ver) != nil {
-		os.Exit(1)
+	} else {
+		e := maker.Process(folder, duokan)
+		if e == nil {
+			e = maker.SaveTo(getArg(1, ""), ver)
+		}
+		if report := getFlagValue("report", ""); len(report) > 0 {
+			maker.SaveReport(report, e == nil)
+		}
+		if e != nil {
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger discards the messages of the makers in tests
+var testLogger = log.New(ioutil.Discard, "", 0)
+
+// makeBook processes the source files in 'files', whose keys are paths and
+// values are contents, it fails the test if the book cannot be created
+func makeBook(t *testing.T, files map[string]string) *EpubMaker {
+	t.Helper()
+	data := make(map[string][]byte)
+	for p, s := range files {
+		data[p] = []byte(s)
+	}
+	maker := NewEpubMaker(testLogger)
+	if e := maker.Process(NewMemoryFolder(data), false); e != nil {
+		t.Fatalf("failed to create the book: %s", e)
+	}
+	return maker
+}
+
+// buildArchive builds 'book' as an epub file of 'version' and opens it
+func buildArchive(t *testing.T, book *Epub, version int) *zip.Reader {
+	t.Helper()
+	data, e := book.Build(version)
+	if e != nil {
+		t.Fatalf("failed to build the book: %s", e)
+	}
+	zr, e := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if e != nil {
+		t.Fatalf("failed to open the book: %s", e)
+	}
+	return zr
+}
+
+// findEntry returns entry 'name' of 'zr', or nil if it does not exist
+func findEntry(zr *zip.Reader, name string) *zip.File {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// readEntry returns the content of entry 'name' of 'zr', it fails the test if
+// the entry does not exist
+func readEntry(t *testing.T, zr *zip.Reader, name string) string {
+	t.Helper()
+	f := findEntry(zr, name)
+	if f == nil {
+		t.Fatalf("'%s' does not exist in the book", name)
+	}
+	rc, e := f.Open()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer rc.Close()
+	data, e := ioutil.ReadAll(rc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return string(data)
+}
+
+// assertWellFormed fails the test if 'data' of file 'name' is not well-formed
+// xml
+func assertWellFormed(t *testing.T, name, data string) {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	for {
+		_, e := decoder.Token()
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			t.Errorf("'%s' is not well-formed: %s\n%s", name, e, data)
+			return
+		}
+	}
+}
+
+var reTestSrc = regexp.MustCompile(`src="([^"]+)"`)
+
+func TestContentDirReferences(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":     "[book]\nname=Test\nauthor=Tester\n[output]\ncontent_dir=OEBPS\n",
+		"book.html":    "<html><head></head><body><h1>One</h1><p><img src=\"../images/x.jpg\"/></p></body></html>",
+		"images/x.jpg": "jpeg",
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+
+	if s := readEntry(t, zr, "META-INF/container.xml"); !strings.Contains(s, "full-path=\"OEBPS/content.opf\"") {
+		t.Errorf("container does not reference 'OEBPS/content.opf':\n%s", s)
+	}
+	readEntry(t, zr, "OEBPS/content.opf")
+
+	chapter := "OEBPS/" + maker.book.ContentFiles()[0].Path
+	m := reTestSrc.FindStringSubmatch(readEntry(t, zr, chapter))
+	if m == nil {
+		t.Fatalf("the image is missing in '%s'", chapter)
+	}
+	if p := path.Join(path.Dir(chapter), m[1]); findEntry(zr, p) == nil {
+		t.Errorf("reference '%s' of '%s' resolves to '%s', which does not exist", m[1], chapter, p)
+	}
+}
+
+func TestStripOrderPrefix(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":           "[book]\nname=Test\nauthor=Tester\n[build]\nstrip_order_prefix=true\n",
+		"2-b.html":           "<html><head></head><body><h1>B</h1></body></html>",
+		"10-c.html":          "<html><head></head><body><h1>C</h1></body></html>",
+		"1-a.html":           "<html><head><link rel=\"stylesheet\" href=\"css/10_a.css\"/></head><body><h1>A</h1><p><a href=\"notes/3_note.xhtml\">note</a></p></body></html>",
+		"css/10_a.css":       "p {}",
+		"css/2_b.css":        "h1 {}",
+		"notes/3_note.xhtml": "<html><head><link rel=\"stylesheet\" href=\"../css/2_b.css\"/></head><body><p>note</p></body></html>",
+	})
+
+	var titles []string
+	for _, f := range maker.book.ContentFiles() {
+		for _, c := range f.Chapters {
+			titles = append(titles, c.Title)
+		}
+	}
+	if s := strings.Join(titles, ","); s != "A,B,C" {
+		t.Errorf("reading order is '%s', want 'A,B,C'", s)
+	}
+
+	var names []string
+	for _, f := range maker.book.Files() {
+		if (f.Attr & epub_CONTENT_FILE) == 0 {
+			names = append(names, f.Path)
+		}
+	}
+	if s := strings.Join(names, ","); s != "css/b.css,notes/note.xhtml,css/a.css" {
+		t.Errorf("manifest order is '%s', want 'css/b.css,notes/note.xhtml,css/a.css'", s)
+	}
+
+	chapter := string(maker.book.ContentFiles()[0].Data)
+	if !strings.Contains(chapter, "href=\"css/a.css\"") || !strings.Contains(chapter, "href=\"notes/note.xhtml\"") {
+		t.Errorf("references in the chapter are not updated:\n%s", chapter)
+	}
+	if note := string(maker.book.FindFile("notes/note.xhtml").Data); !strings.Contains(note, "href=\"../css/b.css\"") {
+		t.Errorf("references in other html files are not updated:\n%s", note)
+	}
+}
+
+func TestSortByOrderPrefix(t *testing.T) {
+	names := []string{"10-c.html", "intro.html", "2-b.html", "1-a.html"}
+	sortByOrderPrefix(names)
+	if s := strings.Join(names, ","); s != "1-a.html,intro.html,2-b.html,10-c.html" {
+		t.Errorf("got '%s', want '1-a.html,intro.html,2-b.html,10-c.html'", s)
+	}
+}
+
+// hasWarning reports whether a warning of 'maker' contains 's'
+func hasWarning(maker *EpubMaker, s string) bool {
+	for _, msg := range maker.messages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChapterNamePattern(t *testing.T) {
+	const content = "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>"
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\nchapter_name_pattern=chapter-{n}.xhtml\n",
+		"book.html": content,
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	opf, nav := readEntry(t, zr, "content.opf"), readEntry(t, zr, "nav.xhtml")
+	for _, name := range []string{"chapter-1.xhtml", "chapter-2.xhtml"} {
+		f := findEntry(zr, name)
+		if f == nil {
+			t.Errorf("'%s' does not exist in the book", name)
+		}
+		if !strings.Contains(opf, "href=\""+name+"\"") {
+			t.Errorf("'%s' is not in the manifest", name)
+		}
+		if !strings.Contains(nav, "href=\""+name+"#") {
+			t.Errorf("'%s' is not in the TOC", name)
+		}
+	}
+
+	// chapters in another folder would break the relative references
+	maker = makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\nchapter_name_pattern=chapters/{n}.xhtml\n",
+		"book.html": content,
+	})
+	if !hasWarning(maker, "option 'chapter_name_pattern' is invalid") {
+		t.Errorf("pattern with a folder is not rejected")
+	}
+	for _, f := range maker.book.ContentFiles() {
+		if strings.Contains(f.Path, "/") {
+			t.Errorf("chapter '%s' is not in the root folder", f.Path)
+		}
+	}
+}
+
+// chapterTitles returns the titles of the chapters of 'maker' in each content
+// file, titles in a file are separated by '+'
+func chapterTitles(maker *EpubMaker) string {
+	var files []string
+	for _, f := range maker.book.ContentFiles() {
+		var titles []string
+		for _, c := range f.Chapters {
+			titles = append(titles, c.Title)
+		}
+		files = append(files, strings.Join(titles, "+"))
+	}
+	return strings.Join(files, ",")
+}
+
+func TestSplitLevels(t *testing.T) {
+	files := map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\ntoc=3\nsplit_levels=1,3\n",
+		"book.html": "<html><head></head><body><h1>A</h1><p>a</p><h2>B</h2><p>b</p><h3>C</h3><p>c</p><h1>D</h1><p>d</p></body></html>",
+	}
+	maker := makeBook(t, files)
+	if s := chapterTitles(maker); s != "A,C,D" {
+		t.Errorf("chapters are '%s', want 'A,C,D'", s)
+	}
+
+	files["book.ini"] = "[book]\nname=Test\nauthor=Tester\ntoc=3\nsplit_levels=1,7\n"
+	maker = makeBook(t, files)
+	if !hasWarning(maker, "option 'split_levels' is invalid") {
+		t.Errorf("level 7 is not rejected")
+	}
+	if s := chapterTitles(maker); s != "A+B+C,D" {
+		t.Errorf("chapters are '%s', want 'A+B+C,D'", s)
+	}
+}
+
+func TestStyleSheet(t *testing.T) {
+	files := map[string]string{
+		"book.ini":       "[book]\nname=Test\nauthor=Tester\n[build]\nstylesheet=css/global.css\n",
+		"book.html":      "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"css/global.css": "p {}",
+	}
+	for _, head := range []string{"", "<link rel=\"stylesheet\" href=\"css/global.css\"/>"} {
+		files["book.html"] = "<html><head>" + head + "</head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>"
+		maker := makeBook(t, files)
+		for _, f := range maker.book.ContentFiles() {
+			if n := strings.Count(string(f.Data), "href=\"css/global.css\""); n != 1 {
+				t.Errorf("'%s' links the style sheet %d times, want once", f.Path, n)
+			}
+		}
+		opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+		if n := strings.Count(opf, "href=\"css/global.css\""); n != 1 {
+			t.Errorf("the style sheet is in the manifest %d times, want once", n)
+		}
+	}
+}
+
+func TestNormalizeCharset(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\nchapter_name_pattern=chapter_{n}.xhtml\n",
+		"book.html": "<?xml version=\"1.0\" encoding=\"gbk\"?>\n<html><head>" +
+			"<meta http-equiv=\"Content-Type\" content=\"text/html; charset=gbk\"/><meta charset=\"gb2312\"/>" +
+			"</head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	s := string(maker.book.ContentFiles()[0].Data)
+	if !strings.HasPrefix(s, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n") {
+		t.Errorf("xml declaration is not rewritten:\n%s", s)
+	}
+	if strings.Count(s, "<?xml") != 1 {
+		t.Errorf("the original xml declaration is kept:\n%s", s)
+	}
+	if strings.Contains(s, "gbk") || strings.Contains(s, "gb2312") {
+		t.Errorf("conflicting charset is kept:\n%s", s)
+	}
+	if strings.Count(s, "<meta charset=\"utf-8\"/>") != 1 {
+		t.Errorf("charset is not declared as 'utf-8' once:\n%s", s)
+	}
+}
+
+func TestSemantics(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\nchapter_name_pattern=chapter-{n}.html\nbody_epub_type=true\n[semantics]\nchapter-1.html=preface\n",
+		"book.html": "<html><head></head><body><h1>Preface</h1><p>0</p><h1>One</h1><p>1</p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	if len(files) != 2 {
+		t.Fatalf("got %d content files, want 2", len(files))
+	}
+	for i, typ := range []string{"preface", "bodymatter"} {
+		if files[i].Type != typ {
+			t.Errorf("type of '%s' is '%s', want '%s'", files[i].Path, files[i].Type, typ)
+		}
+		if !strings.Contains(string(files[i].Data), "<body epub:type=\""+typ+"\">") {
+			t.Errorf("body of '%s' is not of type '%s':\n%s", files[i].Path, typ, files[i].Data)
+		}
+	}
+
+	nav := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "nav.xhtml")
+	if !strings.Contains(nav, "epub:type=\"preface\" href=\"chapter-1.html\"") {
+		t.Errorf("the preface is not in the landmarks:\n%s", nav)
+	}
+}
+
+func TestHeaderFooterTemplates(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":    "[book]\nname=Test\nauthor=Tester\n[build]\nheader_html=<div class=\"header\">{title}</div>\nfooter_html=@footer.html\n",
+		"book.html":   "<html><head></head><body><h1>One &amp; Only</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"footer.html": "<div class=\"footer\">- {title} -</div>",
+	})
+	files := maker.book.ContentFiles()
+	if len(files) != 2 {
+		t.Fatalf("got %d content files, want 2", len(files))
+	}
+	for i, title := range []string{"One &amp; Only", "Two"} {
+		s := string(files[i].Data)
+		header := "<body><div class=\"header\">" + title + "</div>"
+		if !strings.Contains(s, header) {
+			t.Errorf("header of '%s' is not '%s':\n%s", files[i].Path, header, s)
+		}
+		footer := "<div class=\"footer\">- " + title + " -</div></body>"
+		if !strings.Contains(s, footer) {
+			t.Errorf("footer of '%s' is not '%s':\n%s", files[i].Path, footer, s)
+		}
+	}
+}
+
+func TestSampleChapters(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[split]\nAtLevel=2\n[build]\nsample_chapters=2\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>A</h1><p>a</p><h2>A1</h2><p>a1</p>" +
+			"<h1>B</h1><p>b</p><h2>B1</h2><p>b1</p><h2>B2</h2><p>b2</p>" +
+			"<h1>C</h1><p>c</p><h2>C1</h2><p>c1</p>" +
+			"</body></html>",
+	})
+	files := maker.book.ContentFiles()
+	if s := chapterTitles(maker); s != "A,A1,B,B1,B2," {
+		t.Errorf("chapters are '%s', want 'A,A1,B,B1,B2,'", s)
+	}
+	if s := string(files[len(files)-1].Data); !strings.Contains(s, "End of sample") {
+		t.Errorf("the last page is not the 'end of sample' page:\n%s", s)
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+	maker := NewEpubMaker(testLogger)
+	e := maker.Process(NewMemoryFolder(map[string][]byte{
+		"book.ini":         []byte("[book]\nname=Test\nauthor=Tester\n"),
+		"book.html":        []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+		"images/Cover.jpg": []byte("jpeg"),
+		"images/cover.jpg": []byte("jpeg"),
+	}), false)
+	if e == nil || !strings.Contains(e.Error(), "conflicts with") {
+		t.Errorf("case-colliding paths are not rejected, error is '%v'", e)
+	}
+}
+
+func TestCssVars(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":      "[book]\nname=Test\nauthor=Tester\n[css_vars]\nfont-family=serif\n",
+		"book.html":     "<html><head><link rel=\"stylesheet\" href=\"css/main.css\"/></head><body><h1>One</h1><p>{{font-family}}</p></body></html>",
+		"css/main.css":  "body { font-family: {{font-family}}; color: {{unknown}}; }",
+		"notes/a.txt":   "{{font-family}}",
+		"notes/b.xhtml": "<html><head></head><body><p>{{font-family}}</p></body></html>",
+	})
+	if s := string(maker.book.FindFile("css/main.css").Data); s != "body { font-family: serif; color: {{unknown}}; }" {
+		t.Errorf("css is '%s', want 'body { font-family: serif; color: {{unknown}}; }'", s)
+	}
+	if s := string(maker.book.FindFile("notes/a.txt").Data); s != "{{font-family}}" {
+		t.Errorf("text file is changed to '%s'", s)
+	}
+	if s := string(maker.book.FindFile("notes/b.xhtml").Data); !strings.Contains(s, "{{font-family}}") {
+		t.Errorf("html file is changed:\n%s", s)
+	}
+	if s := string(maker.book.ContentFiles()[0].Data); !strings.Contains(s, "<p>{{font-family}}</p>") {
+		t.Errorf("chapter is changed:\n%s", s)
+	}
+}
+
+func TestNotesAnchors(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":   "[book]\nname=Test\nauthor=Tester\n[build]\nnotes=notes.html\n",
+		"book.html":  "<html><head></head><body><h1>One</h1><p><a href=\"notes.html#n1\">1</a><a href=\"notes.html#n2\">2</a></p></body></html>",
+		"notes.html": "<html><head></head><body><p id=\"n1\">note 1</p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	if last := files[len(files)-1]; last.Path != "notes.html" || last.Type != "endnotes" {
+		t.Errorf("the last content file is '%s' of type '%s', want 'notes.html' of type 'endnotes'", last.Path, last.Type)
+	}
+	if !hasWarning(maker, "missing anchor 'n2' in 'notes.html'") {
+		t.Errorf("missing anchor 'n2' is not reported")
+	}
+	if hasWarning(maker, "missing anchor 'n1'") {
+		t.Errorf("existing anchor 'n1' is reported as missing")
+	}
+}
+
+func TestPageBreakBefore(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\npage_break_before=true\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p><h1 style=\"page-break-before: avoid\">Two</h1><p>2</p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	if len(files) != 2 {
+		t.Fatalf("got %d content files, want 2", len(files))
+	}
+	for i, want := range []int{1, 0} {
+		s := string(files[i].Data)
+		if n := strings.Count(s, "."+makeepub_page_break+" {"); n != 1 {
+			t.Errorf("'%s' has %d page break rules, want 1:\n%s", files[i].Path, n, s)
+		}
+		if n := strings.Count(s, "class=\""+makeepub_page_break+"\""); n != want {
+			t.Errorf("'%s' has %d page break classes, want %d:\n%s", files[i].Path, n, want, s)
+		}
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	files := map[string][]byte{
+		"book.ini":  []byte("[book]\nname=Test\n"),
+		"book.html": []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+	}
+	maker := NewEpubMaker(testLogger)
+	if e := maker.Process(NewMemoryFolder(files), false); e != nil {
+		t.Fatalf("warnings are errors in lenient mode: %s", e)
+	}
+	if maker.warnings == 0 {
+		t.Fatalf("empty author is not warned")
+	}
+
+	maker = NewEpubMaker(testLogger)
+	maker.SetStrict(true)
+	if e := maker.Process(NewMemoryFolder(files), false); e == nil || !strings.Contains(e.Error(), "strict mode") {
+		t.Errorf("warnings are not errors in strict mode, error is '%v'", e)
+	}
+
+	files["book.ini"] = []byte("[book]\nname=Test\nauthor=Tester\n")
+	maker = NewEpubMaker(testLogger)
+	maker.SetStrict(true)
+	if e := maker.Process(NewMemoryFolder(files), false); e != nil {
+		t.Errorf("failed in strict mode without warnings: %s", e)
+	}
+}
+
+func TestMismatchedHeadings(t *testing.T) {
+	files := map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p>\n<h1 class=\"t\">Two</h2><p>2</p>\n<h2>Three</h2><p>3</p></body></html>",
+	}
+	maker := makeBook(t, files)
+	if !hasWarning(maker, "'book.html' line 2: <h1> is closed by </h2>") {
+		t.Errorf("no warning for the mismatched heading, messages are:\n%s", strings.Join(maker.messages, "\n"))
+	}
+	if maker.warnings != 1 {
+		t.Errorf("got %d warnings, want 1", maker.warnings)
+	}
+	// the heading is regarded as the level of the start tag
+	if s := chapterTitles(maker); s != "One,Two+Three" {
+		t.Errorf("chapters are '%s', want 'One,Two+Three'", s)
+	}
+
+	data := make(map[string][]byte)
+	for p, s := range files {
+		data[p] = []byte(s)
+	}
+	maker = NewEpubMaker(testLogger)
+	maker.SetStrict(true)
+	if e := maker.Process(NewMemoryFolder(data), false); e == nil {
+		t.Errorf("the mismatched heading is accepted in strict mode")
+	}
+}
+
+// chapterLevels returns the titles & levels of the TOC items of 'maker'
+func chapterLevels(maker *EpubMaker) string {
+	var items []string
+	for _, f := range maker.book.ContentFiles() {
+		for _, c := range f.Chapters {
+			items = append(items, c.Title+":"+strconv.Itoa(c.Level))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func TestSkipEmptyChapters(t *testing.T) {
+	files := map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[split]\nAtLevel=2\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>A</h1><p>a</p><h2>A1</h2><h2>A2</h2><p>a2</p>" +
+			"<h1>B</h1><h1>C</h1><p>c</p></body></html>",
+	}
+	maker := makeBook(t, files)
+	if s := chapterLevels(maker); s != "A:1,A1:2,A2:2,B:1,C:1" {
+		t.Errorf("TOC is '%s' by default, want 'A:1,A1:2,A2:2,B:1,C:1'", s)
+	}
+	if n := len(maker.book.ContentFiles()); n != 5 {
+		t.Errorf("got %d content files by default, want 5", n)
+	}
+
+	files["book.ini"] += "[build]\nskip_empty_chapters=true\n"
+	maker = makeBook(t, files)
+	if s := chapterLevels(maker); s != "A:1,A2:2,C:1" {
+		t.Errorf("TOC is '%s', want 'A:1,A2:2,C:1'", s)
+	}
+	if n := len(maker.book.ContentFiles()); n != 3 {
+		t.Errorf("got %d content files, want 3", n)
+	}
+}
+
+func TestPromoteChapters(t *testing.T) {
+	maker := &EpubMaker{}
+	maker.dropChapters([]Chapter{{Level: 1}, {Level: 2}})
+	chapters := maker.promoteChapters([]Chapter{{Level: 3}, {Level: 4}, {Level: 2}, {Level: 1}})
+	var levels []string
+	for _, c := range chapters {
+		levels = append(levels, strconv.Itoa(c.Level))
+	}
+	// children of the dropped items are promoted until a sibling of them
+	if s := strings.Join(levels, ","); s != "1,2,1,1" {
+		t.Errorf("levels are '%s', want '1,2,1,1'", s)
+	}
+}
+
+func TestTitleWhitespace(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>\n\t  Chapter\t\tOne\r\n   is  here \n</h1><p>1</p></body></html>",
+	})
+	if s := chapterTitles(maker); s != "Chapter One is here" {
+		t.Errorf("title is '%s', want 'Chapter One is here'", s)
+	}
+}
+
+func TestTocIndependentOfSplit(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\ntoc=2\n[split]\nAtLevel=3\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>A</h1><p>a</p><h2>A1</h2><p>a1</p><h3>A1a</h3><p>a1a</p><h3>A1b</h3><p>a1b</p>" +
+			"</body></html>",
+	})
+	// level 3 split points create files, but are not in the TOC
+	if n := len(maker.book.ContentFiles()); n != 4 {
+		t.Errorf("got %d content files, want 4", n)
+	}
+	if s := chapterTitles(maker); s != "A,A1,," {
+		t.Errorf("chapters are '%s', want 'A,A1,,'", s)
+	}
+	nav := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "nav.xhtml")
+	if strings.Contains(nav, "A1a") || !strings.Contains(nav, ">A1<") {
+		t.Errorf("the TOC does not only contain level 1 and 2 items:\n%s", nav)
+	}
+	if hasWarning(maker, "option 'toc'") {
+		t.Errorf("warning for a TOC which is not deeper than the split level")
+	}
+}
+
+func TestTocDeeperThanSplit(t *testing.T) {
+	files := map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\ntoc=3\n[split]\nAtLevel=2\n",
+		"book.html": "<html><head></head><body><h1>A</h1><p>a</p><h2>A1</h2><p>a1</p><h3>A1a</h3><p>a1a</p></body></html>",
+	}
+	maker := makeBook(t, files)
+	if !hasWarning(maker, "option 'toc' (3) is greater than 'AtLevel' (2)") {
+		t.Errorf("no warning for a TOC deeper than the split level")
+	}
+
+	// the warning counts in strict mode
+	data := make(map[string][]byte)
+	for p, s := range files {
+		data[p] = []byte(s)
+	}
+	maker = NewEpubMaker(testLogger)
+	maker.SetStrict(true)
+	if e := maker.Process(NewMemoryFolder(data), false); e == nil {
+		t.Errorf("no error in strict mode")
+	}
+
+	// 'split_levels' selects the levels explicitly, so no warning
+	files["book.ini"] += "[book]\nsplit_levels=1,3\n"
+	if maker = makeBook(t, files); hasWarning(maker, "option 'toc'") {
+		t.Errorf("warning for a TOC with 'split_levels'")
+	}
+}
+
+// makeZip returns a zip file of 'files', entries are sorted by name and their
+// modification time is 'mtime'
+func makeZip(t *testing.T, files map[string]string, mtime time.Time) []byte {
+	t.Helper()
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range names {
+		w, e := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime})
+		if e == nil {
+			_, e = w.Write([]byte(files[name]))
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := zw.Close(); e != nil {
+		t.Fatal(e)
+	}
+	return buf.Bytes()
+}
+
+func TestPreserveMtime(t *testing.T) {
+	mtime := time.Date(2020, 5, 6, 7, 8, 10, 0, time.UTC)
+	for _, preserve := range []bool{true, false} {
+		data := makeZip(t, map[string]string{
+			"book.ini":     "[book]\nname=Test\nauthor=Tester\n[output]\npreserve_mtime=" + strconv.FormatBool(preserve) + "\n",
+			"book.html":    "<html><head></head><body><h1>One</h1><p><img src=\"images/a.jpg\"/></p></body></html>",
+			"images/a.jpg": "jpeg",
+		}, mtime)
+		folder, e := NewZipFolder(data)
+		if e != nil {
+			t.Fatal(e)
+		}
+		maker := NewEpubMaker(testLogger)
+		if e = maker.Process(folder, false); e != nil {
+			t.Fatal(e)
+		}
+
+		f := findEntry(buildArchive(t, maker.book, EPUB_VERSION_300), "images/a.jpg")
+		if f == nil {
+			t.Fatalf("'images/a.jpg' does not exist in the book")
+		}
+		if got := f.Modified.Equal(mtime); got != preserve {
+			t.Errorf("preserve_mtime=%v: modification time of the entry is %v, source is %v", preserve, f.Modified, mtime)
+		}
+	}
+}
+
+func TestContentFilesLinks(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\ncontent_files=part1.html,part2.html\n",
+		"part1.html": "<html><head></head><body><h1>One</h1>" +
+			"<p><a href=\"part2.html#x\">x</a> <a href=\"part2.html\">two</a></p></body></html>",
+		"part2.html": "<html><head></head><body><h1>Two</h1><p>two</p>" +
+			"<h1>Three</h1><p id=\"x\">x</p></body></html>",
+	})
+	files := maker.book.ContentFiles()
+	if len(files) != 3 {
+		t.Fatalf("got %d content files, want 3", len(files))
+	}
+	first := string(files[0].Data)
+	if want := "href=\"" + files[2].Path + "#x\""; !strings.Contains(first, want) {
+		t.Errorf("the link to 'part2.html#x' is not '%s':\n%s", want, first)
+	}
+	if want := "href=\"" + files[1].Path + "#makeepub-part-1\""; !strings.Contains(first, want) {
+		t.Errorf("the link to 'part2.html' is not '%s':\n%s", want, first)
+	}
+	if s := string(files[1].Data); !strings.Contains(s, "id=\"makeepub-part-1\"") {
+		t.Errorf("the start of 'part2.html' has no anchor:\n%s", s)
+	}
+	if strings.Contains(first, "part2.html") {
+		t.Errorf("links to 'part2.html' are not rewritten:\n%s", first)
+	}
+}
+
+func TestSharedAssets(t *testing.T) {
+	const head = `<head><link rel="stylesheet" href="../css/book.css"/>`
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\n" +
+			"content_files=chapters/one.html,chapters/two.html,chapters/three.html\n",
+		"chapters/one.html": "<html>" + head + "</head>" +
+			`<body><h1>One</h1><p><img src="../images/a.png"/></p></body></html>`,
+		"chapters/two.html": "<html>" + head + `<style>p { background: url("../images/a.png"); }</style></head>` +
+			`<body><h1>Two</h1><p><img src="../images/a.png"/></p></body></html>`,
+		"chapters/three.html": "<html>" + head + `<style>h1 { background: url(../images/missing.png); }</style></head>` +
+			`<body><h1>Three</h1><p><img src="../images/a.png"/></p></body></html>`,
+		"css/book.css": "body { background: url(../images/a.png); }",
+		"images/a.png": testImage(t, testPng),
+	})
+	if s := chapterTitles(maker); s != "One,Two,Three" {
+		t.Fatalf("chapters are '%s', want 'One,Two,Three'", s)
+	}
+
+	// shared assets are added once
+	count := make(map[string]int)
+	for _, f := range maker.book.Files() {
+		count[f.Path]++
+	}
+	for _, p := range []string{"images/a.png", "css/book.css"} {
+		if count[p] != 1 {
+			t.Errorf("'%s' is added %d times, want once", p, count[p])
+		}
+	}
+
+	// references of every chapter resolve, including the ones in the style
+	// elements moved from the content files
+	for _, f := range maker.book.ContentFiles() {
+		s := string(f.Data)
+		for _, ref := range []string{`href="css/book.css"`, `src="images/a.png"`, `url("images/a.png")`, `url(images/missing.png)`} {
+			if !strings.Contains(s, ref) {
+				t.Errorf("'%s' is not in '%s':\n%s", ref, f.Path, s)
+			}
+		}
+		if n := strings.Count(s, "css/book.css"); n != 1 {
+			t.Errorf("'css/book.css' is linked %d times in '%s'", n, f.Path)
+		}
+	}
+	if !hasWarning(maker, "references a missing file 'images/missing.png'") {
+		t.Errorf("no warning for the missing reference, messages are:\n%s", strings.Join(maker.messages, "\n"))
+	}
+	if hasWarning(maker, "'images/a.png'") || hasWarning(maker, "'css/book.css'") {
+		t.Errorf("shared assets are reported, messages are:\n%s", strings.Join(maker.messages, "\n"))
+	}
+}
+
+func TestUtf8Bom(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": bom + "<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body><h1>One</h1><p>1</p></body></html>",
+		"style.css": bom + "p { margin: 0; }",
+		"a.png":     bom + "png",
+	})
+	for _, f := range maker.book.Files() {
+		if f.Path != "a.png" && strings.Contains(string(f.Data), bom) {
+			t.Errorf("'%s' contains a BOM", f.Path)
+		}
+	}
+	// binary files are not changed
+	if f := maker.book.FindFile("a.png"); f == nil {
+		t.Errorf("'a.png' does not exist in the book")
+	} else if !strings.HasPrefix(string(f.Data), bom) {
+		t.Errorf("the BOM of binary file 'a.png' is removed")
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	for _, c := range []struct{ option, want string }{{"lf", "\n"}, {"crlf", "\r\n"}} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Test\nauthor=Tester\n[build]\nnormalize_newlines=" + c.option + "\n",
+			"book.html": "<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body>\r\n<h1>One</h1>\r\n<p>1\r2</p>\n</body></html>",
+			"style.css": "p {\r\n\tmargin: 0;\n}\r",
+			"a.png":     "png\r\n",
+		})
+		for _, f := range maker.book.Files() {
+			if f.Path == "a.png" {
+				continue
+			}
+			if s := strings.Replace(string(f.Data), c.want, "", -1); strings.ContainsAny(s, "\r\n") {
+				t.Errorf("%s: '%s' has other line breaks:\n%q", c.option, f.Path, f.Data)
+			}
+		}
+		// binary files are not changed
+		if f := maker.book.FindFile("a.png"); f == nil || string(f.Data) != "png\r\n" {
+			t.Errorf("%s: binary file 'a.png' is changed or missing", c.option)
+		}
+	}
+}
+
+// cancelFolder is a folder which calls 'cancel' when file 'path' is opened
+type cancelFolder struct {
+	VirtualFolder
+	path   string
+	cancel func()
+}
+
+func (this *cancelFolder) OpenFile(path string) (io.ReadCloser, error) {
+	if path == this.path {
+		this.cancel()
+	}
+	return this.VirtualFolder.OpenFile(path)
+}
+
+func TestProcessContext(t *testing.T) {
+	files := map[string][]byte{
+		"book.ini":  []byte("[book]\nname=Test\nauthor=Tester\n"),
+		"book.html": []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+	}
+	for i := 0; i < 10; i++ {
+		files["images/"+strconv.Itoa(i)+".jpg"] = []byte("jpeg")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the build is canceled while loading the files
+	folder := &cancelFolder{NewMemoryFolder(files), "images/3.jpg", cancel}
+	maker := NewEpubMaker(testLogger)
+	if e := maker.ProcessContext(ctx, folder, false); e != context.Canceled {
+		t.Fatalf("got error %v, want context.Canceled", e)
+	}
+	for i := 4; i < 10; i++ {
+		if p := "images/" + strconv.Itoa(i) + ".jpg"; maker.book.FindFile(p) != nil {
+			t.Errorf("'%s' is added after the build is canceled", p)
+		}
+	}
+}
+
+func TestDetectContentFiles(t *testing.T) {
+	// a single html file is used as 'book.html'
+	maker := makeBook(t, map[string]string{
+		"book.ini":   "[book]\nname=Test\nauthor=Tester\n",
+		"main.html":  "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"cover.html": "<html><head></head><body><h1>Cover</h1></body></html>",
+	})
+	if s := chapterTitles(maker); s != "One,Two" {
+		t.Errorf("single file: chapters are '%s', want 'One,Two'", s)
+	}
+	if maker.book.FindFile("main.html") != nil {
+		t.Errorf("single file: the main content is also added as is")
+	}
+
+	// several html files are concatenated in name order
+	maker = makeBook(t, map[string]string{
+		"book.ini":     "[book]\nname=Test\nauthor=Tester\n",
+		"b.html":       "<html><head></head><body><h1>Two</h1><p>2</p></body></html>",
+		"a.html":       "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+		"cover.html":   "<html><head></head><body><h1>Cover</h1></body></html>",
+		"extra/c.html": "<html><head></head><body><h1>Three</h1></body></html>",
+	})
+	if s := chapterTitles(maker); s != "One,Two" {
+		t.Errorf("several files: chapters are '%s', want 'One,Two'", s)
+	}
+	if maker.book.FindFile("a.html") != nil || maker.book.FindFile("b.html") != nil {
+		t.Errorf("several files: the main content is also added as is")
+	}
+}
+
+func TestRequireUtf8(t *testing.T) {
+	files := map[string][]byte{
+		"book.ini":  []byte("[book]\nname=Test\nauthor=Tester\n"),
+		"book.html": []byte("<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body><h1>One</h1><p>1</p></body></html>"),
+		"style.css": []byte("p { font-family: \"\xff\"; }"),
+	}
+	for _, require := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		maker := NewEpubMaker(log.New(buf, "", 0))
+		maker.SetRequireUtf8(require)
+		e := maker.Process(NewMemoryFolder(files), false)
+		if !require && e != nil {
+			t.Errorf("the build fails without -require-utf8: %s", e)
+		}
+		if require && e == nil {
+			t.Errorf("the build does not fail with -require-utf8")
+		}
+		// the offending path is reported
+		if got := strings.Contains(buf.String(), "'style.css' is not valid UTF-8"); got != require {
+			t.Errorf("require=%v: messages are:\n%s", require, buf.String())
+		}
+	}
+}
+
+func TestBaseStyle(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\ncolophon=Printed\nback_cover=back.jpg\n" +
+			"[build]\nauto_title_page=true\n[style]\nfont_size=1.1em\nline_height=1.6\n",
+		"book.html":         "<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body><h1>One</h1><p>1</p></body></html>",
+		"style.css":         "p { margin: 0; }",
+		"cover.jpg":         "jpeg",
+		"back.jpg":          "jpeg",
+		"makeepub_base.css": "body { color: red; }",
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	if s := readEntry(t, zr, path_of_base_style); s != "body { font-size: 1.1em; line-height: 1.6; }\n" {
+		t.Errorf("the base style sheet is '%s'", s)
+	}
+	if !hasWarning(maker, "'makeepub_base.css' is a reserved name") {
+		t.Errorf("no warning for the source file with the reserved name")
+	}
+
+	const link = "<link href=\"" + path_of_base_style + "\""
+	for _, name := range []string{"cover.html", path_of_title_page, path_of_colophon, path_of_back_cover} {
+		if s := readEntry(t, zr, name); !strings.Contains(s, link) {
+			t.Errorf("the base style sheet is not linked into '%s':\n%s", name, s)
+		}
+	}
+	// the base style sheet is linked before the author's style sheets
+	chapter := readEntry(t, zr, maker.book.ContentFiles()[1].Path)
+	if i := strings.Index(chapter, link); i == -1 || i > strings.Index(chapter, "style.css") {
+		t.Errorf("the base style sheet is not linked first:\n%s", chapter)
+	}
+}
+
+func TestChapterLanguage(t *testing.T) {
+	for _, c := range []struct{ html, lang, xmlLang string }{
+		{"<html>", "lang=\"fr\"", "xml:lang=\"fr\""},
+		// the language set by the author is kept
+		{"<html lang=\"en-GB\">", "lang=\"en-GB\"", "xml:lang=\"fr\""},
+		{"<html lang=\"en-GB\" xml:lang=\"en-GB\">", "lang=\"en-GB\"", "xml:lang=\"en-GB\""},
+	} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Test\nauthor=Tester\nlanguage=fr\n",
+			"book.html": c.html + "<head></head><body><h1>One</h1><p>1</p></body></html>",
+		})
+		chapter := string(maker.book.ContentFiles()[0].Data)
+		for _, want := range []string{" " + c.lang, c.xmlLang} {
+			if !strings.Contains(chapter, want) {
+				t.Errorf("%s: '%s' is not in the chapter:\n%s", c.html, want, chapter)
+			}
+		}
+		if strings.Count(chapter, " lang=") != 1 || strings.Count(chapter, "xml:lang=") != 1 {
+			t.Errorf("%s: language attributes are duplicated:\n%s", c.html, chapter)
+		}
+	}
+}
+
+func TestNumberChapters(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\ntoc=2\n[build]\nnumber_chapters=true\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>Intro</h1><p>0</p><h2>Scope</h2><p>1</p><h2>Terms</h2><p>2</p><h1>Usage</h1><p>3</p><h2>Setup</h2><p>4</p>" +
+			"</body></html>",
+	})
+	if s, want := chapterTitles(maker), "1. Intro+1.1 Scope+1.2 Terms,2. Usage+2.1 Setup"; s != want {
+		t.Errorf("chapters are '%s', want '%s'", s, want)
+	}
+	// the headers in the content are not changed
+	if s := string(maker.book.ContentFiles()[0].Data); !strings.Contains(s, ">Intro</h1>") {
+		t.Errorf("the header is changed:\n%s", s)
+	}
+}
+
+func TestSlugAnchorIds(t *testing.T) {
+	files := map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\nanchor_ids=slug\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>Café Crème</h1><p>1</p><h1>Café Crème!</h1><p>2</p><h1>第一章</h1><p>3</p>" +
+			"<h1>2024 Notes</h1><p>4</p><h1>Used</h1><p id=\"used\">5</p>" +
+			"</body></html>",
+	}
+	want := []string{"cafe-creme", "cafe-creme-2", "makeepub-chapter-0", "chapter-2024-notes", "used-2"}
+	for i := 0; i < 2; i++ {
+		// ids are stable between builds
+		maker := makeBook(t, files)
+		var ids []string
+		for _, f := range maker.book.ContentFiles() {
+			for _, c := range f.Chapters {
+				ids = append(ids, strings.TrimPrefix(c.Link, "#"))
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Errorf("ids are %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestDebugFileInfo(t *testing.T) {
+	mtime := time.Date(2020, 5, 6, 7, 8, 10, 0, time.UTC)
+	style := strings.Repeat("p { margin: 0; }\n", 100)
+	folder, e := NewZipFolder(makeZip(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head><link rel=\"stylesheet\" href=\"style.css\"/></head><body><h1>One</h1><p>1</p></body></html>",
+		"style.css": style,
+	}, mtime))
+	if e != nil {
+		t.Fatal(e)
+	}
+	buf := new(bytes.Buffer)
+	maker := NewEpubMaker(log.New(buf, "", 0))
+	maker.SetLogLevel(log_DEBUG)
+	if e = maker.Process(folder, false); e != nil {
+		t.Fatal(e)
+	}
+	want := fmt.Sprintf("file 'style.css' added, media type is 'text/css', modified at %s, compression ratio %.1f%%.",
+		mtime.Format("2006-01-02 15:04:05"), compressionRatio([]byte(style))*100)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("'%s' is not in the debug output:\n%s", want, buf.String())
+	}
+}
+
+func TestProgressAnchors(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\nprogress_anchors=2\n",
+		"book.html": "<html><head></head><body>" +
+			"<h1>One</h1><p>1</p><p>2</p><p>3</p><p>4</p><p>5</p><h1>Two</h1><p>6</p><p>7</p>" +
+			"</body></html>",
+	})
+	files := maker.book.ContentFiles()
+	// ids are unique in the book, and the visible text is not changed
+	for i, want := range []string{
+		"<p>1</p><p><a id=\"makeepub-progress-0\"></a>2</p><p>3</p><p><a id=\"makeepub-progress-1\"></a>4</p><p>5</p>",
+		"<p>6</p><p><a id=\"makeepub-progress-2\"></a>7</p>",
+	} {
+		if s := string(files[i].Data); !strings.Contains(s, want) {
+			t.Errorf("anchors of '%s' are not '%s':\n%s", files[i].Path, want, s)
+		}
+	}
+	if n := strings.Count(string(files[0].Data)+string(files[1].Data), "makeepub-progress-"); n != 3 {
+		t.Errorf("got %d anchors, want 3", n)
+	}
+}
+
+func TestPostCommandFromTrustedConfig(t *testing.T) {
+	files := map[string][]byte{
+		"book.ini":  []byte("[book]\nname=Test\nauthor=Tester\n[output]\npost_command=echo {output}\n"),
+		"book.html": []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+	}
+	maker := NewEpubMaker(testLogger)
+	if e := maker.Process(NewMemoryFolder(files), false); e != nil {
+		t.Fatal(e)
+	}
+	// 'book.ini' comes with the book, which may be from an untrusted source
+	if maker.post_command != "" {
+		t.Errorf("post command '%s' of 'book.ini' is not ignored", maker.post_command)
+	}
+	if !hasWarning(maker, "option 'post_command' in 'book.ini' is ignored") {
+		t.Errorf("no warning for the ignored post command")
+	}
+
+	ext := filepath.Join(t.TempDir(), "ext.ini")
+	if e := ioutil.WriteFile(ext, []byte("[output]\npost_command=true {output}\n"), 0666); e != nil {
+		t.Fatal(e)
+	}
+	maker = NewEpubMaker(testLogger)
+	maker.SetConfigFile(ext)
+	if e := maker.Process(NewMemoryFolder(files), false); e != nil {
+		t.Fatal(e)
+	}
+	if maker.post_command != "true {output}" {
+		t.Errorf("post command is '%s', want 'true {output}'", maker.post_command)
+	}
+}
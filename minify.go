@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	block_elements = map[atom.Atom]bool{
+		atom.Html: true, atom.Head: true, atom.Body: true, atom.Title: true,
+		atom.Meta: true, atom.Link: true, atom.Style: true, atom.Script: true,
+		atom.Div: true, atom.P: true, atom.H1: true, atom.H2: true,
+		atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+		atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Dl: true,
+		atom.Dt: true, atom.Dd: true, atom.Table: true, atom.Thead: true,
+		atom.Tbody: true, atom.Tfoot: true, atom.Tr: true, atom.Td: true,
+		atom.Th: true, atom.Caption: true, atom.Blockquote: true, atom.Pre: true,
+		atom.Hr: true, atom.Section: true, atom.Article: true, atom.Aside: true,
+		atom.Header: true, atom.Footer: true, atom.Nav: true, atom.Figure: true,
+		atom.Figcaption: true, atom.Address: true, atom.Form: true,
+	}
+
+	// whitespace in these elements is significant
+	preformatted_elements = map[atom.Atom]bool{
+		atom.Pre: true, atom.Textarea: true, atom.Code: true,
+		atom.Script: true, atom.Style: true,
+	}
+)
+
+func isBlockNode(node *html.Node) bool {
+	return node == nil || node.Type == html.DocumentNode || node.Type == html.DoctypeNode ||
+		(node.Type == html.ElementNode && block_elements[node.DataAtom])
+}
+
+// keepComment reports whether a comment must be kept: conditional comments
+// and the xml declaration (which is parsed as a comment) are required
+func keepComment(data string) bool {
+	return strings.HasPrefix(data, "[if") ||
+		strings.HasPrefix(data, "<![endif") ||
+		strings.HasPrefix(data, "[endif") ||
+		strings.HasPrefix(data, "?")
+}
+
+// minifyHtml removes comments and collapses insignificant white spaces in
+// 'root', content of preformatted elements is not changed. It returns the
+// number of bytes saved.
+func minifyHtml(root *html.Node) int {
+	saved := 0
+
+	var next *html.Node
+	for node := root.FirstChild; node != nil; node = next {
+		next = node.NextSibling
+
+		switch node.Type {
+		case html.CommentNode:
+			if !keepComment(node.Data) {
+				saved += len(node.Data) + len("<!---->")
+				root.RemoveChild(node)
+			}
+
+		case html.TextNode:
+			if !isBlankNode(node) {
+				continue
+			}
+			if isBlockNode(root) && isBlockNode(node.PrevSibling) && isBlockNode(node.NextSibling) {
+				saved += len(node.Data)
+				root.RemoveChild(node)
+			} else if len(node.Data) > 1 {
+				saved += len(node.Data) - 1
+				node.Data = " "
+			}
+
+		case html.ElementNode:
+			if !preformatted_elements[node.DataAtom] {
+				saved += minifyHtml(node)
+			}
+		}
+	}
+
+	return saved
+}
+
+// minifyHtmlFile minifies the html file content in 'data'
+func minifyHtmlFile(data []byte) ([]byte, error) {
+	return processHtmlFile(data, func(root *html.Node) { minifyHtml(root) })
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+)
+
+// buildOmnibus creates the book of every source folder in 'inputs', and
+// combines them into one book in the given order. The metadata of the first
+// book is used for the omnibus, but its name is replaced by 'name' if not
+// empty, or by the series name if the first book belongs to a series.
+func buildOmnibus(inputs []string, name string, duokan bool) (*Epub, error) {
+	omnibus := NewEpub(duokan)
+	omnibus.SetGenerator("makeepub v" + version)
+	for i, input := range inputs {
+		folder, e := OpenBookFolder(input)
+		if e != nil {
+			logger.Printf("%s: failed to open source folder/file.\n", input)
+			return nil, e
+		}
+
+		maker := NewEpubMaker(logger)
+		maker.SetConfigFile(getFlagValue("config", ""))
+		maker.SetGlobalConfigFile(getGlobalConfigPath())
+		maker.SetLogLevel(getLogLevel())
+		maker.SetStrict(getFlagBool("strict"))
+		maker.SetRequireUtf8(getFlagBool("require-utf8"))
+		if e = maker.Process(folder, duokan); e != nil {
+			return nil, e
+		}
+
+		book := maker.book
+		if i == 0 {
+			omnibus.SetName(book.Name())
+			if series, _ := book.Series(); len(series) > 0 {
+				omnibus.SetName(series)
+			}
+			omnibus.SetAuthor(book.Author())
+			omnibus.SetPublisher(book.Publisher())
+			omnibus.SetLanguage(book.Language())
+			if len(book.CoverImage()) > 0 {
+				omnibus.SetCoverImage(fmt.Sprintf("book%02d/%s", i+1, book.CoverImage()))
+			}
+		}
+		omnibus.AppendBook(book, fmt.Sprintf("book%02d", i+1))
+	}
+
+	if len(name) > 0 {
+		omnibus.SetName(name)
+	}
+	return omnibus, nil
+}
+
+// RunOmnibus combines the books of several source folders into one book, the
+// book of every source folder is a top level TOC node.
+//
+// '-omnibus' is a command like '-b' and '-doctor' rather than an option of
+// the create command: it takes the output file and an ordered list of source
+// folders as arguments, while the create command takes only one source and
+// an output folder, and flags like '-name' only make sense for the omnibus.
+func RunOmnibus() {
+	outpath := getArg(0, "")
+	var inputs []string
+	for i := 1; ; i++ {
+		input := getArg(i, "")
+		if len(input) == 0 {
+			break
+		}
+		inputs = append(inputs, input)
+	}
+	if len(outpath) == 0 || len(inputs) < 2 {
+		onCommandLineError()
+	}
+
+	ver := EPUB_VERSION_300
+	if getFlagBool("epub2") {
+		ver = EPUB_VERSION_200
+	}
+
+	omnibus, e := buildOmnibus(inputs, getFlagValue("name", ""), !getFlagBool("noduokan"))
+	if e != nil {
+		logger.Fatalln("failed to create the omnibus.")
+	}
+	for _, msg := range omnibus.Validate() {
+		logger.Println("validation: " + msg)
+	}
+	if e = omnibus.Save(outpath, ver); e != nil {
+		logger.Fatalln("failed to create output file.")
+	}
+	logger.Printf("%s: %d books combined.\n", outpath, len(inputs))
+}
+
+func init() {
+	AddCommandHandler("omnibus", RunOmnibus)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var reTestNavLabel = regexp.MustCompile(`<a href="([^"#]+)[^"]*">([^<]+)</a>`)
+
+func TestBuildOmnibus(t *testing.T) {
+	// the global configuration file must not affect the test
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	var inputs []string
+	for _, b := range []struct{ name, html string }{
+		{"Book A", "<h1>A1</h1><p>1</p><h1>A2</h1><p>2</p>"},
+		{"Book B", "<h1>B1</h1><p>1</p>"},
+	} {
+		input := filepath.Join(dir, b.name)
+		if e := os.Mkdir(input, 0777); e != nil {
+			t.Fatal(e)
+		}
+		files := map[string]string{
+			"book.ini":  "[book]\nname=" + b.name + "\nauthor=Tester\n",
+			"book.html": "<html><head></head><body>" + b.html + "</body></html>",
+		}
+		for p, s := range files {
+			if e := ioutil.WriteFile(filepath.Join(input, p), []byte(s), 0666); e != nil {
+				t.Fatal(e)
+			}
+		}
+		inputs = append(inputs, input)
+	}
+
+	omnibus, e := buildOmnibus(inputs, "Box Set", false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if omnibus.Name() != "Box Set" {
+		t.Errorf("name of the omnibus is '%s', want 'Box Set'", omnibus.Name())
+	}
+	var titles []string
+	for _, f := range omnibus.ContentFiles() {
+		for _, c := range f.Chapters {
+			titles = append(titles, c.Title+":"+filepath.ToSlash(filepath.Dir(f.Path)))
+		}
+	}
+	if s, want := strings.Join(titles, ","), "Book A:book01,A1:book01,A2:book01,Book B:book02,B1:book02"; s != want {
+		t.Errorf("chapters are '%s', want '%s'", s, want)
+	}
+	// chapters of every book are grouped under the node of the book
+	if levels, want := omnibus.tocLevels(), []int{1, 2, 2, 1, 2}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("TOC levels are %v, want %v", levels, want)
+	}
+
+	zr := buildArchive(t, omnibus, EPUB_VERSION_300)
+	nav := readEntry(t, zr, "nav.xhtml")
+	assertWellFormed(t, "nav.xhtml", nav)
+	for _, m := range reTestNavLabel.FindAllStringSubmatch(nav, -1) {
+		if findEntry(zr, m[1]) == nil {
+			t.Errorf("TOC item '%s' links to '%s', which does not exist", m[2], m[1])
+		}
+	}
+}
+
+func TestAppendBookCoverPath(t *testing.T) {
+	book := NewEpub(false)
+	book.SetName("Book A")
+	book.AddFile("images/my cover#1.png", []byte("png"))
+	book.SetCoverImage("images/my cover#1.png")
+
+	omnibus := NewEpub(false)
+	omnibus.AppendBook(book, "book01")
+	f := omnibus.FindFile("book01/" + path_of_part_page)
+	if f == nil {
+		t.Fatal("the part page does not exist")
+	}
+	// the cover path is escaped like other generated references
+	if s := string(f.Data); !strings.Contains(s, "src=\"images/my%20cover%231.png\"") {
+		t.Errorf("the cover image is not referenced by an escaped path:\n%s", s)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"time"
+)
+
+// GenerateOpdsEntry generates an OPDS acquisition entry of the book, 'href'
+// is the link to the epub file, it is relative to the entry file in most case
+func (this *Epub) GenerateOpdsEntry(href string) []byte {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n" +
+		"<entry xmlns=\"http://www.w3.org/2005/Atom\" xmlns:dc=\"http://purl.org/dc/terms/\">\n")
+	fmt.Fprintf(buf, "	<id>%s</id>\n"+
+		"	<title>%s</title>\n"+
+		"	<author>\n		<name>%s</name>\n	</author>\n"+
+		"	<updated>%s</updated>\n"+
+		"	<dc:language>%s</dc:language>\n",
+		html.EscapeString(this.Id()),
+		html.EscapeString(this.Name()),
+		html.EscapeString(this.Author()),
+		time.Now().UTC().Format(time.RFC3339),
+		html.EscapeString(this.Language()),
+	)
+
+	if len(this.Publisher()) > 0 {
+		fmt.Fprintf(buf, "	<dc:publisher>%s</dc:publisher>\n", html.EscapeString(this.Publisher()))
+	}
+	if len(this.Description()) > 0 {
+		fmt.Fprintf(buf, "	<summary>%s</summary>\n", html.EscapeString(this.Description()))
+	}
+
+	fmt.Fprintf(buf, "	<link rel=\"http://opds-spec.org/acquisition\" href=\"%s\" type=\"application/epub+zip\"/>\n",
+		html.EscapeString(href))
+	buf.WriteString("</entry>\n")
+
+	return buf.Bytes()
+}
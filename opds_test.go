@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestGenerateOpdsEntry(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=A <B> & C\nauthor=Tester\npublisher=P & Q\ndescription=About <it>\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	data := maker.book.GenerateOpdsEntry("a&b.epub")
+
+	var entry struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom entry"`
+		Id      string   `xml:"id"`
+		Title   string   `xml:"title"`
+		Author  string   `xml:"author>name"`
+		Updated string   `xml:"updated"`
+		Summary string   `xml:"summary"`
+		Lang    string   `xml:"http://purl.org/dc/terms/ language"`
+		Pub     string   `xml:"http://purl.org/dc/terms/ publisher"`
+		Link    struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	}
+	if e := xml.Unmarshal(data, &entry); e != nil {
+		t.Fatalf("the entry is not valid xml: %s\n%s", e, data)
+	}
+
+	book := maker.book
+	for _, c := range []struct{ name, got, want string }{
+		{"id", entry.Id, book.Id()},
+		{"title", entry.Title, "A <B> & C"},
+		{"author", entry.Author, "Tester"},
+		{"summary", entry.Summary, "About <it>"},
+		{"language", entry.Lang, book.Language()},
+		{"publisher", entry.Pub, "P & Q"},
+		{"link rel", entry.Link.Rel, "http://opds-spec.org/acquisition"},
+		{"link href", entry.Link.Href, "a&b.epub"},
+		{"link type", entry.Link.Type, "application/epub+zip"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s is '%s', want '%s'", c.name, c.got, c.want)
+		}
+	}
+	if _, e := time.Parse(time.RFC3339, entry.Updated); e != nil {
+		t.Errorf("updated time '%s' is invalid: %s", entry.Updated, e)
+	}
+}
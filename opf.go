@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// xml structures of the epub files
+
+type xmlContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type xmlOpfItem struct {
+	Id         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type xmlOpfItemRef struct {
+	IdRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+type xmlOpfMeta struct {
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type xmlOpf struct {
+	Version  string `xml:"version,attr"`
+	Metadata struct {
+		Identifier  []string     `xml:"identifier"`
+		Title       []string     `xml:"title"`
+		Creator     []string     `xml:"creator"`
+		Publisher   []string     `xml:"publisher"`
+		Description []string     `xml:"description"`
+		Language    []string     `xml:"language"`
+		Meta        []xmlOpfMeta `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []xmlOpfItem `xml:"manifest>item"`
+	Spine    struct {
+		Toc   string          `xml:"toc,attr"`
+		Items []xmlOpfItemRef `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type xmlNcxNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []xmlNcxNavPoint `xml:"navPoint"`
+}
+
+type xmlNcx struct {
+	NavMap []xmlNcxNavPoint `xml:"navMap>navPoint"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TocItem is an item of the table of content of an existing epub book
+type TocItem struct {
+	Level int
+	Title string
+	Path  string // path of the target file in the package
+	Link  string // the fragment part of the target, including the '#'
+}
+
+// EpubReader reads the information of an existing epub book
+type EpubReader struct {
+	folder  VirtualFolder
+	opfPath string
+	opf     xmlOpf
+	toc     []TocItem
+}
+
+func firstOf(values []string) string {
+	if len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+func readAll(folder VirtualFolder, path string) ([]byte, error) {
+	rc, e := folder.OpenFile(path)
+	if e != nil {
+		return nil, e
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func NewEpubReader(folder VirtualFolder) (*EpubReader, error) {
+	this := &EpubReader{folder: folder}
+
+	data, e := readAll(folder, path_of_container_xml)
+	if e != nil {
+		return nil, e
+	}
+	var container xmlContainer
+	if e = xml.Unmarshal(data, &container); e != nil {
+		return nil, e
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("no rootfile in '%s'", path_of_container_xml)
+	}
+	this.opfPath = container.Rootfiles[0].FullPath
+
+	if data, e = readAll(folder, this.opfPath); e != nil {
+		return nil, e
+	}
+	if e = xml.Unmarshal(data, &this.opf); e != nil {
+		return nil, e
+	}
+
+	if e = this.loadToc(); e != nil {
+		return nil, e
+	}
+
+	return this, nil
+}
+
+// ItemPath returns the path in the package of a manifest item
+func (this *EpubReader) ItemPath(item *xmlOpfItem) string {
+	return path.Join(path.Dir(this.opfPath), item.Href)
+}
+
+func (this *EpubReader) findItem(id string) *xmlOpfItem {
+	for i := 0; i < len(this.opf.Manifest); i++ {
+		if this.opf.Manifest[i].Id == id {
+			return &this.opf.Manifest[i]
+		}
+	}
+	return nil
+}
+
+func (this *EpubReader) splitTarget(from, target string) (string, string) {
+	link := ""
+	if i := strings.IndexByte(target, '#'); i != -1 {
+		target, link = target[:i], target[i:]
+	}
+	return path.Join(path.Dir(from), target), link
+}
+
+func (this *EpubReader) loadNcx(item *xmlOpfItem) error {
+	p := this.ItemPath(item)
+	data, e := readAll(this.folder, p)
+	if e != nil {
+		return e
+	}
+	var ncx xmlNcx
+	if e = xml.Unmarshal(data, &ncx); e != nil {
+		return e
+	}
+
+	var walk func(points []xmlNcxNavPoint, level int)
+	walk = func(points []xmlNcxNavPoint, level int) {
+		for _, np := range points {
+			target, link := this.splitTarget(p, np.Content.Src)
+			this.toc = append(this.toc, TocItem{
+				Level: level,
+				Title: strings.TrimSpace(np.Label),
+				Path:  target,
+				Link:  link,
+			})
+			walk(np.Children, level+1)
+		}
+	}
+	walk(ncx.NavMap, 1)
+	return nil
+}
+
+func (this *EpubReader) loadNav(item *xmlOpfItem) error {
+	p := this.ItemPath(item)
+	data, e := readAll(this.folder, p)
+	if e != nil {
+		return e
+	}
+	root, e := html.Parse(bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+
+	var nav *html.Node
+	for _, n := range findChildren(root, atom.Nav) {
+		if containsField(getAttributeValue(n, "epub:type", ""), "toc") {
+			nav = n
+			break
+		}
+	}
+	if nav == nil {
+		return nil
+	}
+
+	var walk func(list *html.Node, level int)
+	walk = func(list *html.Node, level int) {
+		for _, li := range findDirectChildren(list, atom.Li) {
+			if a := findFirstChild(li, atom.A); a != nil {
+				target, link := this.splitTarget(p, getAttributeValue(a, "href", ""))
+				this.toc = append(this.toc, TocItem{
+					Level: level,
+					Title: strings.TrimSpace(nodeText(a)),
+					Path:  target,
+					Link:  link,
+				})
+			}
+			if ol := findFirstDirectChild(li, atom.Ol); ol != nil {
+				walk(ol, level+1)
+			}
+		}
+	}
+	if ol := findFirstDirectChild(nav, atom.Ol); ol != nil {
+		walk(ol, 1)
+	}
+	return nil
+}
+
+func (this *EpubReader) loadToc() error {
+	if item := this.findItem(this.opf.Spine.Toc); item != nil {
+		return this.loadNcx(item)
+	}
+	for i := 0; i < len(this.opf.Manifest); i++ {
+		item := &this.opf.Manifest[i]
+		if containsField(item.Properties, "nav") {
+			return this.loadNav(item)
+		}
+	}
+	for i := 0; i < len(this.opf.Manifest); i++ {
+		item := &this.opf.Manifest[i]
+		if item.MediaType == "application/x-dtbncx+xml" {
+			return this.loadNcx(item)
+		}
+	}
+	return nil
+}
+
+func (this *EpubReader) Title() string {
+	return firstOf(this.opf.Metadata.Title)
+}
+
+func (this *EpubReader) Author() string {
+	return firstOf(this.opf.Metadata.Creator)
+}
+
+func (this *EpubReader) Toc() []TocItem {
+	return this.toc
+}
+
+// Spine returns the manifest items in the spine, in reading order
+func (this *EpubReader) Spine() []*xmlOpfItem {
+	var result []*xmlOpfItem
+	for _, ref := range this.opf.Spine.Items {
+		if item := this.findItem(ref.IdRef); item != nil {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// pageMarker is a page break marker of the print edition in a content file,
+// it is an element whose 'epub:type' is 'pagebreak' (or whose 'role' is
+// 'doc-pagebreak') with an id, for example:
+//
+//	<span epub:type="pagebreak" id="page12" title="12"/>
+type pageMarker struct {
+	Label string // the page number, from 'title', 'aria-label' or the text
+	Href  string // path of the content file and the fragment
+}
+
+// pageMarkers returns the page markers of all content files in reading order
+func (this *Epub) pageMarkers() []pageMarker {
+	var markers []pageMarker
+	for _, f := range this.files {
+		if (f.Attr&epub_CONTENT_FILE) == 0 || !isHtmlFile(f.Path) {
+			continue
+		}
+		if !bytes.Contains(f.Data, []byte("pagebreak")) {
+			continue
+		}
+		root, e := html.Parse(bytes.NewReader(f.Data))
+		if e != nil {
+			continue
+		}
+		var walk func(node *html.Node)
+		walk = func(node *html.Node) {
+			if node.Type == html.ElementNode && isPageMarker(node) {
+				label := getAttributeValue(node, "title", "")
+				if len(label) == 0 {
+					label = getAttributeValue(node, "aria-label", "")
+				}
+				if len(label) == 0 {
+					label = nodeText(node)
+				}
+				if label = strings.TrimSpace(label); len(label) > 0 {
+					markers = append(markers, pageMarker{
+						Label: label,
+						Href:  f.Path + "#" + getAttributeValue(node, "id", ""),
+					})
+				}
+			}
+			for n := node.FirstChild; n != nil; n = n.NextSibling {
+				walk(n)
+			}
+		}
+		walk(root)
+	}
+	return markers
+}
+
+func isPageMarker(node *html.Node) bool {
+	if len(getAttributeValue(node, "id", "")) == 0 {
+		return false
+	}
+	return containsField(getAttributeValue(node, "epub:type", ""), "pagebreak") ||
+		containsField(getAttributeValue(node, "role", ""), "doc-pagebreak")
+}
+
+// maxPageNumber returns the largest numeric page number in 'markers', page
+// numbers like roman numerals are ignored
+func maxPageNumber(markers []pageMarker) int {
+	max := 0
+	for _, m := range markers {
+		if n, e := strconv.Atoi(m.Label); e == nil && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// writeNcxPageList writes the 'pageList' element of the NCX, 'playorder' is
+// the play order of the first page target
+func writeNcxPageList(buf *bytes.Buffer, markers []pageMarker, playorder int) {
+	if len(markers) == 0 {
+		return
+	}
+	buf.WriteString("	<pageList>\n		<navLabel><text>Pages</text></navLabel>\n")
+	for i, m := range markers {
+		typ, value := "special", ""
+		if n, e := strconv.Atoi(m.Label); e == nil {
+			typ, value = "normal", fmt.Sprintf(" value=\"%d\"", n)
+		}
+		fmt.Fprintf(buf, ""+
+			"		<pageTarget id=\"pageTarget-%d\" type=\"%s\"%s playOrder=\"%d\">\n"+
+			"			<navLabel><text>%s</text></navLabel>\n"+
+			"			<content src=\"%s\"/>\n"+
+			"		</pageTarget>\n",
+			i, typ, value, playorder+i, html.EscapeString(m.Label), m.Href)
+	}
+	buf.WriteString("	</pageList>\n")
+}
+
+// writeNavPageList writes the 'page-list' nav of the navigation document
+func writeNavPageList(buf *bytes.Buffer, markers []pageMarker) {
+	if len(markers) == 0 {
+		return
+	}
+	buf.WriteString("		<nav epub:type=\"page-list\" hidden=\"\">\n<ol>\n")
+	for _, m := range markers {
+		fmt.Fprintf(buf, "<li><a href=\"%s\">%s</a></li>\n", m.Href, html.EscapeString(m.Label))
+	}
+	buf.WriteString("</ol>\n		</nav>\n")
+}
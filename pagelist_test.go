@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPageList(t *testing.T) {
+	for _, c := range []struct {
+		body       string
+		total, max int
+	}{
+		{"<h1>One</h1><p>1</p>", 0, 0},
+		{"<h1>One</h1><p><span epub:type=\"pagebreak\" id=\"p1\" title=\"1\"></span>1</p>" +
+			"<p><span role=\"doc-pagebreak\" id=\"pxii\" aria-label=\"xii\"></span>2</p>" +
+			"<p><span epub:type=\"pagebreak\" id=\"p7\">7</span>3</p>", 3, 7},
+	} {
+		maker := makeBook(t, map[string]string{
+			"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+			"book.html": "<html><head></head><body>" + c.body + "</body></html>",
+		})
+		ncx := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_200), "toc.ncx")
+		assertWellFormed(t, "toc.ncx", ncx)
+		for _, want := range []string{
+			fmt.Sprintf("<meta content=\"%d\" name=\"dtb:totalPageCount\"/>", c.total),
+			fmt.Sprintf("<meta content=\"%d\" name=\"dtb:maxPageNumber\"/>", c.max),
+		} {
+			if !strings.Contains(ncx, want) {
+				t.Errorf("'%s' is not in the NCX:\n%s", want, ncx)
+			}
+		}
+		if n := strings.Count(ncx, "<pageTarget "); n != c.total {
+			t.Errorf("got %d page targets, want %d", n, c.total)
+		}
+
+		nav := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "nav.xhtml")
+		assertWellFormed(t, "nav.xhtml", nav)
+		if got := strings.Contains(nav, "epub:type=\"page-list\""); got != (c.total > 0) {
+			t.Errorf("page-list in the nav is %v, want %v", got, c.total > 0)
+		}
+	}
+}
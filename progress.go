@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const progress_bar_width = 40
+
+// progressBar is a simple text progress bar on a terminal
+type progressBar struct {
+	w     io.Writer
+	title string
+	total int
+	count int
+}
+
+// isTerminal reports whether 'f' is a terminal, it is not accurate, but good
+// enough to decide whether to show the progress bar
+func isTerminal(f *os.File) bool {
+	fi, e := f.Stat()
+	return e == nil && (fi.Mode()&os.ModeCharDevice) != 0
+}
+
+func newProgressBar(w io.Writer, title string, total int) *progressBar {
+	return &progressBar{w: w, title: title, total: total}
+}
+
+func (this *progressBar) step() {
+	this.count++
+	n := progress_bar_width
+	if this.total > 0 {
+		n = this.count * progress_bar_width / this.total
+	}
+	fmt.Fprintf(this.w, "\r%s [%s%s] %d/%d", this.title,
+		strings.Repeat("=", n), strings.Repeat(" ", progress_bar_width-n),
+		this.count, this.total)
+}
+
+// finish clears the progress bar, so that other messages can be printed
+func (this *progressBar) finish() {
+	n := len(this.title) + progress_bar_width + 2*len(fmt.Sprint(this.total)) + 5
+	fmt.Fprintf(this.w, "\r%s\r", strings.Repeat(" ", n))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// buildReport is the summary of a build for machine consumption
+type buildReport struct {
+	Input            string   `json:"input"`
+	Succeeded        bool     `json:"succeeded"`
+	Title            string   `json:"title"`
+	Author           string   `json:"author"`
+	Output           string   `json:"output,omitempty"`
+	OutputSize       int64    `json:"output_size"`
+	FileCount        int      `json:"file_count"`
+	ChapterCount     int      `json:"chapter_count"`
+	Warnings         []string `json:"warnings"`
+	ValidationErrors []string `json:"validation_errors"`
+}
+
+// SaveReport saves the JSON report of the build to file 'path', 'succeeded'
+// is whether the book is created successfully
+func (this *EpubMaker) SaveReport(path string, succeeded bool) error {
+	r := &buildReport{
+		Input:            this.folder.Name(),
+		Succeeded:        succeeded,
+		Warnings:         this.messages,
+		ValidationErrors: this.validation,
+	}
+	if this.book != nil {
+		r.Title, r.Author = this.book.Name(), this.book.Author()
+		r.FileCount, r.ChapterCount = len(this.book.Files()), this.chapter_count
+	}
+	if succeeded && len(this.output) > 0 {
+		r.Output = this.output
+		if stat, e := os.Stat(this.output); e == nil && !stat.IsDir() {
+			r.OutputSize = stat.Size()
+		}
+	}
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+	if r.ValidationErrors == nil {
+		r.ValidationErrors = []string{}
+	}
+
+	data, e := json.MarshalIndent(r, "", "\t")
+	if e == nil {
+		e = ioutil.WriteFile(path, data, 0666)
+	}
+	if e != nil {
+		this.writeLog("failed to create report file.")
+	}
+	return e
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveReport(t *testing.T) {
+	dir := t.TempDir()
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[output]\npath=test.epub\n[build]\nprogress_anchors=-1\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+	})
+	if e := maker.SaveTo(dir, EPUB_VERSION_300); e != nil {
+		t.Fatal(e)
+	}
+	path := filepath.Join(dir, "report.json")
+	if e := maker.SaveReport(path, true); e != nil {
+		t.Fatal(e)
+	}
+
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var r map[string]interface{}
+	if e = json.Unmarshal(data, &r); e != nil {
+		t.Fatal(e)
+	}
+	stat, e := os.Stat(filepath.Join(dir, "test.epub"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	for key, want := range map[string]interface{}{
+		"succeeded":     true,
+		"title":         "Test",
+		"author":        "Tester",
+		"output":        filepath.Join(dir, "test.epub"),
+		"output_size":   float64(stat.Size()),
+		"file_count":    float64(len(maker.book.Files())),
+		"chapter_count": float64(2),
+	} {
+		if r[key] != want {
+			t.Errorf("'%s' is %v, want %v", key, r[key], want)
+		}
+	}
+	if w, ok := r["warnings"].([]interface{}); !ok || len(w) != 1 {
+		t.Errorf("warnings are %v, want the invalid option", r["warnings"])
+	}
+	if v, ok := r["validation_errors"].([]interface{}); !ok || len(v) != 0 {
+		t.Errorf("validation errors are %v, want an empty list", r["validation_errors"])
+	}
+}
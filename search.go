@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const path_of_search_index = "search_index.json"
+
+// words which are too common to be useful in the search index
+var default_stopwords = "a,an,and,are,as,at,be,but,by,for,from,has,have,he,in,is,it,its," +
+	"of,on,or,she,that,the,they,this,to,was,were,will,with"
+
+func isCjkChar(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// searchTerms returns the terms in 'text' for the search index, terms are
+// lower case words. Words of CJK languages are not separated by white spaces,
+// so every CJK character is a term if 'cjk' is true.
+func searchTerms(text string, cjk bool) []string {
+	var terms []string
+	word := make([]rune, 0, 32)
+	flush := func() {
+		if len(word) > 0 {
+			terms = append(terms, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		if cjk && isCjkChar(r) {
+			flush()
+			terms = append(terms, string(r))
+		} else if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word = append(word, r)
+		} else {
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// addSearchIndex generates a JSON object which maps the terms to the paths
+// of content files containing them (in spine order), and adds it to the book
+func (this *EpubMaker) addSearchIndex() {
+	if this.book.FindFile(path_of_search_index) != nil {
+		this.writeWarning("search index is not generated, because '" + path_of_search_index + "' already exists.")
+		return
+	}
+
+	stopwords := make(map[string]bool)
+	for _, w := range strings.Split(this.stopwords, ",") {
+		if w = strings.ToLower(strings.TrimSpace(w)); len(w) > 0 {
+			stopwords[w] = true
+		}
+	}
+
+	cjk := isCjkLanguage(this.book.Language())
+	index := make(map[string][]string)
+	for _, f := range this.book.ContentFiles() {
+		if !isHtmlFile(f.Path) {
+			continue
+		}
+		found := make(map[string]bool)
+		for _, t := range searchTerms(bodyText(f.Data), cjk) {
+			// single letters & digits are useless, a CJK character has 3 bytes
+			if found[t] || stopwords[t] || len(t) < 2 {
+				continue
+			}
+			found[t] = true
+			index[t] = append(index[t], f.Path)
+		}
+	}
+
+	data, e := json.Marshal(index)
+	if e != nil {
+		this.writeWarning("failed to generate search index: " + e.Error())
+		return
+	}
+	this.book.AddFile(path_of_search_index, data)
+	this.book.Include(path_of_search_index)
+	this.writeInfo(fmt.Sprintf("search index generated, %d terms.", len(index)))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	if got, want := searchTerms("Hello, World! 42", false), []string{"hello", "world", "42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := searchTerms("中文abc", true), []string{"中", "文", "abc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\nlanguage=en\n[build]\nsearch_index=true\nstopwords=apple\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>Apple banana</p>" +
+			"<h1>Two</h1><p>banana cherry</p></body></html>",
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	if opf := readEntry(t, zr, "content.opf"); !strings.Contains(opf, "href=\""+path_of_search_index+"\"") {
+		t.Errorf("the search index is not in the manifest:\n%s", opf)
+	}
+
+	var index map[string][]string
+	if e := json.Unmarshal([]byte(readEntry(t, zr, path_of_search_index)), &index); e != nil {
+		t.Fatal(e)
+	}
+	files := maker.book.ContentFiles()
+	if got, want := index["banana"], []string{files[0].Path, files[1].Path}; !reflect.DeepEqual(got, want) {
+		t.Errorf("'banana' is in %v, want %v", got, want)
+	}
+	if got, want := index["cherry"], []string{files[1].Path}; !reflect.DeepEqual(got, want) {
+		t.Errorf("'cherry' is in %v, want %v", got, want)
+	}
+	if _, ok := index["apple"]; ok {
+		t.Errorf("stopword 'apple' is in the index")
+	}
+}
@@ -60,7 +60,7 @@ func doConvert(l *log.Logger, w http.ResponseWriter, r *http.Request) error {
 	}
 
 	maker := NewEpubMaker(l)
-	if e = maker.Process(folder, r.FormValue("duokan") == "duokan"); e != nil {
+	if e = maker.ProcessContext(r.Context(), folder, r.FormValue("duokan") == "duokan"); e != nil {
 		return e
 	}
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// loadSigningKey loads the Ed25519 private key from PEM file 'path', the key
+// must be in PKCS #8 format, which can be created by:
+//
+//	openssl genpkey -algorithm ed25519 -out key.pem
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("the key file is not a PEM encoded PKCS #8 private key")
+	}
+	key, e := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if e != nil {
+		return nil, e
+	}
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return k, nil
+	}
+	return nil, errors.New("the key is not an Ed25519 private key")
+}
+
+// signFile creates the detached signature of file 'path' with the key in
+// file 'keyPath', the raw 64 bytes Ed25519 signature is saved to '<path>.sig',
+// it can be verified by:
+//
+//	openssl pkey -in key.pem -pubout -out pub.pem
+//	openssl pkeyutl -verify -pubin -inkey pub.pem -rawin -in book.epub -sigfile book.epub.sig
+func signFile(path, keyPath string) error {
+	key, e := loadSigningKey(keyPath)
+	if e != nil {
+		return e
+	}
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path+".sig", ed25519.Sign(key, data), 0666)
+}
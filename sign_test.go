@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestKey creates an Ed25519 key and saves it to 'path' in PEM format
+func writeTestKey(t *testing.T, path string) ed25519.PublicKey {
+	pub, key, e := ed25519.GenerateKey(rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	der, e := x509.MarshalPKCS8PrivateKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if e = ioutil.WriteFile(path, data, 0600); e != nil {
+		t.Fatal(e)
+	}
+	return pub
+}
+
+func TestSignFile(t *testing.T) {
+	dir := t.TempDir()
+	pub := writeTestKey(t, filepath.Join(dir, "key.pem"))
+	path := filepath.Join(dir, "book.epub")
+	data := []byte("the book")
+	if e := ioutil.WriteFile(path, data, 0666); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := signFile(path, filepath.Join(dir, "key.pem")); e != nil {
+		t.Fatal(e)
+	}
+	sig, e := ioutil.ReadFile(path + ".sig")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		t.Fatalf("signature has %d bytes, want %d", len(sig), ed25519.SignatureSize)
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		t.Error("signature is not verified by the public key")
+	}
+
+	if e := signFile(path, filepath.Join(dir, "missing.pem")); e == nil {
+		t.Error("no error with a missing key")
+	}
+	if e := signFile(path, path); e == nil {
+		t.Error("no error with a key which is not PEM encoded")
+	}
+}
+
+func TestSignKeyPath(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n[output]\nsign=key.pem\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	}
+	for name, s := range files {
+		if e := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0666); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	maker := NewEpubMaker(testLogger)
+	if e := maker.Process(OpenSystemFolder(dir), false); e != nil {
+		t.Fatal(e)
+	}
+	// relative to the folder of 'book.ini' instead of the working directory
+	if p := filepath.Join(dir, "key.pem"); maker.sign_key != p {
+		t.Errorf("key path is '%s', want '%s'", maker.sign_key, p)
+	}
+
+	// relative to the folder of the external configuration file
+	ext := filepath.Join(t.TempDir(), "ext.ini")
+	if e := ioutil.WriteFile(ext, []byte("[output]\nsign=keys/key.pem\n"), 0666); e != nil {
+		t.Fatal(e)
+	}
+	maker = NewEpubMaker(testLogger)
+	maker.SetConfigFile(ext)
+	if e := maker.Process(OpenSystemFolder(dir), false); e != nil {
+		t.Fatal(e)
+	}
+	if p := filepath.Join(filepath.Dir(ext), "keys", "key.pem"); maker.sign_key != p {
+		t.Errorf("key path is '%s', want '%s'", maker.sign_key, p)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Option 'spine' of section 'build' composes the reading order of hybrid
+// books, it is a comma separated list of directives which are processed in
+// order, for example:
+//
+//	spine = intro.html, split:book.html, afterword.html
+//
+// A literal file is added to the spine as is, and its 'title' becomes the TOC
+// title, while 'split:<file>' splits the file by headers the same way as
+// 'book.html' is split normally. Like other source html files, a literal file
+// is only minified by 'loadFiles', typography, the base style sheet and the
+// header & footer templates are the author's business.
+
+const spine_split_prefix = "split:"
+
+// isSplitTarget returns whether 'path' is split by a 'spine' directive, such
+// files are not added to the book as is
+func (this *EpubMaker) isSplitTarget(path string) bool {
+	for _, d := range this.spine {
+		if strings.HasPrefix(d, spine_split_prefix) && strings.EqualFold(d[len(spine_split_prefix):], path) {
+			return true
+		}
+	}
+	return false
+}
+
+// composeSpine processes the 'spine' directives in order, it replaces the
+// split of 'book.html' and must be called after 'loadFiles'
+func (this *EpubMaker) composeSpine() error {
+	for _, d := range this.spine {
+		if !strings.HasPrefix(d, spine_split_prefix) {
+			if e := this.addSpineFile(d); e != nil {
+				return e
+			}
+			continue
+		}
+
+		p := d[len(spine_split_prefix):]
+		this.content_files = []string{p}
+		root, e := this.parseBook()
+		if e != nil {
+			return fmt.Errorf("failed to parse '%s' in option 'spine': %s", p, e.Error())
+		}
+		this.writeDebug("'" + p + "' in option 'spine' is split.")
+		this.splitChapter(root)
+	}
+	this.content_files = nil
+	return nil
+}
+
+// addSpineFile adds source file 'path' to the spine as is, the file is removed
+// from 'files' so that it is not added again
+func (this *EpubMaker) addSpineFile(path string) error {
+	path = this.rename(path)
+	for i, f := range this.files {
+		if !strings.EqualFold(f.path, path) {
+			continue
+		}
+		if !isHtmlFile(f.path) {
+			return fmt.Errorf("file '%s' in option 'spine' is not an html file.", f.path)
+		}
+
+		this.book.AddContentFile(f.path, f.data, this.book.FileType(f.path))
+		bf := this.book.FindFile(f.path)
+		if !f.mtime.IsZero() {
+			bf.ModTime = f.mtime
+		}
+		if doc, e := html.Parse(bytes.NewReader(f.data)); e == nil {
+			if t := findFirstChild(doc, atom.Title); t != nil {
+				if title := strings.TrimSpace(nodeText(t)); len(title) > 0 {
+					bf.Chapters = []Chapter{{Level: 1, Title: title}}
+				}
+			}
+		}
+
+		if this.track_mtime {
+			this.recordChapterMtime([]string{f.path}, f.modified)
+		}
+
+		this.files = append(this.files[:i], this.files[i+1:]...)
+		this.writeDebug("'" + f.path + "' in option 'spine' is added as is.")
+		return nil
+	}
+	return fmt.Errorf("file '%s' in option 'spine' does not exist.", path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComposeSpine(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\nspine=intro.html, split:book.html, split:appendix.html\ntypography=true\n" +
+			"[style]\nfont_size=1.2em\n",
+		"intro.html":    "<html><head><title>Intro</title></head><body><p>\"intro\"</p></body></html>",
+		"book.html":     "<html><head></head><body><h1>One</h1><p>1</p><h1>Two</h1><p>2</p></body></html>",
+		"appendix.html": "<html><head></head><body><h1>Appendix</h1><p>\"a\"</p></body></html>",
+	})
+	if s := chapterTitles(maker); s != "Intro,One,Two,Appendix" {
+		t.Errorf("chapters are '%s', want 'Intro,One,Two,Appendix'", s)
+	}
+
+	files := maker.book.ContentFiles()
+	intro := string(files[0].Data)
+	if files[0].Path != "intro.html" {
+		t.Errorf("the literal file is saved as '%s', want 'intro.html'", files[0].Path)
+	}
+	// literal files are added as is
+	if !strings.Contains(intro, "\"intro\"") || strings.Contains(intro, path_of_base_style) {
+		t.Errorf("the literal file is processed:\n%s", intro)
+	}
+	appendix := string(files[len(files)-1].Data)
+	if !strings.Contains(appendix, "“a”") || !strings.Contains(appendix, path_of_base_style) {
+		t.Errorf("the split file is not processed:\n%s", appendix)
+	}
+	// the split files are not in the book as is
+	if maker.book.FindFile("book.html") != nil || maker.book.FindFile("appendix.html") != nil {
+		t.Errorf("the split files are added to the book")
+	}
+
+	// the base style sheet is generated once, whatever the number of 'split:'
+	count := 0
+	for _, f := range maker.book.Files() {
+		if strings.EqualFold(f.Path, path_of_base_style) {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("'%s' is added %d times, want once", path_of_base_style, count)
+	}
+	opf := readEntry(t, buildArchive(t, maker.book, EPUB_VERSION_300), "content.opf")
+	if n := strings.Count(opf, "href=\""+path_of_base_style+"\""); n != 1 {
+		t.Errorf("'%s' is in the manifest %d times, want once:\n%s", path_of_base_style, n, opf)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// text in these elements are code or not for reading, so never changed
+var typography_skipped = map[atom.Atom]bool{
+	atom.Pre: true, atom.Code: true, atom.Kbd: true, atom.Samp: true, atom.Var: true,
+	atom.Tt: true, atom.Script: true, atom.Style: true, atom.Textarea: true,
+	atom.Math: true, atom.Svg: true,
+}
+
+// isOpeningContext reports whether a quote after 'prev' opens a quotation
+func isOpeningContext(prev rune) bool {
+	return unicode.IsSpace(prev) || strings.ContainsRune("([{<—–-“‘", prev)
+}
+
+// smartenText converts straight quotes in 's' to curly quotes and '--' to em
+// dashes, 'prev' is the character before 's', the last character of the
+// result is also returned
+func smartenText(s string, prev rune) (string, rune) {
+	s = strings.Replace(s, "--", "—", -1)
+	buf := new(strings.Builder)
+	for _, r := range s {
+		switch r {
+		case '"':
+			if isOpeningContext(prev) {
+				r = '“'
+			} else {
+				r = '”'
+			}
+		case '\'':
+			// a closing quote is also an apostrophe
+			if isOpeningContext(prev) {
+				r = '‘'
+			} else {
+				r = '’'
+			}
+		}
+		buf.WriteRune(r)
+		prev = r
+	}
+	return buf.String(), prev
+}
+
+// smartenTypography applies 'smartenText' to the text nodes in 'body', text
+// in elements like 'pre' and 'code' and all attributes are not changed
+func smartenTypography(body *html.Node) {
+	prev := ' '
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		switch node.Type {
+		case html.TextNode:
+			node.Data, prev = smartenText(node.Data, prev)
+		case html.ElementNode:
+			if typography_skipped[node.DataAtom] {
+				prev = 'x'
+				return
+			}
+			if block_elements[node.DataAtom] {
+				// a new block starts a new context
+				prev = ' '
+			}
+			for n := node.FirstChild; n != nil; n = n.NextSibling {
+				walk(n)
+			}
+		}
+	}
+	walk(body)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSmartenText(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		{`"Hello," she said.`, `“Hello,” she said.`},
+		{`It's 'quoted' -- really`, `It’s ‘quoted’ — really`},
+		{`("a")`, `(“a”)`},
+	} {
+		if s, _ := smartenText(c.in, ' '); s != c.out {
+			t.Errorf("got '%s', want '%s'", s, c.out)
+		}
+	}
+}
+
+func TestTypography(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini": "[book]\nname=Test\nauthor=Tester\n[build]\ntypography=true\n",
+		"book.html": "<html><head></head><body><h1>One</h1>" +
+			"<p title=\"a 'b' -- c\">\"Go <b>now</b>\" -- it's <code>x = 'y' -- z</code></p>" +
+			"<pre>\"raw\" -- text</pre></body></html>",
+	})
+	s := string(maker.book.ContentFiles()[0].Data)
+	for _, want := range []string{
+		"“Go <b>now</b>” — it’s ",
+		// attributes and code are not changed
+		"title=\"a &#39;b&#39; -- c\"",
+		"<code>x = &#39;y&#39; -- z</code>",
+		"<pre>&#34;raw&#34; -- text</pre>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("'%s' is not in the chapter:\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Unpacking is the reverse of the chapter splitting, but it is lossy:
+//   - only the 'head' of the first chapter is kept, stylesheets linked by
+//     other chapters are appended to it.
+//   - TOC items deeper than level 6 are flattened to level 6.
+//   - links to another chapter without a fragment are not updated, and ids
+//     from different chapters may conflict after merge.
+//   - content documents which are not in the spine are kept as normal files.
+//   - files out of the folder of the package document are dropped.
+
+type epubUnpacker struct {
+	reader *EpubReader
+	files  map[string][]byte
+	root   *html.Node // the merged 'book.html'
+	head   *html.Node
+	body   *html.Node
+	cover  string // path of the cover page
+	level  int    // max TOC level
+	lossy  []string
+}
+
+// addLossy records a lossy transformation, each one is recorded only once
+func (this *epubUnpacker) addLossy(msg string) {
+	for _, m := range this.lossy {
+		if m == msg {
+			return
+		}
+	}
+	this.lossy = append(this.lossy, msg)
+}
+
+// relPath returns the path of 'p' relative to the folder of the package
+// document, which becomes the root of the source folder
+func (this *epubUnpacker) relPath(p string) string {
+	dir := path.Dir(this.reader.opfPath)
+	if dir == "." {
+		return p
+	}
+	return strings.TrimPrefix(p, dir+"/")
+}
+
+func (this *epubUnpacker) findCover() {
+	spine := this.reader.Spine()
+	if len(spine) > 0 {
+		item := spine[0]
+		name := strings.ToLower(path.Base(item.Href))
+		if item.Id == "cover" || strings.HasPrefix(name, "cover") {
+			this.cover = this.reader.ItemPath(item)
+		}
+	}
+
+	image := ""
+	for _, m := range this.reader.opf.Metadata.Meta {
+		if m.Name == "cover" {
+			if item := this.reader.findItem(m.Content); item != nil {
+				image = this.reader.ItemPath(item)
+			} else if len(m.Content) > 0 {
+				image = path.Join(path.Dir(this.reader.opfPath), m.Content)
+			}
+		}
+	}
+	for i := 0; i < len(this.reader.opf.Manifest) && len(image) == 0; i++ {
+		item := &this.reader.opf.Manifest[i]
+		if containsField(item.Properties, "cover-image") {
+			image = this.reader.ItemPath(item)
+		}
+	}
+	if len(image) == 0 {
+		return
+	}
+
+	// the cover image is detected by name when rebuild
+	ext := strings.ToLower(path.Ext(image))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	if ext != ".png" && ext != ".jpg" && ext != ".gif" {
+		return
+	}
+	if data, e := readAll(this.reader.folder, image); e == nil {
+		this.files["cover"+ext] = data
+	}
+}
+
+// markChapter makes the direct child of 'body' which contains 'node' a
+// chapter tag with the level & title of 'item'
+func (this *epubUnpacker) markChapter(body, node *html.Node, item *TocItem) {
+	for node.Parent != body {
+		node = node.Parent
+	}
+	level := item.Level
+	if level > lowest_level {
+		this.addLossy("TOC items deeper than level 6 are flattened to level 6.")
+		level = lowest_level
+	}
+	if level > this.level {
+		this.level = level
+	}
+	addClass(node, makeepub_chapter)
+	removeAttribute(node, data_chapter_level)
+	removeAttribute(node, data_chapter_title)
+	node.Attr = append(node.Attr,
+		html.Attribute{Key: data_chapter_level, Val: strconv.Itoa(level)},
+		html.Attribute{Key: data_chapter_title, Val: item.Title},
+	)
+}
+
+func newChapterTag(level int) *html.Node {
+	return &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Div,
+		Data:     "div",
+		Attr: []html.Attribute{
+			{Key: "class", Val: makeepub_chapter},
+			{Key: data_chapter_level, Val: strconv.Itoa(level)},
+		},
+	}
+}
+
+func findNodeById(root *html.Node, id string) *html.Node {
+	for node := root.FirstChild; node != nil; node = node.NextSibling {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		if getAttributeValue(node, "id", "") == id {
+			return node
+		}
+		if n := findNodeById(node, id); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+func (this *epubUnpacker) mergeHead(head *html.Node) {
+	if this.head == nil {
+		return
+	}
+	for _, link := range findDirectChildren(head, atom.Link) {
+		if !containsField(strings.ToLower(getAttributeValue(link, "rel", "")), "stylesheet") {
+			continue
+		}
+		href := getAttributeValue(link, "href", "")
+		found := false
+		for _, l := range findDirectChildren(this.head, atom.Link) {
+			if getAttributeValue(l, "href", "") == href {
+				found = true
+				break
+			}
+		}
+		if !found {
+			head.RemoveChild(link)
+			this.head.AppendChild(link)
+		}
+	}
+}
+
+func (this *epubUnpacker) addChapter(item *xmlOpfItem) error {
+	p := this.reader.ItemPath(item)
+	data, e := readAll(this.reader.folder, p)
+	if e != nil {
+		return e
+	}
+	doc, e := html.Parse(bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	body := findFirstChild(doc, atom.Body)
+	head := findFirstChild(doc, atom.Head)
+	if body == nil {
+		return fmt.Errorf("'%s' has no 'body' element", p)
+	}
+
+	rewriteReferences(doc, this.relPath(p), "book.html", nil)
+
+	// fragment only links to other chapters are still valid after merge
+	spine := make(map[string]bool)
+	for _, it := range this.reader.Spine() {
+		spine[this.relPath(this.reader.ItemPath(it))] = true
+	}
+	for _, a := range findChildren(body, atom.A) {
+		if attr := findAttribute(a, "href"); attr != nil {
+			if i := strings.IndexByte(attr.Val, '#'); i > 0 && spine[attr.Val[:i]] {
+				attr.Val = attr.Val[i:]
+			}
+		}
+	}
+
+	// every chapter file starts with a level 0 chapter tag to force split
+	body.InsertBefore(newChapterTag(0), body.FirstChild)
+	start := body.FirstChild.NextSibling
+
+	for _, ti := range this.reader.Toc() {
+		if ti.Path != p {
+			continue
+		}
+		var node *html.Node
+		if len(ti.Link) > 1 {
+			node = findNodeById(body, ti.Link[1:])
+		}
+		if node == nil {
+			node = newChapterTag(ti.Level)
+			body.InsertBefore(node, start)
+		}
+		this.markChapter(body, node, &ti)
+	}
+
+	if this.root == nil {
+		this.root, this.head, this.body = doc, head, body
+		return nil
+	}
+
+	if head != nil {
+		this.mergeHead(head)
+		for n := head.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type == html.ElementNode && n.DataAtom != atom.Title && n.DataAtom != atom.Meta && n.DataAtom != atom.Link {
+				this.addLossy("only the 'head' of the first chapter is kept.")
+				break
+			}
+		}
+	}
+	for n := body.FirstChild; n != nil; n = body.FirstChild {
+		body.RemoveChild(n)
+		this.body.AppendChild(n)
+	}
+	return nil
+}
+
+func (this *epubUnpacker) generateIni() []byte {
+	md := &this.reader.opf.Metadata
+	oneLine := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+
+	level := this.level
+	if level < 1 {
+		level = 1
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "[book]\n"+
+		"name=%s\n"+
+		"author=%s\n"+
+		"id=%s\n"+
+		"publisher=%s\n"+
+		"description=%s\n"+
+		"language=%s\n"+
+		"toc=%d\n\n",
+		oneLine(firstOf(md.Title)),
+		oneLine(firstOf(md.Creator)),
+		oneLine(firstOf(md.Identifier)),
+		oneLine(firstOf(md.Publisher)),
+		oneLine(firstOf(md.Description)),
+		oneLine(firstOf(md.Language)),
+		level,
+	)
+
+	// only the chapter tags generated during unpacking are split points
+	buf.WriteString("[split]\nAtLevel=0\nByHeader=7\n\n")
+
+	name := firstOf(md.Title)
+	if len(name) == 0 {
+		name = "book"
+	}
+	fmt.Fprintf(buf, "[output]\npath=%s.epub\n", oneLine(name))
+
+	return buf.Bytes()
+}
+
+// checkMetadata records the metadata which can not be kept in 'book.ini'
+func (this *epubUnpacker) checkMetadata() {
+	md := &this.reader.opf.Metadata
+	if len(md.Title) > 1 || len(md.Creator) > 1 || len(md.Identifier) > 1 ||
+		len(md.Publisher) > 1 || len(md.Description) > 1 || len(md.Language) > 1 {
+		this.addLossy("only the first value of each metadata item is kept.")
+	}
+	// these are generated again when rebuild
+	for _, m := range md.Meta {
+		if m.Name != "cover" && m.Name != "generator" && m.Property != "dcterms:modified" && m.Property != "role" {
+			this.addLossy("'meta' elements in the package document are dropped.")
+			break
+		}
+	}
+}
+
+// unpackEpub converts an epub book to the source files of this tool, it also
+// returns the descriptions of the lossy transformations
+func unpackEpub(folder VirtualFolder) (map[string][]byte, []string, error) {
+	reader, e := NewEpubReader(folder)
+	if e != nil {
+		return nil, nil, e
+	}
+	this := &epubUnpacker{reader: reader, files: make(map[string][]byte)}
+	this.findCover()
+	this.checkMetadata()
+
+	skip := map[string]bool{reader.opfPath: true}
+	for _, item := range reader.Spine() {
+		p := reader.ItemPath(item)
+		skip[p] = true
+		if p == this.cover {
+			data, e := readAll(folder, p)
+			if e != nil {
+				return nil, nil, e
+			}
+			this.files[path_of_cover_page] = data
+			continue
+		}
+		if e := this.addChapter(item); e != nil {
+			return nil, nil, e
+		}
+	}
+
+	if this.root == nil {
+		return nil, nil, fmt.Errorf("the book has no chapter")
+	}
+
+	buf := new(bytes.Buffer)
+	if e := html.Render(buf, this.root); e != nil {
+		return nil, nil, e
+	}
+	this.files["book.html"] = buf.Bytes()
+	this.files["book.ini"] = this.generateIni()
+
+	for i := 0; i < len(reader.opf.Manifest); i++ {
+		item := &reader.opf.Manifest[i]
+		p := reader.ItemPath(item)
+		if skip[p] || containsField(item.Properties, "nav") || item.MediaType == "application/x-dtbncx+xml" {
+			continue
+		}
+		// a crafted book may reference files like '../../x', they must not be
+		// written out of the output folder
+		if isOutOfRoot(this.relPath(p)) {
+			this.addLossy("files out of the folder of the package document are dropped.")
+			continue
+		}
+		if item.MediaType == "application/xhtml+xml" {
+			this.addLossy("content documents which are not in the spine are kept as normal files.")
+		}
+		data, e := readAll(folder, p)
+		if e != nil {
+			return nil, nil, e
+		}
+		if _, ok := this.files[this.relPath(p)]; !ok {
+			this.files[this.relPath(p)] = data
+		}
+	}
+
+	return this.files, this.lossy, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// EpubFolder is an existing epub book used as the source of a new one, it is
+// unpacked into memory, so the book can be edited & rebuilt
+type EpubFolder struct {
+	*MemoryFolder
+	name  string
+	lossy []string
+}
+
+func OpenEpubFolder(path string) (*EpubFolder, error) {
+	zf, e := OpenZipFolder(path)
+	if e != nil {
+		return nil, e
+	}
+	files, lossy, e := unpackEpub(zf)
+	if e != nil {
+		return nil, e
+	}
+	return &EpubFolder{MemoryFolder: NewMemoryFolder(files), name: path, lossy: lossy}, nil
+}
+
+func (this *EpubFolder) Name() string {
+	return this.name
+}
+
+// Lossy returns the descriptions of the lossy transformations during unpacking
+func (this *EpubFolder) Lossy() []string {
+	return this.lossy
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func RunUnpack() {
+	inpath, outpath := getArg(0, ""), getArg(1, "")
+	if len(inpath) == 0 || len(outpath) == 0 {
+		onCommandLineError()
+	}
+
+	folder, e := OpenZipFolder(inpath)
+	if e != nil {
+		logger.Fatalf("failed to open '%s'.\n", inpath)
+	}
+
+	files, lossy, e := unpackEpub(folder)
+	if e != nil {
+		logger.Fatalln("failed to unpack book:", e.Error())
+	}
+	for _, msg := range lossy {
+		logger.Println(msg)
+	}
+
+	for name, data := range files {
+		p, e := joinOutputPath(outpath, name)
+		if e != nil {
+			logger.Printf("'%s' is skipped, the book is not unpacked completely: %s\n", name, e.Error())
+			continue
+		}
+		dir, _ := filepath.Split(p)
+		if e = os.MkdirAll(dir, os.ModeDir|0755); e != nil {
+			logger.Fatalf("failed to create output folder '%s'.\n", dir)
+		}
+		if e = ioutil.WriteFile(p, data, 0666); e != nil {
+			logger.Fatalf("failed to create output file '%s'.\n", name)
+		}
+	}
+}
+
+func init() {
+	AddCommandHandler("u", RunUnpack)
+}
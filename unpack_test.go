@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnpackOutOfFolder(t *testing.T) {
+	folder := NewMemoryFolder(map[string][]byte{
+		"META-INF/container.xml": []byte(`<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`),
+		"OEBPS/content.opf": []byte(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Test</dc:title></metadata>
+	<manifest>
+		<item id="one" href="one.xhtml" media-type="application/xhtml+xml"/>
+		<item id="evil" href="../../evil.txt" media-type="text/plain"/>
+		<item id="a" href="images/a.jpg" media-type="image/jpeg"/>
+	</manifest>
+	<spine><itemref idref="one"/></spine>
+</package>`),
+		"OEBPS/one.xhtml":    []byte("<html><head></head><body><h1>One</h1><p>1</p></body></html>"),
+		"OEBPS/images/a.jpg": []byte("jpeg"),
+		"../evil.txt":        []byte("evil"),
+	})
+
+	files, lossy, e := unpackEpub(folder)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for name := range files {
+		if isOutOfRoot(name) {
+			t.Errorf("'%s' is out of the output folder", name)
+		}
+	}
+	if _, ok := files["images/a.jpg"]; !ok {
+		t.Errorf("'images/a.jpg' is not unpacked")
+	}
+	if !strings.Contains(strings.Join(lossy, "\n"), "files out of the folder of the package document are dropped") {
+		t.Errorf("dropped file is not reported as lossy: %v", lossy)
+	}
+}
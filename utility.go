@@ -1,6 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
 	"strings"
 	"unicode"
 
@@ -8,13 +16,209 @@ import (
 	"golang.org/x/net/html/atom"
 )
 
+// resolveReference returns the path in the book of 'ref' which is referenced
+// by file 'from', or an empty string if 'ref' does not point to a local file
+func resolveReference(from, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if len(ref) == 0 || ref[0] == '#' || ref[0] == '/' || strings.Contains(ref, ":") {
+		return ""
+	}
+	if i := strings.IndexAny(ref, "#?"); i != -1 {
+		ref = ref[:i]
+	}
+	if p, e := url.PathUnescape(ref); e == nil {
+		ref = p
+	}
+	return path.Join(path.Dir(from), ref)
+}
+
+func isHtmlFile(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".html", ".htm", ".xhtml":
+		return true
+	}
+	return false
+}
+
+func isCssFile(p string) bool {
+	return strings.ToLower(path.Ext(p)) == ".css"
+}
+
+// isTextFile reports whether 'p' is a text file according to its media type
+func isTextFile(p string) bool {
+	mt := getMediaType(p)
+	return strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+xml") || mt == "application/json"
+}
+
+// cleanBookPath removes the leading '../' which points out of the book root
+func cleanBookPath(p string) string {
+	p = path.Clean(p)
+	for strings.HasPrefix(p, "../") {
+		p = p[3:]
+	}
+	return p
+}
+
+// isOutOfRoot reports whether slash separated path 'p' points out of the root
+// folder, that is, it is absolute, has a volume name or escapes by '..'
+func isOutOfRoot(p string) bool {
+	p = strings.Replace(p, "\\", "/", -1)
+	if path.IsAbs(p) || filepath.IsAbs(p) || len(filepath.VolumeName(p)) > 0 {
+		return true
+	}
+	if len(p) >= 2 && p[1] == ':' { // drive name of windows
+		return true
+	}
+	p = path.Clean(p)
+	return p == "." || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// joinOutputPath returns the path in folder 'dir' of slash separated path 'p',
+// it fails if the result is not in 'dir', so a file name from a book cannot
+// write to anywhere else
+func joinOutputPath(dir, p string) (string, error) {
+	if isOutOfRoot(p) {
+		return "", fmt.Errorf("'%s' is out of the output folder", p)
+	}
+	result := filepath.Join(dir, filepath.FromSlash(path.Clean(p)))
+	rel, e := filepath.Rel(dir, result)
+	if e != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is out of the output folder", p)
+	}
+	return result, nil
+}
+
+// relativeReference returns the reference to 'target' from file 'from'
+func relativeReference(from, target string) string {
+	dir := path.Dir(from)
+	if dir == "." {
+		return target
+	}
+	rel, e := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(target))
+	if e != nil {
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rewriteReferences updates the local references (attribute 'src' & 'href')
+// in 'root' which is moved from file 'from' to file 'to', 'rename' is called
+// to get the final path of the referenced file, it can be nil
+func rewriteReferences(root *html.Node, from, to string, rename func(string) string) {
+	for i := 0; i < len(root.Attr); i++ {
+		attr := &root.Attr[i]
+		if attr.Key != "src" && attr.Key != "href" {
+			continue
+		}
+		target := resolveReference(from, attr.Val)
+		if len(target) == 0 {
+			continue
+		}
+		target = cleanBookPath(target)
+		if rename != nil {
+			target = rename(target)
+		}
+		suffix := ""
+		if j := strings.IndexAny(attr.Val, "#?"); j != -1 {
+			suffix = attr.Val[j:]
+		}
+		ref := relativeReference(to, target)
+		if old, e := url.PathUnescape(strings.TrimSuffix(attr.Val, suffix)); e == nil && old == ref {
+			continue
+		}
+		attr.Val = (&url.URL{Path: ref}).EscapedPath() + suffix
+	}
+	for node := root.FirstChild; node != nil; node = node.NextSibling {
+		if node.Type == html.ElementNode {
+			rewriteReferences(node, from, to, rename)
+		}
+	}
+}
+
+// rewriteCssReferences is the same as 'rewriteReferences', but for a css file
+func rewriteCssReferences(data []byte, from string, rename func(string) string) []byte {
+	return rebaseCssReferences(data, from, from, rename)
+}
+
+// rebaseCssReferences rewrites the references in css 'data', which are
+// relative to 'from', to be relative to 'to', 'rename' can be nil
+func rebaseCssReferences(data []byte, from, to string, rename func(string) string) []byte {
+	return reCssUrl.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := reCssUrl.FindSubmatch(m)
+		ref := sub[1]
+		if len(ref) == 0 {
+			ref = sub[2]
+		}
+		target := resolveReference(from, string(ref))
+		if len(target) == 0 {
+			return m
+		}
+		target = cleanBookPath(target)
+		if rename != nil {
+			target = rename(target)
+		}
+		return bytes.Replace(m, ref, []byte(relativeReference(to, target)), 1)
+	})
+}
+
+// rewriteStyleReferences rewrites the references in the 'style' elements of
+// 'root', which are relative to 'from', to be relative to 'to'
+func rewriteStyleReferences(root *html.Node, from, to string) {
+	for _, style := range findChildren(root, atom.Style) {
+		for n := style.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type == html.TextNode {
+				n.Data = string(rebaseCssReferences([]byte(n.Data), from, to, nil))
+			}
+		}
+	}
+}
+
+// processHtmlFile parses the html file content in 'data', calls 'fn' to
+// update the document and returns the rendered result. The xml declaration
+// is kept as is because the html parser converts it to a comment.
+func processHtmlFile(data []byte, fn func(root *html.Node)) ([]byte, error) {
+	decl := []byte(nil)
+	if bytes.HasPrefix(data, []byte("<?xml")) {
+		if i := bytes.Index(data, []byte("?>")); i != -1 {
+			decl, data = data[:i+2], data[i+2:]
+		}
+	}
+
+	root, e := html.Parse(bytes.NewReader(data))
+	if e != nil {
+		return nil, e
+	}
+	fn(root)
+
+	buf := new(bytes.Buffer)
+	if len(decl) > 0 {
+		buf.Write(decl)
+		buf.WriteByte('\n')
+	}
+	if e = html.Render(buf, root); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
 func removeUtf8Bom(data []byte) []byte {
-	if len(data) > 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+	if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
 		data = data[3:]
 	}
 	return data
 }
 
+// normalizeNewlines converts all line breaks (CRLF, CR and LF) in 'data' to
+// 'newline'
+func normalizeNewlines(data []byte, newline string) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+	if newline != "\n" {
+		data = bytes.Replace(data, []byte("\n"), []byte(newline), -1)
+	}
+	return data
+}
+
 func containsField(str, field string) bool {
 	for _, f := range strings.Fields(str) {
 		if f == field {
@@ -102,6 +306,16 @@ func removeAttribute(node *html.Node, name string) {
 	node.Attr = attr
 }
 
+// setAttribute sets attribute 'name' of 'node' to 'val', the attribute is
+// added if not exists
+func setAttribute(node *html.Node, name, val string) {
+	if attr := findAttribute(node, name); attr != nil {
+		attr.Val = val
+	} else {
+		node.Attr = append(node.Attr, html.Attribute{Key: name, Val: val})
+	}
+}
+
 func getAttributeValue(node *html.Node, name string, dflt string) string {
 	if attr := findAttribute(node, name); attr != nil {
 		return attr.Val
@@ -145,6 +359,18 @@ func removeClass(node *html.Node, class string) {
 	attr.Val = classes
 }
 
+// nodeText returns the text content of 'node' and all its descendants
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	text := ""
+	for n := node.FirstChild; n != nil; n = n.NextSibling {
+		text += nodeText(n)
+	}
+	return text
+}
+
 func cloneNode(node *html.Node) *html.Node {
 	n := &html.Node{
 		Type:     node.Type,
@@ -155,3 +381,157 @@ func cloneNode(node *html.Node) *html.Node {
 	copy(n.Attr, node.Attr)
 	return n
 }
+
+// content_properties maps the elements to the EPUB3 manifest properties of
+// the content documents containing them
+var content_properties = []struct{ tag, property string }{
+	{"math", "mathml"},
+	{"script", "scripted"},
+	{"svg", "svg"},
+}
+
+// contentProperties returns the EPUB3 manifest properties of content document
+// 'data' according to the elements in it, all elements are found in one pass
+func contentProperties(data []byte) []string {
+	found := make(map[string]bool)
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			name, _ := z.TagName()
+			found[string(name)] = true
+		}
+	}
+
+	var props []string
+	for _, cp := range content_properties {
+		if found[cp.tag] {
+			props = append(props, cp.property)
+		}
+	}
+	return props
+}
+
+// ASCII equivalents of common latin letters with diacritics
+var ascii_fold = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ñ': "n", 'ń': "n", 'ň': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o",
+	'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe", 'ŕ': "r", 'ř': "r",
+	'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// slugify converts 'title' to an id: latin letters are folded to ASCII and
+// lower cased, other characters are dropped, and words are joined by '-'
+func slugify(title string) string {
+	words, word := []string(nil), new(strings.Builder)
+	for _, r := range strings.ToLower(title) {
+		if s, ok := ascii_fold[r]; ok {
+			word.WriteString(s)
+		} else if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			word.WriteRune(r)
+		} else if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return strings.Join(words, "-")
+}
+
+// compressionRatio returns the ratio of the compressed size of 'data' to its
+// original size, files are compressed by deflate in the book
+func compressionRatio(data []byte) float64 {
+	if len(data) == 0 {
+		return 1
+	}
+	buf := new(bytes.Buffer)
+	w, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	return float64(buf.Len()) / float64(len(data))
+}
+
+// xmlName returns the qualified name of 'name' which is from a raw token
+func xmlName(name xml.Name) string {
+	if len(name.Space) > 0 {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// indentXml returns 'data' re-indented by tabs, one element per line. Text of
+// elements which only contain text is kept as is, whitespace between elements
+// is dropped, so it must not be used for documents with mixed content.
+func indentXml(data []byte) ([]byte, error) {
+	var tokens []xml.Token
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	for {
+		t, e := d.RawToken()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return nil, e
+		}
+		tokens = append(tokens, xml.CopyToken(t))
+	}
+
+	buf, depth := new(bytes.Buffer), 0
+	indent := func() {
+		buf.WriteString(strings.Repeat("\t", depth))
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch t := tokens[i].(type) {
+		case xml.ProcInst:
+			buf.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>\n")
+		case xml.Directive:
+			buf.WriteString("<!" + string(t) + ">\n")
+		case xml.Comment:
+			indent()
+			buf.WriteString("<!--" + string(t) + "-->\n")
+		case xml.StartElement:
+			indent()
+			buf.WriteString("<" + xmlName(t.Name))
+			for _, a := range t.Attr {
+				buf.WriteString(" " + xmlName(a.Name) + "=\"" + html.EscapeString(a.Value) + "\"")
+			}
+			if i+1 < len(tokens) {
+				if _, ok := tokens[i+1].(xml.EndElement); ok {
+					buf.WriteString("/>\n")
+					i++
+					continue
+				}
+			}
+			if i+2 < len(tokens) {
+				cd, ok := tokens[i+1].(xml.CharData)
+				if _, end := tokens[i+2].(xml.EndElement); ok && end {
+					buf.WriteString(">" + html.EscapeString(string(cd)) + "</" + xmlName(t.Name) + ">\n")
+					i += 2
+					continue
+				}
+			}
+			buf.WriteString(">\n")
+			depth++
+		case xml.EndElement:
+			depth--
+			indent()
+			buf.WriteString("</" + xmlName(t.Name) + ">\n")
+		case xml.CharData:
+			if s := strings.TrimSpace(string(t)); len(s) > 0 {
+				indent()
+				buf.WriteString(html.EscapeString(s) + "\n")
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRatio(t *testing.T) {
+	if r := compressionRatio(nil); r != 1 {
+		t.Errorf("ratio of empty data is %f, want 1", r)
+	}
+
+	data := []byte(strings.Repeat("makeepub ", 1000))
+	buf := new(bytes.Buffer)
+	w, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	want := float64(buf.Len()) / float64(len(data))
+	if r := compressionRatio(data); r != want {
+		t.Errorf("ratio is %f, want %f", r, want)
+	}
+	if want >= 0.1 {
+		t.Errorf("repeated text is not compressed well, ratio is %f", want)
+	}
+}
+
+func TestIsOutOfRoot(t *testing.T) {
+	for p, want := range map[string]bool{
+		"a.txt":         false,
+		"images/a.jpg":  false,
+		"a/../b.txt":    false,
+		"../a.txt":      true,
+		"a/../../b.txt": true,
+		"..":            true,
+		"/etc/passwd":   true,
+		"c:/windows/a":  true,
+		"..\\a.txt":     true,
+		"":              true,
+	} {
+		if got := isOutOfRoot(p); got != want {
+			t.Errorf("isOutOfRoot('%s') is %t, want %t", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var reCssUrl = regexp.MustCompile(`url\(\s*['"]?([^'")]+)['"]?\s*\)|@import\s+['"]([^'"]+)['"]`)
+
+// findReferences returns all the local references in file 'f'
+func findReferences(f *File) []string {
+	var refs []string
+
+	if isCssFile(f.Path) {
+		for _, m := range reCssUrl.FindAllSubmatch(f.Data, -1) {
+			ref := string(m[1])
+			if len(ref) == 0 {
+				ref = string(m[2])
+			}
+			if p := resolveReference(f.Path, ref); len(p) > 0 {
+				refs = append(refs, p)
+			}
+		}
+		return refs
+	}
+
+	if !isHtmlFile(f.Path) {
+		return nil
+	}
+
+	root, e := html.Parse(bytes.NewReader(f.Data))
+	if e != nil {
+		return nil
+	}
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.DataAtom == atom.Style {
+			for _, m := range reCssUrl.FindAllStringSubmatch(nodeText(node), -1) {
+				ref := m[1]
+				if len(ref) == 0 {
+					ref = m[2]
+				}
+				if p := resolveReference(f.Path, ref); len(p) > 0 {
+					refs = append(refs, p)
+				}
+			}
+		}
+		if node.Type == html.ElementNode {
+			for _, attr := range node.Attr {
+				if attr.Key != "src" && attr.Key != "href" {
+					continue
+				}
+				if p := resolveReference(f.Path, attr.Val); len(p) > 0 {
+					refs = append(refs, p)
+				}
+			}
+		}
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			walk(n)
+		}
+	}
+	walk(root)
+
+	return refs
+}
+
+// Validate cross references the files of the book, and returns a message
+// for each reference to a missing file and each file which is never used
+func (this *Epub) Validate() []string {
+	var result []string
+
+	exists := make(map[string]bool)
+	for _, f := range this.files {
+		exists[f.Path] = true
+	}
+
+	referenced := make(map[string]bool)
+	if len(this.cover) > 0 {
+		referenced[this.cover] = true
+	}
+	for p := range this.included {
+		referenced[p] = true
+	}
+
+	for _, f := range this.files {
+		for _, p := range findReferences(f) {
+			if !exists[p] {
+				result = append(result, fmt.Sprintf("'%s' references a missing file '%s'.", f.Path, p))
+				exists[p] = true // only report once
+			}
+			referenced[p] = true
+		}
+	}
+
+	for _, f := range this.files {
+		if f.Attr&(epub_CONTENT_FILE|epub_INTERNAL_FILE) != 0 || referenced[f.Path] {
+			continue
+		}
+		result = append(result, fmt.Sprintf("'%s' is not referenced by any file.", f.Path))
+	}
+
+	return result
+}
+
+// collectIds returns all the ids in html file 'f'
+func collectIds(f *File) map[string]bool {
+	ids := make(map[string]bool)
+	if root, e := html.Parse(bytes.NewReader(f.Data)); e == nil {
+		collectNodeIds(root, ids)
+	}
+	return ids
+}
+
+// collectNodeIds adds the ids of 'node' and its descendants into 'ids'
+func collectNodeIds(node *html.Node, ids map[string]bool) {
+	if node.Type == html.ElementNode {
+		if id := getAttributeValue(node, "id", ""); len(id) > 0 {
+			ids[id] = true
+		}
+	}
+	for n := node.FirstChild; n != nil; n = n.NextSibling {
+		collectNodeIds(n, ids)
+	}
+}
+
+// ValidateAnchors checks the links from content files to 'target', and
+// returns a message for each link whose fragment does not exist in 'target'
+func (this *Epub) ValidateAnchors(target string) []string {
+	var result []string
+
+	t := this.FindFile(target)
+	if t == nil {
+		return nil
+	}
+	ids := collectIds(t)
+
+	for _, f := range this.files {
+		if f.Attr&epub_CONTENT_FILE == 0 || f == t || !isHtmlFile(f.Path) {
+			continue
+		}
+		root, e := html.Parse(bytes.NewReader(f.Data))
+		if e != nil {
+			continue
+		}
+		for _, a := range findChildren(root, atom.A) {
+			href := getAttributeValue(a, "href", "")
+			i := strings.IndexByte(href, '#')
+			if i == -1 || resolveReference(f.Path, href) != t.Path {
+				continue
+			}
+			if id := href[i+1:]; !ids[id] {
+				result = append(result, fmt.Sprintf("'%s' references a missing anchor '%s' in '%s'.", f.Path, id, t.Path))
+			}
+		}
+	}
+
+	return result
+}
+
+// ValidatePackage checks the container structure of the epub book stored in
+// 'folder': 'META-INF/container.xml' must exist, be well-formed and point to
+// an existing package document, whose manifest & spine must be consistent.
+// It returns a message for every problem found.
+func ValidatePackage(folder VirtualFolder) []string {
+	var result []string
+	fileExists := func(p string) bool {
+		rc, e := folder.OpenFile(p)
+		if e != nil {
+			return false
+		}
+		rc.Close()
+		return true
+	}
+
+	if data, e := readAll(folder, path_of_mimetype); e != nil {
+		result = append(result, "'mimetype' does not exist.")
+	} else if string(data) != "application/epub+zip" {
+		result = append(result, "the content of 'mimetype' is not 'application/epub+zip'.")
+	}
+
+	data, e := readAll(folder, path_of_container_xml)
+	if e != nil {
+		return append(result, fmt.Sprintf("'%s' does not exist.", path_of_container_xml))
+	}
+	var container xmlContainer
+	if e = xml.Unmarshal(data, &container); e != nil {
+		return append(result, fmt.Sprintf("'%s' is not well-formed: %s.", path_of_container_xml, e.Error()))
+	}
+	if len(container.Rootfiles) == 0 {
+		return append(result, fmt.Sprintf("no rootfile in '%s'.", path_of_container_xml))
+	}
+	rootfile := container.Rootfiles[0]
+	if rootfile.MediaType != "application/oebps-package+xml" {
+		result = append(result, fmt.Sprintf("the media type of rootfile '%s' is not 'application/oebps-package+xml'.", rootfile.FullPath))
+	}
+	opfPath := rootfile.FullPath
+	if data, e = readAll(folder, opfPath); e != nil {
+		return append(result, fmt.Sprintf("package document '%s' does not exist.", opfPath))
+	}
+	var opf xmlOpf
+	if e = xml.Unmarshal(data, &opf); e != nil {
+		return append(result, fmt.Sprintf("package document '%s' is not well-formed: %s.", opfPath, e.Error()))
+	}
+
+	items, hrefs, navs := make(map[string]*xmlOpfItem), make(map[string]string), 0
+	for i := range opf.Manifest {
+		item := &opf.Manifest[i]
+		if len(item.Id) == 0 {
+			result = append(result, fmt.Sprintf("manifest item '%s' has no id.", item.Href))
+		} else if _, ok := items[item.Id]; ok {
+			result = append(result, fmt.Sprintf("manifest item id '%s' is duplicated.", item.Id))
+		} else {
+			items[item.Id] = item
+		}
+		if len(item.MediaType) == 0 {
+			result = append(result, fmt.Sprintf("manifest item '%s' has no media type.", item.Id))
+		}
+		if containsField(item.Properties, "nav") {
+			navs++
+		}
+		if strings.Contains(item.Href, "://") {
+			continue
+		}
+		href, e := url.PathUnescape(item.Href)
+		if e != nil || len(href) == 0 {
+			result = append(result, fmt.Sprintf("manifest item '%s' has an invalid href '%s'.", item.Id, item.Href))
+			continue
+		}
+		p := path.Join(path.Dir(opfPath), href)
+		if id, ok := hrefs[p]; ok {
+			result = append(result, fmt.Sprintf("manifest items '%s' and '%s' refer to the same file '%s'.", id, item.Id, p))
+		} else if hrefs[p] = item.Id; !fileExists(p) {
+			result = append(result, fmt.Sprintf("manifest item '%s' refers to a missing file '%s'.", item.Id, p))
+		}
+	}
+
+	if strings.HasPrefix(opf.Version, "3") && navs != 1 {
+		result = append(result, fmt.Sprintf("the manifest must have exactly one 'nav' item, but %d found.", navs))
+	}
+	if len(opf.Spine.Toc) > 0 {
+		if _, ok := items[opf.Spine.Toc]; !ok {
+			result = append(result, fmt.Sprintf("the spine 'toc' refers to a missing manifest item '%s'.", opf.Spine.Toc))
+		}
+	} else if !strings.HasPrefix(opf.Version, "3") {
+		result = append(result, "the spine has no 'toc' attribute, which is required by EPUB2.")
+	}
+	if len(opf.Spine.Items) == 0 {
+		result = append(result, "the spine is empty.")
+	}
+	referenced := make(map[string]bool)
+	for _, ref := range opf.Spine.Items {
+		if _, ok := items[ref.IdRef]; !ok {
+			result = append(result, fmt.Sprintf("spine item refers to a missing manifest item '%s'.", ref.IdRef))
+		} else if referenced[ref.IdRef] {
+			result = append(result, fmt.Sprintf("manifest item '%s' is referenced by the spine more than once.", ref.IdRef))
+		}
+		referenced[ref.IdRef] = true
+		if ref.Linear != "" && ref.Linear != "yes" && ref.Linear != "no" {
+			result = append(result, fmt.Sprintf("spine item '%s' has an invalid linear attribute '%s'.", ref.IdRef, ref.Linear))
+		}
+	}
+
+	return result
+}
+
+// RunValidate checks the container structure of an existing epub book
+func RunValidate() {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 {
+		onCommandLineError()
+	}
+	folder, e := OpenZipFolder(inpath)
+	if e != nil {
+		logger.Fatalf("failed to open '%s'.\n", inpath)
+	}
+
+	problems := ValidatePackage(folder)
+	for _, msg := range problems {
+		logger.Printf("%s: %s\n", inpath, msg)
+	}
+	if len(problems) == 0 {
+		logger.Printf("%s: no problem found.\n", inpath)
+		return
+	}
+	logger.Printf("%s: %d problem(s) found.\n", inpath, len(problems))
+	exitCode = 1
+}
+
+func init() {
+	AddCommandHandler("validate", RunValidate)
+}
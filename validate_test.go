@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePackage(t *testing.T) {
+	maker := makeBook(t, map[string]string{
+		"book.ini":  "[book]\nname=Test\nauthor=Tester\n",
+		"book.html": "<html><head></head><body><h1>One</h1><p>1</p></body></html>",
+	})
+	zr := buildArchive(t, maker.book, EPUB_VERSION_300)
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		files[f.Name] = readEntry(t, zr, f.Name)
+	}
+	validate := func(files map[string]string) []string {
+		folder, e := NewZipFolder(makeZip(t, files, time.Now()))
+		if e != nil {
+			t.Fatal(e)
+		}
+		return ValidatePackage(folder)
+	}
+	if problems := validate(files); len(problems) != 0 {
+		t.Errorf("problems are found in a valid book:\n%s", strings.Join(problems, "\n"))
+	}
+
+	container := files[path_of_container_xml]
+	for _, c := range []struct{ container, want string }{
+		{"", "'META-INF/container.xml' does not exist."},
+		{"<container><rootfiles>", "'META-INF/container.xml' is not well-formed"},
+		{"<container><rootfiles></rootfiles></container>", "no rootfile in 'META-INF/container.xml'."},
+		{strings.Replace(container, "content.opf", "missing.opf", 1), "package document 'missing.opf' does not exist."},
+	} {
+		broken := make(map[string]string)
+		for name, data := range files {
+			broken[name] = data
+		}
+		if len(c.container) == 0 {
+			delete(broken, path_of_container_xml)
+		} else {
+			broken[path_of_container_xml] = c.container
+		}
+		problems := validate(broken)
+		if len(problems) != 1 || !strings.HasPrefix(problems[0], c.want) {
+			t.Errorf("problems are %q, want '%s'", problems, c.want)
+		}
+	}
+
+	// the manifest refers to a missing file
+	broken := make(map[string]string)
+	for name, data := range files {
+		if name != "nav.xhtml" {
+			broken[name] = data
+		}
+	}
+	if problems := validate(broken); len(problems) != 1 || !strings.Contains(problems[0], "refers to a missing file 'nav.xhtml'") {
+		t.Errorf("problems are %q, want the missing 'nav.xhtml'", problems)
+	}
+}